@@ -22,4 +22,9 @@ const (
 	OBJECT_MARKER = 0x0a
 	XML_MARKER = 0x0b
 	BYTEARRAY_MARKER = 0x0c
+	VECTOR_INT_MARKER = 0x0d
+	VECTOR_UINT_MARKER = 0x0e
+	VECTOR_DOUBLE_MARKER = 0x0f
+	VECTOR_OBJECT_MARKER = 0x10
+	DICTIONARY_MARKER = 0x11
 )
@@ -0,0 +1,453 @@
+package amf
+
+import (
+	"errors"
+	"strconv"
+)
+
+//markers of AMF0, used by remoting packets and RTMP commands
+const (
+	AMF0_NUMBER_MARKER       = 0x00
+	AMF0_BOOLEAN_MARKER      = 0x01
+	AMF0_STRING_MARKER       = 0x02
+	AMF0_OBJECT_MARKER       = 0x03
+	AMF0_MOVIECLIP_MARKER    = 0x04
+	AMF0_NULL_MARKER         = 0x05
+	AMF0_UNDEFINED_MARKER    = 0x06
+	AMF0_REFERENCE_MARKER    = 0x07
+	AMF0_ECMA_ARRAY_MARKER   = 0x08
+	AMF0_OBJECT_END_MARKER   = 0x09
+	AMF0_STRICT_ARRAY_MARKER = 0x0a
+	AMF0_DATE_MARKER         = 0x0b
+	AMF0_LONG_STRING_MARKER  = 0x0c
+	AMF0_UNSUPPORTED_MARKER  = 0x0d
+	AMF0_RECORDSET_MARKER    = 0x0e
+	AMF0_XMLDOC_MARKER       = 0x0f
+	AMF0_TYPED_OBJECT_MARKER = 0x10
+	AMF0_AVMPLUS_MARKER      = 0x11
+)
+
+//ReadAMF0Value decodes the next AMF0 value as a document tree. Numbers are
+//KindDouble, ecma arrays are arrays with associative members only, and a
+//value after the AVM+ marker is read as AMF3 with the tables of the decoder.
+func (decoder *Decoder) ReadAMF0Value() (*Value, error) {
+	err := decoder.peekMarker()
+	if err != nil {
+		return nil, err
+	}
+
+	decoder.startValue()
+	value, err := decoder.readNextAMF0()
+	if decoder.depth > 0 {
+		return value, err
+	}
+	return value, topPath(err)
+}
+
+func (decoder *Decoder) readNextAMF0() (*Value, error) {
+	marker, err := decoder.readMarker()
+	if err != nil {
+		return nil, decodeError(err, decoder.offset, 0, nil)
+	}
+
+	offset := decoder.offset - 1
+	defer decoder.leave()
+	err = decoder.enter()
+	if err != nil {
+		return nil, decodeError(err, offset, marker, nil)
+	}
+
+	value, err := decoder.readAMF0(marker)
+	if err != nil {
+		return nil, decodeError(err, offset, marker, nil)
+	}
+
+	return value, nil
+}
+
+func (decoder *Decoder) readAMF0(marker byte) (*Value, error) {
+	switch marker {
+	case AMF0_NUMBER_MARKER:
+		f, err := decoder.readDouble()
+		if err != nil {
+			return nil, err
+		}
+		return NewDouble(f), nil
+	case AMF0_BOOLEAN_MARKER:
+		b, err := decoder.readByte()
+		if err != nil {
+			return nil, err
+		}
+		return NewBool(b != 0), nil
+	case AMF0_STRING_MARKER:
+		s, err := decoder.readShortString()
+		if err != nil {
+			return nil, err
+		}
+		return NewString(s), nil
+	case AMF0_LONG_STRING_MARKER:
+		s, err := decoder.readLongString()
+		if err != nil {
+			return nil, err
+		}
+		return NewString(s), nil
+	case AMF0_XMLDOC_MARKER:
+		s, err := decoder.readLongString()
+		if err != nil {
+			return nil, err
+		}
+		return &Value{Kind: KindXMLDocument, Str: s}, nil
+	case AMF0_NULL_MARKER:
+		return NewNull(), nil
+	case AMF0_UNDEFINED_MARKER, AMF0_UNSUPPORTED_MARKER:
+		return NewUndefined(), nil
+	case AMF0_DATE_MARKER:
+		ms, err := decoder.readDouble()
+		if err != nil {
+			return nil, err
+		}
+		//the time zone is reserved and ignored
+		err = decoder.readFull(decoder.scratch[:2])
+		if err != nil {
+			return nil, err
+		}
+		return &Value{Kind: KindDate, Float: ms}, nil
+	case AMF0_REFERENCE_MARKER:
+		index, err := decoder.readUint16()
+		if err != nil {
+			return nil, err
+		}
+		if int(index) >= len(decoder.amf0Objects) {
+			return nil, errors.New("invalid object reference:" + strconv.Itoa(int(index)))
+		}
+		return decoder.amf0Objects[index], nil
+	case AMF0_OBJECT_MARKER, AMF0_TYPED_OBJECT_MARKER:
+		class := ""
+		if marker == AMF0_TYPED_OBJECT_MARKER {
+			var err error
+			class, err = decoder.readShortString()
+			if err != nil {
+				return nil, err
+			}
+		}
+		value := NewObject(class)
+		err := decoder.addAMF0Object(value)
+		if err != nil {
+			return nil, err
+		}
+		return value, decoder.readAMF0Members(value)
+	case AMF0_ECMA_ARRAY_MARKER:
+		//the count is a hint only, the members end like those of an object
+		_, err := decoder.readUint32()
+		if err != nil {
+			return nil, err
+		}
+		value := &Value{Kind: KindArray}
+		err = decoder.addAMF0Object(value)
+		if err != nil {
+			return nil, err
+		}
+		return value, decoder.readAMF0Members(value)
+	case AMF0_STRICT_ARRAY_MARKER:
+		return decoder.readAMF0Array()
+	case AMF0_AVMPLUS_MARKER:
+		return decoder.readNextValue()
+	}
+
+	return nil, errors.New("unsupported amf0 marker:" + strconv.Itoa(int(marker)))
+}
+
+func (decoder *Decoder) readAMF0Members(value *Value) error {
+	for n := 1; ; n++ {
+		key, err := decoder.readShortString()
+		if err != nil {
+			return err
+		}
+
+		if key == "" {
+			end, err := decoder.readMarker()
+			if err != nil {
+				return err
+			}
+			if end != AMF0_OBJECT_END_MARKER {
+				return errors.New("object end expected, found marker:" + strconv.Itoa(int(end)))
+			}
+			return nil
+		}
+
+		err = decoder.checkMembers(n)
+		if err != nil {
+			return err
+		}
+
+		member, err := decoder.readNextAMF0()
+		if err != nil {
+			return prependPath(err, memberElem(key))
+		}
+		value.Members = append(value.Members, Member{Key: key, Value: member})
+	}
+}
+
+func (decoder *Decoder) readAMF0Array() (*Value, error) {
+	length, err := decoder.readUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	err = decoder.checkMembers(int(length))
+	if err != nil {
+		return nil, err
+	}
+
+	value := &Value{Kind: KindArray, Elements: make([]*Value, 0, min(length, maxPrealloc))}
+	err = decoder.addAMF0Object(value)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < int(length); i++ {
+		element, err := decoder.readNextAMF0()
+		if err != nil {
+			return nil, prependPath(err, indexElem(i))
+		}
+		value.Elements = append(value.Elements, element)
+	}
+
+	return value, nil
+}
+
+func (decoder *Decoder) addAMF0Object(value *Value) error {
+	if decoder.maxReferences > 0 && len(decoder.amf0Objects) >= decoder.maxReferences {
+		return ErrTooManyReferences
+	}
+	decoder.amf0Objects = append(decoder.amf0Objects, value)
+	return nil
+}
+
+func (decoder *Decoder) readShortString() (string, error) {
+	length, err := decoder.readUint16()
+	if err != nil {
+		return "", err
+	}
+	return decoder.readAMF0String(int(length))
+}
+
+func (decoder *Decoder) readLongString() (string, error) {
+	length, err := decoder.readUint32()
+	if err != nil {
+		return "", err
+	}
+	return decoder.readAMF0String(int(length))
+}
+
+func (decoder *Decoder) readAMF0String(length int) (string, error) {
+	err := decoder.checkString(length)
+	if err != nil {
+		return "", err
+	}
+
+	bytes, err := decoder.readBytes(length)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+//WriteAMF0Value encodes value as AMF0. Values other than a *Value are
+//encoded through their document tree, see Marshal. Byte arrays, vectors,
+//dictionaries, xml and externalizable objects have no AMF0 form, they are
+//written as AMF3 after the AVM+ marker.
+func (encoder *Encoder) WriteAMF0Value(value AMFAny) error {
+	encoder.depth++
+	err := encoder.writeAMF0Any(value)
+	encoder.depth--
+	if encoder.depth > 0 {
+		return err
+	}
+	return encoder.flush(topPath(err))
+}
+
+func (encoder *Encoder) writeAMF0Any(value AMFAny) error {
+	v, ok := value.(*Value)
+	if !ok {
+		data, err := Marshal(value, ReservStruct(encoder.reservStruct))
+		if err != nil {
+			return err
+		}
+		v, err = UnmarshalAs[*Value](data)
+		if err != nil {
+			return err
+		}
+	}
+	return encoder.writeAMF0(v)
+}
+
+func (encoder *Encoder) writeAMF0(value *Value) error {
+	err := encoder.writeAMF0Kind(value)
+	if err != nil {
+		return encodeError(err, valueType)
+	}
+	return nil
+}
+
+func (encoder *Encoder) writeAMF0Kind(value *Value) error {
+	if value == nil {
+		return encoder.writeMarker(AMF0_NULL_MARKER)
+	}
+
+	switch value.Kind {
+	case KindUndefined:
+		return encoder.writeMarker(AMF0_UNDEFINED_MARKER)
+	case KindNull:
+		return encoder.writeMarker(AMF0_NULL_MARKER)
+	case KindBool:
+		encoder.writeMarker(AMF0_BOOLEAN_MARKER)
+		if value.Bool {
+			return encoder.writeMarker(1)
+		}
+		return encoder.writeMarker(0)
+	case KindInteger:
+		encoder.writeMarker(AMF0_NUMBER_MARKER)
+		return encoder.writeDouble(float64(value.Int))
+	case KindDouble:
+		encoder.writeMarker(AMF0_NUMBER_MARKER)
+		return encoder.writeDouble(value.Float)
+	case KindString:
+		if len(value.Str) > 0xffff {
+			encoder.writeMarker(AMF0_LONG_STRING_MARKER)
+			encoder.writeUint32(uint32(len(value.Str)))
+			return encoder.writeBytes([]byte(value.Str))
+		}
+		encoder.writeMarker(AMF0_STRING_MARKER)
+		return encoder.writeShortString(value.Str)
+	case KindDate:
+		encoder.writeMarker(AMF0_DATE_MARKER)
+		encoder.writeDouble(value.Float)
+		return encoder.writeUint16(0)
+	case KindXMLDocument:
+		encoder.writeMarker(AMF0_XMLDOC_MARKER)
+		encoder.writeUint32(uint32(len(value.Str)))
+		return encoder.writeBytes([]byte(value.Str))
+	case KindArray:
+		return encoder.writeAMF0Array(value)
+	case KindObject:
+		if value.Traits == nil || !value.Traits.Externalizable {
+			return encoder.writeAMF0Object(value)
+		}
+	}
+
+	encoder.writeMarker(AMF0_AVMPLUS_MARKER)
+	return encoder.writeValue(value)
+}
+
+//writeAMF0Reference writes a reference if the value has been written before,
+//otherwise it registers the value in the AMF0 object table
+func (encoder *Encoder) writeAMF0Reference(value *Value) bool {
+	if encoder.amf0Cache == nil {
+		encoder.amf0Cache = make(map[*Value]int)
+	}
+
+	index, ok := encoder.amf0Cache[value]
+	if ok {
+		encoder.writeMarker(AMF0_REFERENCE_MARKER)
+		encoder.writeUint16(uint16(index))
+		return true
+	}
+
+	//references have 16 bits, later objects are written again each time
+	if len(encoder.amf0Cache) <= 0xffff {
+		encoder.amf0Cache[value] = len(encoder.amf0Cache)
+	}
+	return false
+}
+
+func (encoder *Encoder) writeAMF0Array(value *Value) error {
+	if encoder.writeAMF0Reference(value) {
+		return nil
+	}
+
+	if len(value.Members) == 0 {
+		encoder.writeMarker(AMF0_STRICT_ARRAY_MARKER)
+		encoder.writeUint32(uint32(len(value.Elements)))
+		for i, element := range value.Elements {
+			err := encoder.writeAMF0(element)
+			if err != nil {
+				return prependPath(err, indexElem(i))
+			}
+		}
+		return nil
+	}
+
+	encoder.writeMarker(AMF0_ECMA_ARRAY_MARKER)
+	encoder.writeUint32(uint32(len(value.Elements) + len(value.Members)))
+	for i, element := range value.Elements {
+		encoder.writeShortString(strconv.Itoa(i))
+		err := encoder.writeAMF0(element)
+		if err != nil {
+			return prependPath(err, indexElem(i))
+		}
+	}
+	return encoder.writeAMF0Members(value.Members)
+}
+
+func (encoder *Encoder) writeAMF0Object(value *Value) error {
+	if encoder.writeAMF0Reference(value) {
+		return nil
+	}
+
+	class := value.Class()
+	if class == "" {
+		encoder.writeMarker(AMF0_OBJECT_MARKER)
+	} else {
+		encoder.writeMarker(AMF0_TYPED_OBJECT_MARKER)
+		err := encoder.writeShortString(class)
+		if err != nil {
+			return err
+		}
+	}
+
+	if value.Traits != nil {
+		if len(value.Sealed) != len(value.Traits.Members) {
+			return errors.New("object of class:" + class + " has " + strconv.Itoa(len(value.Sealed)) + " sealed values for " + strconv.Itoa(len(value.Traits.Members)) + " members")
+		}
+		for i, name := range value.Traits.Members {
+			err := encoder.writeShortString(name)
+			if err != nil {
+				return err
+			}
+			err = encoder.writeAMF0(value.Sealed[i])
+			if err != nil {
+				return prependPath(err, memberElem(name))
+			}
+		}
+	}
+
+	return encoder.writeAMF0Members(value.Members)
+}
+
+func (encoder *Encoder) writeAMF0Members(members []Member) error {
+	for _, m := range members {
+		if m.Key == "" {
+			return errors.New("empty key not allowed in object")
+		}
+		err := encoder.writeShortString(m.Key)
+		if err != nil {
+			return err
+		}
+		err = encoder.writeAMF0(m.Value)
+		if err != nil {
+			return prependPath(err, memberElem(m.Key))
+		}
+	}
+
+	encoder.writeUint16(0)
+	return encoder.writeMarker(AMF0_OBJECT_END_MARKER)
+}
+
+func (encoder *Encoder) writeShortString(value string) error {
+	if len(value) > 0xffff {
+		return errors.New("string of length:" + strconv.Itoa(len(value)) + " too long for amf0")
+	}
+	encoder.writeUint16(uint16(len(value)))
+	return encoder.writeBytes([]byte(value))
+}
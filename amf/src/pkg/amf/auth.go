@@ -0,0 +1,241 @@
+package amf
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CredentialsHeader = "Credentials"  //header of NetConnection.setCredentials, {userid, password}
+	SessionCookie     = "AMFSESSIONID" //cookie of the sessions of a Gateway
+)
+
+//Authenticator checks the credentials a client sends with the Credentials
+//header or a flex login and returns the principal of its session, which the
+//calls of the session find with PrincipalFrom
+type Authenticator func(ctx context.Context, username, password string) (AMFAny, error)
+
+type session struct {
+	principal AMFAny
+	expires   time.Time
+	closed    bool //refused until it expires, e.g. a DSId disconnected
+}
+
+//sessionStore keeps the principals of the sessions of a gateway, by the id
+//of their cookie or by the DSId of flex clients
+type sessionStore struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	sessions map[string]*session
+	swept    time.Time
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{timeout: 30 * time.Minute, sessions: make(map[string]*session)}
+}
+
+//principal returns the principal of a session and extends it
+func (store *sessionStore) principal(id string) (AMFAny, bool) {
+	if id == "" {
+		return nil, false
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	s, ok := store.sessions[id]
+	if !ok || s.closed {
+		return nil, false
+	}
+	now := time.Now()
+	if now.After(s.expires) {
+		delete(store.sessions, id)
+		return nil, false
+	}
+	s.expires = now.Add(store.timeout)
+	return s.principal, true
+}
+
+func (store *sessionStore) put(id string, principal AMFAny) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	store.sweep(now)
+	store.sessions[id] = &session{principal: principal, expires: now.Add(store.timeout)}
+}
+
+//add begins a session unless one with the id exists, closed or not
+func (store *sessionStore) add(id string, principal AMFAny) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	store.sweep(now)
+	if s, ok := store.sessions[id]; ok && !now.After(s.expires) {
+		return false
+	}
+	store.sessions[id] = &session{principal: principal, expires: now.Add(store.timeout)}
+	return true
+}
+
+//sweep drops the expired sessions, at most every half timeout
+func (store *sessionStore) sweep(now time.Time) {
+	if now.Sub(store.swept) < store.timeout/2 {
+		return
+	}
+	store.swept = now
+	for id, s := range store.sessions {
+		if now.After(s.expires) {
+			delete(store.sessions, id)
+		}
+	}
+}
+
+func (store *sessionStore) remove(id string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.sessions, id)
+}
+
+//close ends a session but keeps its id until it expires, for add to refuse it
+func (store *sessionStore) close(id string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if s, ok := store.sessions[id]; ok {
+		s.principal = nil
+		s.closed = true
+	}
+}
+
+func (store *sessionStore) getTimeout() time.Duration {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.timeout
+}
+
+//SetAuthenticator makes the gateway authenticate the Credentials header and
+//the flex logins with auth. Without an authenticator the header is ignored
+//and logins fail.
+func (gateway *Gateway) SetAuthenticator(auth Authenticator) {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	gateway.auth = auth
+}
+
+//SetSessionTimeout sets how long a session, and the DSId of a flex client,
+//lasts without calls, 30 minutes by default
+func (gateway *Gateway) SetSessionTimeout(timeout time.Duration) {
+	for _, store := range []*sessionStore{gateway.sessions, gateway.clients} {
+		store.mu.Lock()
+		store.timeout = timeout
+		store.mu.Unlock()
+	}
+}
+
+func (gateway *Gateway) getAuthenticator() Authenticator {
+	gateway.mu.RLock()
+	defer gateway.mu.RUnlock()
+	return gateway.auth
+}
+
+//authenticate checks credentials with the authenticator of the gateway
+func (gateway *Gateway) authenticate(ctx context.Context, username, password string) (AMFAny, error) {
+	auth := gateway.getAuthenticator()
+	if auth == nil {
+		return nil, &Fault{Code: "Client.Authentication", Message: "login not supported"}
+	}
+
+	principal, err := auth(ctx, username, password)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnauthorized, err)
+	}
+	if principal == nil {
+		return nil, ErrUnauthorized
+	}
+	return principal, nil
+}
+
+//sessionContext returns the context of the calls of a request, carrying the
+//principal of its session cookie. A Credentials header begins a new session,
+//its error fails the calls.
+func (gateway *Gateway) sessionContext(w http.ResponseWriter, r *http.Request, headers []Header) (context.Context, error) {
+	ctx := r.Context()
+	var id string
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		id = cookie.Value
+	}
+
+	var credentials *Value
+	for i := range headers {
+		if headers[i].Name == CredentialsHeader {
+			credentials, _ = headers[i].Value.(*Value)
+		}
+	}
+	if credentials == nil || gateway.getAuthenticator() == nil {
+		if principal, ok := gateway.sessions.principal(id); ok {
+			ctx = WithPrincipal(ctx, principal)
+		}
+		return ctx, nil
+	}
+
+	principal, err := gateway.authenticate(ctx, memberString(credentials, "userid"), memberString(credentials, "password"))
+	if err != nil {
+		return ctx, err
+	}
+
+	//a new id for every login, the ids clients come with are never trusted
+	if id != "" {
+		gateway.sessions.remove(id)
+	}
+	id = newUUID()
+	gateway.sessions.put(id, principal)
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Value: id, Path: "/", HttpOnly: true})
+	return WithPrincipal(ctx, principal), nil
+}
+
+//login authenticates the base64 "username:password" body of a flex login
+//and begins a session under a new DSId, sent back with the acknowledgement
+func (gateway *Gateway) login(ctx context.Context, in *flexRequest) (AMFAny, error) {
+	var encoded string
+	if in.body != nil && in.body.Kind == KindString {
+		encoded = in.body.Str
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, &Fault{Code: "Client.Authentication", Message: "invalid credentials:" + err.Error()}
+	}
+
+	credentials := string(decoded)
+	if strings.EqualFold(memberString(in.headers, DSCredentialsCharsetHeader), "ISO-8859-1") {
+		runes := make([]rune, len(decoded))
+		for i, c := range decoded {
+			runes[i] = rune(c)
+		}
+		credentials = string(runes)
+	}
+
+	username, password, ok := strings.Cut(credentials, ":")
+	if !ok {
+		return nil, &Fault{Code: "Client.Authentication", Message: "invalid credentials"}
+	}
+
+	principal, err := gateway.authenticate(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+	//like the cookies, the DSId the client logged in with is replaced
+	if broker := gateway.getBroker(); broker != nil {
+		broker.Disconnect(in.dsId)
+	}
+	gateway.sessions.remove(in.dsId)
+	gateway.clients.close(in.dsId)
+	in.dsId = gateway.newDSId()
+	gateway.sessions.put(in.dsId, principal)
+	return in.ack("success"), nil
+}
@@ -0,0 +1,251 @@
+package amf
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func authGateway() *Gateway {
+	gateway := NewGateway()
+	gateway.SetAuthenticator(func(ctx context.Context, username, password string) (AMFAny, error) {
+		if username == "bob" && password == "pässword" {
+			return "bob", nil
+		}
+		return nil, errors.New("bad password")
+	})
+	gateway.Handle("Auth.who", func(ctx context.Context, call *Call) (AMFAny, error) {
+		principal, ok := PrincipalFrom(ctx)
+		if !ok {
+			return nil, ErrUnauthorized
+		}
+		return principal, nil
+	})
+	return gateway
+}
+
+func withCookie(handler http.Handler, cookie *http.Cookie) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.AddCookie(cookie)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func TestCredentialsHeader(t *testing.T) {
+	gateway := authGateway()
+	who := func(handler http.Handler, headers ...Header) (string, []*http.Cookie) {
+		t.Helper()
+		response, recorder := postPacket(t, handler, &Packet{Headers: headers, Messages: []Message{{Target: "Auth.who", Response: "/1", Data: []AMFAny{}}}})
+		data := response.Messages[0].Data.(*Value)
+		if response.Messages[0].Target == "/1/onStatus" {
+			return memberString(data, "code"), recorder.Result().Cookies()
+		}
+		return data.Str, recorder.Result().Cookies()
+	}
+	credentials := func(password string) Header {
+		return Header{Name: CredentialsHeader, Value: map[string]AMFAny{"userid": "bob", "password": password}}
+	}
+
+	if got, _ := who(gateway); got != "Client.Authentication" {
+		t.Errorf("without credentials answered %s", got)
+	}
+	if got, cookies := who(gateway, credentials("nope")); got != "Client.Authentication" || len(cookies) != 0 {
+		t.Errorf("bad credentials answered %s, %v", got, cookies)
+	}
+
+	got, cookies := who(gateway, credentials("pässword"))
+	if got != "bob" || len(cookies) != 1 || cookies[0].Name != SessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("credentials answered %s, %v", got, cookies)
+	}
+	if got, _ := who(withCookie(gateway, cookies[0])); got != "bob" {
+		t.Errorf("session answered %s", got)
+	}
+	if got, _ := who(withCookie(gateway, &http.Cookie{Name: SessionCookie, Value: "forged"})); got != "Client.Authentication" {
+		t.Errorf("forged session answered %s", got)
+	}
+
+	//logging in again replaces the id of the session
+	got, again := who(withCookie(gateway, cookies[0]), credentials("pässword"))
+	if got != "bob" || len(again) != 1 || again[0].Value == cookies[0].Value {
+		t.Fatalf("second login answered %s, %v", got, again)
+	}
+	if got, _ := who(withCookie(gateway, cookies[0])); got != "Client.Authentication" {
+		t.Errorf("replaced session answered %s", got)
+	}
+
+	gateway.SetSessionTimeout(time.Nanosecond)
+	_, cookies = who(gateway, credentials("pässword"))
+	time.Sleep(time.Millisecond)
+	if got, _ := who(withCookie(gateway, cookies[0])); got != "Client.Authentication" {
+		t.Errorf("expired session answered %s", got)
+	}
+}
+
+func TestFlexLogin(t *testing.T) {
+	gateway := authGateway()
+	who := func(dsId string) *ErrorMessage {
+		t.Helper()
+		reply := postFlex(t, gateway, &RemotingMessage{Destination: "Auth", Operation: "who", MessageId: "R", Body: []AMFAny{}, Headers: map[string]AMFAny{DSIdHeader: dsId}}, "")
+		if reply.Class() == "flex.messaging.messages.AcknowledgeMessage" {
+			return nil
+		}
+		var message ErrorMessage
+		reply.Decode(&message)
+		return &message
+	}
+	login := func(dsId, credentials, charset string) (string, *ErrorMessage) {
+		t.Helper()
+		headers := map[string]AMFAny{DSIdHeader: dsId}
+		if charset != "" {
+			headers[DSCredentialsCharsetHeader] = charset
+		}
+		reply := postFlex(t, gateway, &CommandMessage{Operation: LOGIN_OPERATION, MessageId: "L", Body: base64.StdEncoding.EncodeToString([]byte(credentials)), Headers: headers}, "")
+		if reply.Class() == "flex.messaging.messages.AcknowledgeMessage" {
+			var ack AcknowledgeMessage
+			reply.Decode(&ack)
+			dsId, _ := ack.Headers[DSIdHeader].(string)
+			return dsId, nil
+		}
+		var message ErrorMessage
+		reply.Decode(&message)
+		return "", &message
+	}
+
+	dsId := ping(t, gateway)
+	if fault := who(dsId); fault == nil || fault.FaultCode != "Client.Authentication" {
+		t.Errorf("call without login answered %+v", fault)
+	}
+	if _, fault := login(dsId, "bob:wrong", ""); fault == nil || fault.FaultCode != "Client.Authentication" {
+		t.Errorf("bad login answered %+v", fault)
+	}
+	if _, fault := login(dsId, "bob", ""); fault == nil || fault.FaultString != "invalid credentials" {
+		t.Errorf("login without password answered %+v", fault)
+	}
+
+	session, fault := login(dsId, "bob:p\xe4ssword", "ISO-8859-1")
+	if fault != nil || session == "" || session == dsId {
+		t.Fatalf("login answered DSId %q, %+v", session, fault)
+	}
+	if fault := who(session); fault != nil {
+		t.Errorf("call of the session answered %+v", fault)
+	}
+	if fault := who(dsId); fault == nil || fault.FaultCode != "Server.Processing.UnknownDSId" {
+		t.Errorf("call with the DSId before login answered %+v", fault)
+	}
+
+	postFlex(t, gateway, &CommandMessage{Operation: LOGOUT_OPERATION, MessageId: "O", Headers: map[string]AMFAny{DSIdHeader: session}}, "onResult")
+	if fault := who(session); fault == nil || fault.FaultCode != "Client.Authentication" {
+		t.Errorf("call after logout answered %+v", fault)
+	}
+
+	session, fault = login(session, "bob:pässword", "UTF-8")
+	if fault != nil {
+		t.Fatalf("login after logout answered %+v", fault)
+	}
+	postFlex(t, gateway, &CommandMessage{Operation: DISCONNECT_OPERATION, MessageId: "D", Headers: map[string]AMFAny{DSIdHeader: session}}, "onResult")
+	if fault := who(session); fault == nil || fault.FaultCode != "Server.Processing.UnknownDSId" {
+		t.Errorf("call after disconnect answered %+v", fault)
+	}
+
+	gateway = NewGateway()
+	reply := postFlex(t, gateway, &CommandMessage{Operation: LOGIN_OPERATION, MessageId: "L", Body: "eDp5", Headers: map[string]AMFAny{DSIdHeader: ping(t, gateway)}}, "onStatus")
+	if memberString(reply, "faultString") != "login not supported" {
+		t.Errorf("login without authenticator answered %v", reply)
+	}
+}
+
+//TestFlexDSId checks the gateway answers the DSIds it issued only
+func TestFlexDSId(t *testing.T) {
+	gateway := authGateway()
+	for _, dsId := range []string{"forged", "nil"} {
+		for _, message := range []AMFAny{
+			&CommandMessage{Operation: CLIENT_PING_OPERATION, MessageId: "P", Headers: map[string]AMFAny{DSIdHeader: dsId}},
+			&CommandMessage{Operation: LOGIN_OPERATION, MessageId: "L", Body: base64.StdEncoding.EncodeToString([]byte("bob:pässword")), Headers: map[string]AMFAny{DSIdHeader: dsId}},
+			&RemotingMessage{Destination: "Auth", Operation: "who", MessageId: "R", Headers: map[string]AMFAny{DSIdHeader: dsId}},
+		} {
+			reply := postFlex(t, gateway, message, "")
+			var answer ErrorMessage
+			reply.Decode(&answer)
+			issued, _ := answer.Headers[DSIdHeader].(string)
+			switch {
+			case dsId == "forged" && answer.FaultCode != "Server.Processing.UnknownDSId":
+				t.Errorf("%T with a forged DSId answered %+v", message, answer)
+			case dsId == "nil" && (issued == "nil" || issued == "" || answer.FaultCode == "Server.Processing.UnknownDSId"):
+				t.Errorf("%T without DSId answered %+v", message, answer)
+			}
+		}
+	}
+
+	//DSIds are kept once clients come back with them
+	gateway = authGateway()
+	var dsId string
+	for i := 0; i < 100; i++ {
+		dsId = ping(t, gateway)
+	}
+	if n := len(gateway.clients.sessions); n != 0 {
+		t.Errorf("%d DSIds kept before use", n)
+	}
+	postFlex(t, gateway, &CommandMessage{Operation: CLIENT_PING_OPERATION, MessageId: "P", Headers: map[string]AMFAny{DSIdHeader: dsId}}, "onResult")
+	if n := len(gateway.clients.sessions); n != 1 {
+		t.Errorf("%d DSIds kept after use", n)
+	}
+
+	tampered := []byte(ping(t, gateway))
+	tampered[len(tampered)-1] ^= 1
+	for _, dsId := range []string{string(tampered), ping(t, authGateway())} {
+		reply := postFlex(t, gateway, &CommandMessage{Operation: CLIENT_PING_OPERATION, MessageId: "P", Headers: map[string]AMFAny{DSIdHeader: dsId}}, "onStatus")
+		if memberString(reply, "faultCode") != "Server.Processing.UnknownDSId" {
+			t.Errorf("DSId %s answered %v", dsId, reply)
+		}
+	}
+
+	gateway.SetSessionTimeout(time.Nanosecond)
+	dsId = ping(t, gateway)
+	time.Sleep(time.Millisecond)
+	reply := postFlex(t, gateway, &CommandMessage{Operation: CLIENT_PING_OPERATION, MessageId: "P", Headers: map[string]AMFAny{DSIdHeader: dsId}}, "onStatus")
+	if memberString(reply, "faultCode") != "Server.Processing.UnknownDSId" {
+		t.Errorf("expired DSId answered %v", reply)
+	}
+}
+
+func TestSessionStoreSweep(t *testing.T) {
+	store := newSessionStore()
+	store.timeout = 20 * time.Millisecond
+	store.put("a", "x")
+	time.Sleep(30 * time.Millisecond)
+	store.put("b", "y")
+	if _, ok := store.sessions["a"]; ok || len(store.sessions) != 1 {
+		t.Errorf("sessions after the sweep: %v", store.sessions)
+	}
+
+	store.close("b")
+	if _, ok := store.principal("b"); ok || store.add("b", "z") {
+		t.Error("closed session used again")
+	}
+	if !store.add("c", "z") || store.add("c", "z") {
+		t.Error("added a session twice")
+	}
+}
+
+//TestFlexLoginSubscriptions checks the subscriptions of the DSId a client
+//logs in with end with it
+func TestFlexLoginSubscriptions(t *testing.T) {
+	gateway := authGateway()
+	broker := NewBroker()
+	broker.AddDestination("feed", Destination{})
+	gateway.SetBroker(broker)
+
+	dsId := ping(t, gateway)
+	postFlex(t, gateway, &CommandMessage{Operation: SUBSCRIBE_OPERATION, ClientId: "C1", Destination: "feed", MessageId: "S", Headers: map[string]AMFAny{DSIdHeader: dsId}}, "onResult")
+	postFlex(t, gateway, &CommandMessage{Operation: LOGIN_OPERATION, MessageId: "L", Body: base64.StdEncoding.EncodeToString([]byte("bob:pässword")), Headers: map[string]AMFAny{DSIdHeader: dsId}}, "onResult")
+
+	broker.mu.Lock()
+	_, ok := broker.clients[dsId]
+	broker.mu.Unlock()
+	if ok {
+		t.Error("subscriptions of the DSId replaced by login kept")
+	}
+}
@@ -0,0 +1,256 @@
+package amf
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Destination configures a destination of a Broker
+type Destination struct {
+	AllowSubtopics bool
+	Separator      string //of the tokens of subtopics, "." by default
+}
+
+//Broker is an in-process message broker of flex messaging, like the message
+//service of BlazeDS. Messages published to a destination are queued for the
+//consumers subscribed to it, until the flex client of the consumers polls.
+//A flex client that neither subscribes nor polls for IdleTimeout is
+//disconnected.
+type Broker struct {
+	PollWait    time.Duration //how long a poll waits for messages, long polling if not 0
+	MaxQueue    int           //messages queued per flex client, the oldest are dropped beyond, 0 for no limit
+	IdleTimeout time.Duration //30 minutes by default, 0 to keep the clients until they disconnect
+
+	mu           sync.Mutex
+	destinations map[string]Destination
+	clients      map[string]*brokerClient
+	swept        time.Time
+}
+
+//brokerClient is a flex client, i.e. a channel polling for its consumers
+type brokerClient struct {
+	subscriptions map[string]*subscription
+	queue         []*AsyncMessage
+	notify        chan struct{}
+	seen          time.Time
+}
+
+type subscription struct {
+	clientId    string
+	destination string
+	subtopic    string
+	selector    *Selector
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		MaxQueue:     1000,
+		IdleTimeout:  30 * time.Minute,
+		destinations: make(map[string]Destination),
+		clients:      make(map[string]*brokerClient),
+	}
+}
+
+//AddDestination adds or replaces a destination messages are published to
+func (broker *Broker) AddDestination(name string, destination Destination) {
+	if destination.Separator == "" {
+		destination.Separator = "."
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.destinations[name] = destination
+}
+
+func (broker *Broker) destination(name, subtopic string) (Destination, error) {
+	destination, ok := broker.destinations[name]
+	if !ok {
+		return destination, &Fault{Code: "Server.Processing", Message: "no destination:" + name}
+	}
+	if subtopic != "" && !destination.AllowSubtopics {
+		return destination, &Fault{Code: "Server.Processing", Message: "destination:" + name + " doesn't allow subtopics"}
+	}
+	return destination, nil
+}
+
+//Subscribe subscribes the consumer clientId of the flex client dsId to the
+//messages of a destination matching subtopic and selector. A subtopic may
+//end with the token "*" matching any token, or "**" matching the remaining
+//tokens. A consumer without subtopic gets the messages without subtopic.
+func (broker *Broker) Subscribe(dsId, clientId, destination, subtopic, selector string) error {
+	parsed, err := ParseSelector(selector)
+	if err != nil {
+		return &Fault{Code: "Client.Message.InvalidSelector", Message: err.Error()}
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	_, err = broker.destination(destination, subtopic)
+	if err != nil {
+		return err
+	}
+
+	client := broker.client(dsId, true)
+	client.subscriptions[clientId] = &subscription{clientId: clientId, destination: destination, subtopic: subtopic, selector: parsed}
+	return nil
+}
+
+//expire disconnects the clients idle for longer than IdleTimeout, at most
+//every half IdleTimeout
+func (broker *Broker) expire(now time.Time) {
+	if broker.IdleTimeout <= 0 || now.Sub(broker.swept) < broker.IdleTimeout/2 {
+		return
+	}
+	broker.swept = now
+	for dsId, client := range broker.clients {
+		if now.Sub(client.seen) > broker.IdleTimeout {
+			delete(broker.clients, dsId)
+		}
+	}
+}
+
+//client returns the flex client dsId, created if it doesn't exist and
+//create is set
+func (broker *Broker) client(dsId string, create bool) *brokerClient {
+	now := time.Now()
+	broker.expire(now)
+
+	client, ok := broker.clients[dsId]
+	if !ok && create {
+		client = &brokerClient{subscriptions: make(map[string]*subscription), notify: make(chan struct{}, 1)}
+		broker.clients[dsId] = client
+	}
+	if client != nil {
+		client.seen = now
+	}
+	return client
+}
+
+//Unsubscribe ends the subscription of a consumer
+func (broker *Broker) Unsubscribe(dsId, clientId string) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	if client, ok := broker.clients[dsId]; ok {
+		delete(client.subscriptions, clientId)
+	}
+}
+
+//Disconnect ends the subscriptions of a flex client and drops its queue
+func (broker *Broker) Disconnect(dsId string) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	delete(broker.clients, dsId)
+}
+
+//Publish queues message for the consumers subscribed to its destination,
+//with the subtopic of its DSSubtopic header
+func (broker *Broker) Publish(message *AsyncMessage) error {
+	subtopic, _ := message.Headers[DSSubtopicHeader].(string)
+	if message.MessageId == "" {
+		message.MessageId = newUUID()
+	}
+	if message.Timestamp == 0 {
+		message.Timestamp = float64(time.Now().UnixMilli())
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	destination, err := broker.destination(message.Destination, subtopic)
+	if err != nil {
+		return err
+	}
+	broker.expire(time.Now())
+
+	for _, client := range broker.clients {
+		queued := false
+		for _, sub := range client.subscriptions {
+			if sub.destination != message.Destination || !matchSubtopic(sub.subtopic, subtopic, destination.Separator) || !sub.selector.Match(message.Headers) {
+				continue
+			}
+
+			delivered := *message
+			delivered.ClientId = sub.clientId
+			client.queue = append(client.queue, &delivered)
+			queued = true
+		}
+
+		if !queued {
+			continue
+		}
+		if broker.MaxQueue > 0 && len(client.queue) > broker.MaxQueue {
+			client.queue = append(client.queue[:0], client.queue[len(client.queue)-broker.MaxQueue:]...)
+		}
+		select {
+		case client.notify <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+//matchSubtopic tells whether the subtopic of a message matches the one of a
+//subscription
+func matchSubtopic(pattern, subtopic, separator string) bool {
+	if pattern == "" || subtopic == "" {
+		return pattern == subtopic
+	}
+
+	patterns := strings.Split(pattern, separator)
+	tokens := strings.Split(subtopic, separator)
+	for i, p := range patterns {
+		if p == "**" {
+			return true
+		}
+		if i >= len(tokens) || p != "*" && p != tokens[i] {
+			return false
+		}
+	}
+	return len(patterns) == len(tokens)
+}
+
+//Poll returns the messages queued for the consumers of the flex client
+//dsId. If there are none, it waits up to PollWait for some to be published.
+func (broker *Broker) Poll(ctx context.Context, dsId string) ([]*AsyncMessage, error) {
+	broker.mu.Lock()
+	client := broker.client(dsId, false)
+	if client == nil {
+		broker.mu.Unlock()
+		return nil, nil
+	}
+	messages := client.take()
+	broker.mu.Unlock()
+
+	if len(messages) > 0 || broker.PollWait <= 0 {
+		return messages, nil
+	}
+
+	timer := time.NewTimer(broker.PollWait)
+	defer timer.Stop()
+	select {
+	case <-client.notify:
+	case <-timer.C:
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	client.seen = time.Now()
+	return client.take(), nil
+}
+
+func (client *brokerClient) take() []*AsyncMessage {
+	messages := client.queue
+	client.queue = nil
+	select {
+	case <-client.notify:
+	default:
+	}
+	return messages
+}
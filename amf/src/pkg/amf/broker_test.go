@@ -0,0 +1,254 @@
+package amf
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchSubtopic(t *testing.T) {
+	tests := []struct {
+		pattern, subtopic, separator string
+		want                         bool
+	}{
+		{"", "", ".", true},
+		{"", "a", ".", false},
+		{"a", "", ".", false},
+		{"a.b", "a.b", ".", true},
+		{"a.b", "a.c", ".", false},
+		{"a.*", "a.b", ".", true},
+		{"a.*", "a.b.c", ".", false},
+		{"a.*", "a", ".", false},
+		{"*.b", "a.b", ".", true},
+		{"a.**", "a.b.c", ".", true},
+		{"**", "a", ".", true},
+		{"a/*", "a/b", "/", true},
+		{"a/*", "a.b", "/", false},
+	}
+
+	for _, test := range tests {
+		if matchSubtopic(test.pattern, test.subtopic, test.separator) != test.want {
+			t.Errorf("%q matched %q: %v", test.pattern, test.subtopic, !test.want)
+		}
+	}
+}
+
+func TestBroker(t *testing.T) {
+	broker := NewBroker()
+	broker.AddDestination("chat", Destination{AllowSubtopics: true})
+	broker.AddDestination("plain", Destination{})
+
+	err := broker.Subscribe("ds", "c1", "chat", "room.*", "prio > 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Subscribe("ds", "c2", "chat", "**", "")
+	broker.Subscribe("ds2", "c3", "chat", "", "")
+
+	errs := []struct {
+		destination, subtopic, selector, code string
+	}{
+		{"nope", "", "", "Server.Processing"},
+		{"plain", "a", "", "Server.Processing"},
+		{"chat", "", "prio >", "Client.Message.InvalidSelector"},
+	}
+	for _, test := range errs {
+		err := broker.Subscribe("ds", "c4", test.destination, test.subtopic, test.selector)
+		fault, ok := err.(*Fault)
+		if !ok || fault.Code != test.code {
+			t.Errorf("subscribed to %s %q %q with %v", test.destination, test.subtopic, test.selector, err)
+		}
+	}
+
+	broker.Publish(&AsyncMessage{Destination: "chat", Body: "hi", Headers: map[string]AMFAny{DSSubtopicHeader: "room.a", "prio": 2}})
+	broker.Publish(&AsyncMessage{Destination: "chat", Body: "low", Headers: map[string]AMFAny{DSSubtopicHeader: "room.a", "prio": 0}})
+	broker.Publish(&AsyncMessage{Destination: "chat", Body: "plain"})
+	if err := broker.Publish(&AsyncMessage{Destination: "plain", Headers: map[string]AMFAny{DSSubtopicHeader: "a"}}); err == nil {
+		t.Error("published with a subtopic not allowed")
+	}
+
+	messages, err := broker.Poll(context.Background(), "ds")
+	if err != nil || len(messages) != 3 || messages[0].MessageId == "" || messages[0].Timestamp == 0 {
+		t.Fatalf("polled %v, %v", messages, err)
+	}
+	clients := map[string]int{}
+	for _, message := range messages {
+		clients[message.ClientId]++
+	}
+	if clients["c1"] != 1 || clients["c2"] != 2 {
+		t.Errorf("delivered to %v", clients)
+	}
+
+	messages, _ = broker.Poll(context.Background(), "ds2")
+	if len(messages) != 1 || messages[0].Body != "plain" || messages[0].ClientId != "c3" {
+		t.Errorf("polled %v", messages)
+	}
+	if messages, _ = broker.Poll(context.Background(), "ds2"); len(messages) != 0 {
+		t.Errorf("polled %v again", messages)
+	}
+
+	broker.Unsubscribe("ds2", "c3")
+	broker.Disconnect("ds")
+	broker.Publish(&AsyncMessage{Destination: "chat", Body: "gone", Headers: map[string]AMFAny{DSSubtopicHeader: "room.a", "prio": 2}})
+	for _, dsId := range []string{"ds", "ds2", "unknown"} {
+		if messages, err := broker.Poll(context.Background(), dsId); len(messages) != 0 || err != nil {
+			t.Errorf("%s polled %v, %v", dsId, messages, err)
+		}
+	}
+}
+
+func TestBrokerMaxQueue(t *testing.T) {
+	broker := NewBroker()
+	broker.MaxQueue = 2
+	broker.AddDestination("chat", Destination{})
+	broker.Subscribe("ds", "c", "chat", "", "")
+	for _, body := range []string{"a", "b", "c"} {
+		broker.Publish(&AsyncMessage{Destination: "chat", Body: body})
+	}
+
+	messages, _ := broker.Poll(context.Background(), "ds")
+	if len(messages) != 2 || messages[0].Body != "b" || messages[1].Body != "c" {
+		t.Errorf("polled %v", messages)
+	}
+}
+
+func TestBrokerIdleTimeout(t *testing.T) {
+	broker := NewBroker()
+	broker.IdleTimeout = 100 * time.Millisecond
+	broker.AddDestination("chat", Destination{})
+	broker.Subscribe("idle", "c", "chat", "", "")
+	broker.Subscribe("active", "c", "chat", "", "")
+
+	for i := 0; i < 8; i++ {
+		time.Sleep(20 * time.Millisecond)
+		broker.Poll(context.Background(), "active")
+	}
+	broker.Publish(&AsyncMessage{Destination: "chat", Body: "hi"})
+
+	broker.mu.Lock()
+	_, idle := broker.clients["idle"]
+	_, active := broker.clients["active"]
+	broker.mu.Unlock()
+	if idle || !active {
+		t.Errorf("idle client kept %v, active client kept %v", idle, active)
+	}
+	if messages, _ := broker.Poll(context.Background(), "active"); len(messages) != 1 {
+		t.Errorf("active client polled %v", messages)
+	}
+}
+
+func TestBrokerLongPoll(t *testing.T) {
+	broker := NewBroker()
+	broker.PollWait = time.Second
+	broker.AddDestination("chat", Destination{})
+	broker.Subscribe("ds", "c", "chat", "", "")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		broker.Publish(&AsyncMessage{Destination: "chat", Body: "late"})
+	}()
+	start := time.Now()
+	messages, err := broker.Poll(context.Background(), "ds")
+	if err != nil || len(messages) != 1 || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("polled %v, %v after %v", messages, err, time.Since(start))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := broker.Poll(ctx, "ds"); err != context.DeadlineExceeded {
+		t.Errorf("canceled poll returned %v", err)
+	}
+
+	broker.PollWait = 20 * time.Millisecond
+	if messages, err := broker.Poll(context.Background(), "ds"); len(messages) != 0 || err != nil {
+		t.Errorf("poll timed out with %v, %v", messages, err)
+	}
+}
+
+func TestFlexMessaging(t *testing.T) {
+	gateway := NewGateway()
+	broker := NewBroker()
+	broker.AddDestination("feed", Destination{})
+	gateway.SetBroker(broker)
+	dsId := ping(t, gateway)
+
+	postFlex(t, gateway, &CommandMessage{Operation: SUBSCRIBE_OPERATION, ClientId: "C1", Destination: "feed", MessageId: "S", Headers: map[string]AMFAny{DSIdHeader: dsId, DSSelectorHeader: "n > 1"}}, "onResult")
+	postFlex(t, gateway, &AsyncMessage{Destination: "feed", Body: "x", Headers: map[string]AMFAny{DSIdHeader: dsId, "n": 2}}, "onResult", SmallMessages(true))
+	postFlex(t, gateway, &AsyncMessage{Destination: "feed", Body: "y", Headers: map[string]AMFAny{DSIdHeader: dsId, "n": 0}}, "onResult")
+
+	reply := postFlex(t, gateway, &CommandMessage{Operation: POLL_OPERATION, Headers: map[string]AMFAny{DSIdHeader: dsId}}, "onResult")
+	var command CommandMessage
+	err := reply.Decode(&command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, _ := command.Body.([]AMFAny)
+	if len(list) != 1 || list[0].(*AsyncMessage).ClientId != "C1" || list[0].(*AsyncMessage).Body != "x" {
+		t.Errorf("polled %+v", command)
+	}
+
+	reply = postFlex(t, gateway, &CommandMessage{Operation: POLL_OPERATION, Headers: map[string]AMFAny{DSIdHeader: dsId}}, "onResult")
+	if reply.Class() != "flex.messaging.messages.AcknowledgeMessage" {
+		t.Errorf("empty poll answered %v", reply)
+	}
+
+	reply = postFlex(t, gateway, &CommandMessage{Operation: SUBSCRIBE_OPERATION, ClientId: "C2", Destination: "feed", MessageId: "S", Headers: map[string]AMFAny{DSIdHeader: dsId, DSSelectorHeader: strings.Repeat("(", 200)}}, "onStatus")
+	var message ErrorMessage
+	if err := reply.Decode(&message); err != nil || message.FaultCode != "Client.Message.InvalidSelector" {
+		t.Errorf("deeply nested selector answered %+v, %v", message, err)
+	}
+}
+
+//TestFlexMessagingSharedReferences checks the values a published body
+//shares are sent to the consumers as references, not copied
+func TestFlexMessagingSharedReferences(t *testing.T) {
+	gateway := NewGateway()
+	broker := NewBroker()
+	broker.AddDestination("feed", Destination{})
+	gateway.SetBroker(broker)
+	dsId := ping(t, gateway)
+	postFlex(t, gateway, &CommandMessage{Operation: SUBSCRIBE_OPERATION, ClientId: "C1", Destination: "feed", MessageId: "S", Headers: map[string]AMFAny{DSIdHeader: dsId}}, "onResult")
+
+	var body AMFAny = map[string]AMFAny{"leaf": "x"}
+	for i := 0; i < 24; i++ {
+		body = []AMFAny{body, body}
+	}
+	for _, small := range []bool{false, true} {
+		postFlex(t, gateway, &AsyncMessage{Destination: "feed", Body: body, Headers: map[string]AMFAny{DSIdHeader: dsId}}, "onResult", SmallMessages(small))
+	}
+
+	var buffer bytes.Buffer
+	poll := &CommandMessage{Operation: POLL_OPERATION, Headers: map[string]AMFAny{DSIdHeader: dsId}}
+	err := WritePacket(&buffer, &Packet{Version: 3, Messages: []Message{{Target: "null", Response: "/1", Data: []AMFAny{poll}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	gateway.ServeHTTP(recorder, httptest.NewRequest("POST", "/messagebroker/amf", &buffer))
+	if recorder.Body.Len() > 4096 {
+		t.Fatalf("polled %d bytes", recorder.Body.Len())
+	}
+
+	response, err := ReadPacket(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var command CommandMessage
+	err = response.Messages[0].Data.(*Value).Decode(&command)
+	list, _ := command.Body.([]AMFAny)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("polled %+v, %v", command, err)
+	}
+	for _, message := range list {
+		leaf := message.(*AsyncMessage).Body
+		for i := 0; i < 24; i++ {
+			leaf = leaf.([]AMFAny)[1]
+		}
+		if leaf.(map[string]AMFAny)["leaf"] != "x" {
+			t.Errorf("polled body ending with %v", leaf)
+		}
+	}
+}
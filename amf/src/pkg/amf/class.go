@@ -0,0 +1,198 @@
+package amf
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+//Externalizable is implemented by classes that read and write their own
+//members, like IExternalizable of flash. ReadExternal reads the members
+//after the traits of the object, WriteExternal writes them.
+type Externalizable interface {
+	ReadExternal(decoder *Decoder) error
+	WriteExternal(encoder *Encoder) error
+}
+
+var externalizableType = reflect.TypeOf((*Externalizable)(nil)).Elem()
+
+//classInfo is a class registered by RegisterClass or RegisterExternalizable
+type classInfo struct {
+	alias    string
+	t        reflect.Type //struct type
+	external bool
+	traits   [2]*Traits //sealed traits for encoding, by reservStruct
+	small    *classInfo //small form of the class, see SmallMessages
+}
+
+var classes struct {
+	sync.RWMutex
+	byAlias map[string]*classInfo
+	byType  map[reflect.Type]*classInfo
+}
+
+//RegisterClass registers the struct type of value for the class alias, like
+//registerClassAlias of flash. Objects of the class decoded into an interface
+//become a pointer to a new value of the type, and values of the type are
+//encoded as objects of the class with the fields as sealed members.
+func RegisterClass(alias string, value AMFAny) {
+	registerClass(alias, value, false)
+}
+
+//RegisterExternalizable registers the type of value, which must implement
+//Externalizable with a pointer receiver, for the externalizable class alias.
+//Values of the type are encoded with the alias unless the type is also
+//registered by RegisterClass.
+func RegisterExternalizable(alias string, value Externalizable) {
+	registerClass(alias, value, true)
+}
+
+func registerClass(alias string, value AMFAny, external bool) *classInfo {
+	t := reflect.TypeOf(value)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		panic("amf: class " + alias + " registered for non-struct type " + t.String())
+	}
+	if external && !reflect.PointerTo(t).Implements(externalizableType) {
+		panic("amf: externalizable class " + alias + " registered for " + t.String() + " without pointer Externalizable")
+	}
+
+	info := &classInfo{alias: alias, t: t, external: external}
+	if external {
+		info.traits[0] = &Traits{Class: alias, Externalizable: true}
+		info.traits[1] = info.traits[0]
+	} else {
+		plan := getStructPlan(t)
+		for i, reserv := range []bool{false, true} {
+			traits := &Traits{Class: alias}
+			for _, f := range plan.fields {
+				if reserv {
+					traits.Members = append(traits.Members, f.reservName)
+				} else {
+					traits.Members = append(traits.Members, f.name)
+				}
+			}
+			info.traits[i] = traits
+		}
+	}
+
+	classes.Lock()
+	defer classes.Unlock()
+	if classes.byAlias == nil {
+		classes.byAlias = make(map[string]*classInfo)
+		classes.byType = make(map[reflect.Type]*classInfo)
+	}
+	classes.byAlias[alias] = info
+	if _, ok := classes.byType[t]; !ok || !external {
+		classes.byType[t] = info
+	}
+	return info
+}
+
+func classByAlias(alias string) (*classInfo, bool) {
+	classes.RLock()
+	defer classes.RUnlock()
+	info, ok := classes.byAlias[alias]
+	return info, ok
+}
+
+func classByType(t reflect.Type) (*classInfo, bool) {
+	classes.RLock()
+	defer classes.RUnlock()
+	info, ok := classes.byType[t]
+	return info, ok
+}
+
+//classTraits returns the traits an encoder writes for the class
+func (encoder *Encoder) classTraits(info *classInfo) *classInfo {
+	if encoder.smallMessages && info.small != nil {
+		return info.small
+	}
+	return info
+}
+
+//readExternal decodes an object of an externalizable class into value, the
+//flex wrappers are decoded as the value they wrap unless value is
+//externalizable itself
+func (decoder *Decoder) readExternal(traits *Traits, value reflect.Value) error {
+	external := value.Kind() == reflect.Struct && reflect.PointerTo(value.Type()).Implements(externalizableType)
+	if wrapperClasses[traits.Class] && !external {
+		return decoder.readWrapped(value)
+	}
+
+	switch value.Kind() {
+	case reflect.Interface:
+		info, ok := classByAlias(traits.Class)
+		if !ok || !info.external {
+			return errors.New("externalizable class:" + traits.Class + " not registered")
+		}
+
+		v := reflect.New(info.t)
+		err := setInterface(value, v)
+		if err != nil {
+			return err
+		}
+
+		err = decoder.addObject(v)
+		if err != nil {
+			return err
+		}
+		return v.Interface().(Externalizable).ReadExternal(decoder)
+	case reflect.Struct:
+		if !value.CanAddr() || !reflect.PointerTo(value.Type()).Implements(externalizableType) {
+			return errors.New("externalizable class:" + traits.Class + " can't be decoded into " + value.Type().String())
+		}
+
+		err := decoder.addObject(value)
+		if err != nil {
+			return err
+		}
+		return value.Addr().Interface().(Externalizable).ReadExternal(decoder)
+	}
+
+	return errors.New("externalizable class:" + traits.Class + " can't be decoded into " + value.Type().String())
+}
+
+//readExternalValue decodes an object of an externalizable class into the go
+//value held by a document, wrappers are replaced by the value they wrap
+func (decoder *Decoder) readExternalValue(traits *Traits) (*Value, error) {
+	if wrapperClasses[traits.Class] {
+		return decoder.readWrappedValue()
+	}
+
+	info, ok := classByAlias(traits.Class)
+	if !ok || !info.external {
+		return nil, errors.New("externalizable class:" + traits.Class + " not registered")
+	}
+
+	v := reflect.New(info.t)
+	value := &Value{Kind: KindObject, Traits: traits, External: v.Interface().(Externalizable)}
+	err := decoder.addValueReference(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, value.External.ReadExternal(decoder)
+}
+
+//ReadByte reads a byte of the members of an externalizable object, values
+//are read with DecodeField
+func (decoder *Decoder) ReadByte() (byte, error) {
+	return decoder.readByte()
+}
+
+//WriteByte writes a byte of the members of an externalizable object, values
+//are written with EncodeField
+func (encoder *Encoder) WriteByte(c byte) error {
+	return encoder.writeMarker(c)
+}
+
+//SmallMessages makes the encoder write the small forms of flex messages,
+//DSK, DSA and DSC, which flex 3.5 and later understand
+func SmallMessages(small bool) EncoderOption {
+	return func(encoder *Encoder) {
+		encoder.smallMessages = small
+	}
+}
@@ -0,0 +1,177 @@
+package amf
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type classPoint struct {
+	X, Y int
+}
+
+//classVersion writes its members as two bytes
+type classVersion struct {
+	Major, Minor byte
+}
+
+func (version *classVersion) ReadExternal(decoder *Decoder) error {
+	var err error
+	version.Major, err = decoder.ReadByte()
+	if err != nil {
+		return err
+	}
+	version.Minor, err = decoder.ReadByte()
+	return err
+}
+
+func (version *classVersion) WriteExternal(encoder *Encoder) error {
+	encoder.WriteByte(version.Major)
+	return encoder.WriteByte(version.Minor)
+}
+
+func init() {
+	RegisterClass("test.Point", classPoint{})
+	RegisterExternalizable("test.Version", &classVersion{})
+}
+
+func TestRegisterClass(t *testing.T) {
+	point := []byte{OBJECT_MARKER, 0x23, 0x15, 't', 'e', 's', 't', '.', 'P', 'o', 'i', 'n', 't', 0x03, 'x', 0x03, 'y', INTEGER_MARKER, 0x01, INTEGER_MARKER, 0x02}
+	data, err := Marshal(&classPoint{1, 2})
+	if err != nil || !bytes.Equal(data, point) {
+		t.Fatalf("encoded % x, %v", data, err)
+	}
+
+	var buffer bytes.Buffer
+	err = NewEncoder(&buffer, true).Encode(&classPoint{1, 2})
+	if err != nil || !bytes.Contains(buffer.Bytes(), []byte{0x03, 'X', 0x03, 'Y'}) {
+		t.Errorf("encoded with go names as % x, %v", buffer.Bytes(), err)
+	}
+
+	var any AMFAny
+	err = Unmarshal(point, &any)
+	if p, ok := any.(*classPoint); err != nil || !ok || *p != (classPoint{1, 2}) {
+		t.Errorf("decoded %#v, %v", any, err)
+	}
+
+	var m map[string]int
+	err = Unmarshal(point, &m)
+	if err != nil || m["x"] != 1 || m["y"] != 2 {
+		t.Errorf("decoded into map %v, %v", m, err)
+	}
+
+	//the second point refers to the traits of the first one
+	data, err = Marshal([]AMFAny{&classPoint{1, 2}, &classPoint{3, 4}})
+	if err != nil || !bytes.HasSuffix(data, []byte{OBJECT_MARKER, 0x01, INTEGER_MARKER, 0x03, INTEGER_MARKER, 0x04}) {
+		t.Fatalf("encoded % x, %v", data, err)
+	}
+	var list []AMFAny
+	err = Unmarshal(data, &list)
+	if err != nil || len(list) != 2 || *list[1].(*classPoint) != (classPoint{3, 4}) {
+		t.Errorf("decoded %v, %v", list, err)
+	}
+
+	value, err := UnmarshalAs[*Value](point)
+	if err != nil || value.Class() != "test.Point" {
+		t.Fatalf("decoded document %v, %v", value, err)
+	}
+	data, err = Marshal(value)
+	if err != nil || !bytes.Equal(data, point) {
+		t.Errorf("document encoded as % x, %v", data, err)
+	}
+}
+
+func TestRegisterExternalizable(t *testing.T) {
+	version := []byte{OBJECT_MARKER, 0x07, 0x19, 't', 'e', 's', 't', '.', 'V', 'e', 'r', 's', 'i', 'o', 'n', 1, 2}
+	data, err := Marshal(&classVersion{1, 2})
+	if err != nil || !bytes.Equal(data, version) {
+		t.Fatalf("encoded % x, %v", data, err)
+	}
+
+	var any AMFAny
+	err = Unmarshal(version, &any)
+	if v, ok := any.(*classVersion); err != nil || !ok || *v != (classVersion{1, 2}) {
+		t.Errorf("decoded %#v, %v", any, err)
+	}
+
+	var v classVersion
+	err = Unmarshal(version, &v)
+	if err != nil || v != (classVersion{1, 2}) {
+		t.Errorf("decoded into struct %+v, %v", v, err)
+	}
+
+	value, err := UnmarshalAs[*Value](version)
+	if err != nil || value.External == nil {
+		t.Fatalf("decoded document %v, %v", value, err)
+	}
+	data, err = Marshal(value)
+	if err != nil || !bytes.Equal(data, version) {
+		t.Errorf("document encoded as % x, %v", data, err)
+	}
+
+	unknown := []byte{OBJECT_MARKER, 0x07, 0x05, 'n', 'o', 1, 2}
+	err = Unmarshal(unknown, &any)
+	if err == nil || !strings.Contains(err.Error(), "externalizable class:no not registered") {
+		t.Errorf("unregistered class decoded with %v", err)
+	}
+	var m map[string]AMFAny
+	err = Unmarshal(version, &m)
+	if err == nil {
+		t.Error("externalizable class decoded into a map")
+	}
+}
+
+func TestSmallMessages(t *testing.T) {
+	ack := &AcknowledgeMessage{Body: "hi", ClientId: "C", CorrelationId: "X", MessageId: "M", Timestamp: 12, Headers: map[string]AMFAny{"a": 1.5}}
+	for _, small := range []bool{false, true} {
+		data, err := Marshal(ack, SmallMessages(small))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("DSK")) != small || bytes.Contains(data, []byte("AcknowledgeMessage")) == small {
+			t.Errorf("small %v: encoded %q", small, data)
+		}
+
+		var any AMFAny
+		err = Unmarshal(data, &any)
+		decoded, ok := any.(*AcknowledgeMessage)
+		if err != nil || !ok || decoded.Body != "hi" || decoded.ClientId != "C" || decoded.CorrelationId != "X" || decoded.MessageId != "M" || decoded.Timestamp != 12 || decoded.Headers["a"] != 1.5 {
+			t.Errorf("small %v: decoded %#v, %v", small, any, err)
+		}
+
+		value, err := UnmarshalAs[*Value](data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := Marshal(value)
+		if err != nil || !bytes.Equal(again, data) {
+			t.Errorf("small %v: document encoded as %q, %v", small, again, err)
+		}
+	}
+
+	command := &CommandMessage{Operation: LOGIN_OPERATION, Body: []AMFAny{ack, ack}}
+	data, err := Marshal(command, SmallMessages(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var any AMFAny
+	err = Unmarshal(data, &any)
+	decoded, ok := any.(*CommandMessage)
+	if err != nil || !ok || decoded.Operation != LOGIN_OPERATION || len(decoded.Body.([]AMFAny)) != 2 {
+		t.Errorf("decoded %#v, %v", any, err)
+	}
+}
+
+//TestSmallMessageFields decodes a DSA whose client id is sent as the bytes
+//of a uuid
+func TestSmallMessageFields(t *testing.T) {
+	data := []byte{OBJECT_MARKER, 0x07, 0x07, 'D', 'S', 'A', 0x80 | 0x20, 0x01, DOUBLE_MARKER, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0, BYTEARRAY_MARKER, 0x21}
+	data = append(data, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 0xab)
+	data = append(data, 0x00)
+
+	var message AsyncMessage
+	err := Unmarshal(data, &message)
+	if err != nil || message.ClientId != "01020304-0506-0708-090A-0B0C0D0E0FAB" || message.Timestamp != 1 {
+		t.Errorf("decoded %+v, %v", message, err)
+	}
+}
@@ -0,0 +1,243 @@
+package amf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+//statusFault makes the Fault of the data of an onStatus message, the fault
+//is wrapped with the error of its extendedData if that doesn't decode
+func statusFault(data *Value) error {
+	fault := &Fault{Data: data}
+	fault.Code = memberString(data, "code", "faultCode")
+	fault.Message = memberString(data, "description", "faultString")
+	fault.Detail = memberString(data, "details", "faultDetail")
+	fault.Level = memberString(data, "level")
+	if data == nil {
+		return fault
+	}
+	if data.Kind == KindString && fault.Code == "" && fault.Message == "" {
+		fault.Message = data.Str
+	}
+	if rootCause, ok := data.Member("rootCause"); ok && rootCause != nil && rootCause.Kind != KindNull {
+		fault.RootCause = rootCause
+	}
+	if extendedData, ok := data.Member("extendedData"); ok && extendedData != nil && extendedData.Kind == KindObject {
+		err := extendedData.Decode(&fault.ExtendedData)
+		if err != nil {
+			return fmt.Errorf("%w, extendedData not decoded: %w", fault, err)
+		}
+	}
+	return fault
+}
+
+//memberString returns the first of the keys that is a string member of value
+func memberString(value *Value, keys ...string) string {
+	if value == nil {
+		return ""
+	}
+	for _, key := range keys {
+		member, ok := value.Member(key)
+		if ok && member != nil && member.Kind == KindString {
+			return member.Str
+		}
+	}
+	return ""
+}
+
+//Client calls remoting services like NetConnection.call of flash
+type Client struct {
+	HTTP    *http.Client //http.DefaultClient if nil
+	Version uint16       //version of the packets, 3 by default
+
+	mu       sync.Mutex
+	url      string
+	appended string //suffix of the last AppendToGatewayUrl header
+	headers  []Header
+	next     int
+}
+
+func NewClient(url string) *Client {
+	return &Client{url: url, Version: 3}
+}
+
+//URL returns the gateway url, changed by the AppendToGatewayUrl and
+//ReplaceGatewayUrl headers of the responses
+func (client *Client) URL() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.url
+}
+
+//AddHeader adds a header sent with every request, like
+//NetConnection.addHeader, replacing the header of the same name
+func (client *Client) AddHeader(name string, mustUnderstand bool, value AMFAny) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.addHeader(Header{Name: name, MustUnderstand: mustUnderstand, Value: value})
+}
+
+func (client *Client) addHeader(header Header) {
+	for i := range client.headers {
+		if client.headers[i].Name == header.Name {
+			client.headers[i] = header
+			return
+		}
+	}
+	client.headers = append(client.headers, header)
+}
+
+//Call calls target, e.g. "Service.method", with args and decodes the result
+//into result, unless it is nil. A call answered with onStatus returns a
+//*Fault.
+func (client *Client) Call(ctx context.Context, target string, result AMFAny, args ...AMFAny) error {
+	batch := client.Batch()
+	call := batch.Call(target, result, args...)
+	err := batch.Do(ctx)
+	if err != nil {
+		return err
+	}
+	return call.Err
+}
+
+//Batch collects calls sent together in one request
+type Batch struct {
+	client *Client
+	calls  []*BatchCall
+}
+
+//BatchCall is a call of a batch, its Err is set by Batch.Do
+type BatchCall struct {
+	Target string
+	Args   []AMFAny
+	Result AMFAny
+	Err    error
+
+	response string
+}
+
+func (client *Client) Batch() *Batch {
+	return &Batch{client: client}
+}
+
+//Call adds a call to the batch, see Client.Call
+func (batch *Batch) Call(target string, result AMFAny, args ...AMFAny) *BatchCall {
+	if args == nil {
+		args = []AMFAny{}
+	}
+	call := &BatchCall{Target: target, Args: args, Result: result}
+	batch.calls = append(batch.calls, call)
+	return call
+}
+
+//Do sends the calls of the batch in one request. The error is about the
+//request as a whole, the error of each call is in its Err.
+func (batch *Batch) Do(ctx context.Context) error {
+	client := batch.client
+	client.mu.Lock()
+	request := &Packet{Version: client.Version, Headers: append([]Header(nil), client.headers...)}
+	url := client.url
+	for _, call := range batch.calls {
+		client.next++
+		call.response = "/" + strconv.Itoa(client.next)
+		request.Messages = append(request.Messages, Message{Target: call.Target, Response: call.response, Data: call.Args})
+	}
+	client.mu.Unlock()
+
+	var buffer bytes.Buffer
+	err := WritePacket(&buffer, request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buffer)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amf")
+
+	httpClient := client.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("amf gateway returned status:" + resp.Status)
+	}
+
+	response, err := ReadPacket(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	client.handleHeaders(response.Headers)
+
+	results := make(map[string]*Message)
+	for i := range response.Messages {
+		results[response.Messages[i].Target] = &response.Messages[i]
+	}
+
+	for _, call := range batch.calls {
+		if message, ok := results[call.response+"/onResult"]; ok {
+			if call.Result != nil {
+				call.Err = message.Data.(*Value).Decode(call.Result)
+			}
+		} else if message, ok := results[call.response+"/onStatus"]; ok {
+			call.Err = statusFault(message.Data.(*Value))
+		} else {
+			call.Err = errors.New("no response for call:" + call.Target)
+		}
+	}
+
+	return nil
+}
+
+//handleHeaders applies the headers of a response to the client
+func (client *Client) handleHeaders(headers []Header) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	for _, header := range headers {
+		value, _ := header.Value.(*Value)
+		if value == nil {
+			continue
+		}
+
+		switch header.Name {
+		case "AppendToGatewayUrl":
+			//gateways send the suffix with every response, it is appended once
+			if value.Kind == KindString && value.Str != client.appended {
+				client.url += value.Str
+				client.appended = value.Str
+			}
+		case "ReplaceGatewayUrl":
+			if value.Kind == KindString {
+				client.url = value.Str
+				client.appended = ""
+			}
+		case "RequestPersistentHeader":
+			name := memberString(value, "name")
+			if name == "" {
+				continue
+			}
+			persistent := Header{Name: name}
+			if mustUnderstand, ok := value.Member("mustUnderstand"); ok && mustUnderstand != nil {
+				persistent.MustUnderstand = mustUnderstand.Bool
+			}
+			if data, ok := value.Member("data"); ok {
+				persistent.Value = data
+			}
+			client.addHeader(persistent)
+		}
+	}
+}
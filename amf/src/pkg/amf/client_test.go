@@ -0,0 +1,192 @@
+package amf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//clientServer serves the calls of a gateway and adds headers to its
+//responses, it records the urls and headers of the requests
+type clientServer struct {
+	gateway *Gateway
+	headers []Header
+
+	mu       sync.Mutex
+	urls     []string
+	received [][]Header
+}
+
+func (server *clientServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request, err := ReadPacket(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	server.mu.Lock()
+	server.urls = append(server.urls, r.URL.String())
+	server.received = append(server.received, request.Headers)
+	server.mu.Unlock()
+
+	var buffer bytes.Buffer
+	WritePacket(&buffer, request)
+	recorder := httptest.NewRecorder()
+	server.gateway.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", &buffer))
+	response, err := ReadPacket(recorder.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.Headers = server.headers
+	w.Header().Set("Content-Type", "application/x-amf")
+	WritePacket(w, response)
+}
+
+func TestClient(t *testing.T) {
+	gateway := NewGateway()
+	gateway.RegisterService("Users", serviceUsers{})
+	server := &clientServer{gateway: gateway, headers: []Header{
+		{Name: "AppendToGatewayUrl", Value: "?sid=1"},
+		{Name: "RequestPersistentHeader", Value: map[string]AMFAny{"name": "token", "mustUnderstand": true, "data": "abc"}},
+	}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	for _, version := range []uint16{0, 3} {
+		server.urls, server.received = nil, nil
+		client := NewClient(httpServer.URL + "/gateway")
+		client.Version = version
+		client.AddHeader(CredentialsHeader, false, map[string]string{"userid": "bob"})
+
+		var user serviceUser
+		err := client.Call(context.Background(), "Users.get", &user, 5)
+		if err != nil || user != (serviceUser{Name: "bob", Age: 5}) {
+			t.Fatalf("version %d: got %+v, %v", version, user, err)
+		}
+
+		err = client.Call(context.Background(), "Users.fail", nil)
+		var fault *Fault
+		if !errors.As(err, &fault) || fault.Code != "App.Fail" {
+			t.Errorf("version %d: failed with %v", version, err)
+		}
+
+		batch := client.Batch()
+		first := batch.Call("Users.get", &serviceUser{}, 1)
+		second := batch.Call("Users.nothing", nil)
+		third := batch.Call("Users.missing", nil)
+		err = batch.Do(context.Background())
+		if err != nil || first.Err != nil || first.Result.(*serviceUser).Age != 1 || second.Err != nil || !errors.As(third.Err, &fault) {
+			t.Errorf("version %d: batch %v, %v %v %v", version, err, first.Err, second.Err, third.Err)
+		}
+
+		//the suffix of the gateway is appended once, the persistent header is
+		//sent after the first response
+		wantURLs := []string{"/gateway", "/gateway?sid=1", "/gateway?sid=1"}
+		if strings.Join(server.urls, " ") != strings.Join(wantURLs, " ") || client.URL() != httpServer.URL+"/gateway?sid=1" {
+			t.Errorf("version %d: requested %q, url %s", version, server.urls, client.URL())
+		}
+		if len(server.received[0]) != 1 || server.received[0][0].Name != CredentialsHeader {
+			t.Errorf("version %d: first request with headers %+v", version, server.received[0])
+		}
+		last := server.received[len(server.received)-1]
+		if len(last) != 2 || last[1].Name != "token" || !last[1].MustUnderstand || last[1].Value.(*Value).Str != "abc" {
+			t.Errorf("version %d: last request with headers %+v", version, last)
+		}
+	}
+}
+
+func TestClientURL(t *testing.T) {
+	client := NewClient("http://host/gateway?a=1")
+	client.handleHeaders([]Header{{Name: "AppendToGatewayUrl", Value: NewString("&a=1")}})
+	if client.URL() != "http://host/gateway?a=1&a=1" {
+		t.Errorf("suffix already in the url appended as %s", client.URL())
+	}
+	client.handleHeaders([]Header{{Name: "AppendToGatewayUrl", Value: NewString("&a=1")}})
+	if client.URL() != "http://host/gateway?a=1&a=1" {
+		t.Errorf("suffix appended again as %s", client.URL())
+	}
+
+	client.handleHeaders([]Header{{Name: "ReplaceGatewayUrl", Value: NewString("http://other/gateway")}})
+	client.handleHeaders([]Header{{Name: "AppendToGatewayUrl", Value: NewString("&a=1")}})
+	if client.URL() != "http://other/gateway&a=1" {
+		t.Errorf("suffix after a replaced url appended as %s", client.URL())
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/garbage" {
+			w.Write([]byte{0, 9})
+			return
+		}
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer httpServer.Close()
+
+	for _, path := range []string{"/down", "/garbage"} {
+		err := NewClient(httpServer.URL+path).Call(context.Background(), "Users.get", nil)
+		if err == nil {
+			t.Errorf("%s answered", path)
+		}
+	}
+
+	err := NewClient(httpServer.URL).Call(context.Background(), "Users.get", nil, make(chan int))
+	if err == nil {
+		t.Error("channel argument sent")
+	}
+}
+
+func TestStatusFault(t *testing.T) {
+	status := NewObject("")
+	status.Members = []Member{
+		{Key: "level", Value: NewString("error")},
+		{Key: "code", Value: NewString("App.Code")},
+		{Key: "description", Value: NewString("message")},
+		{Key: "details", Value: NewString("detail")},
+		{Key: "rootCause", Value: NewString("cause")},
+		{Key: "extendedData", Value: &Value{Kind: KindObject, Members: []Member{{Key: "k", Value: NewString("v")}}}},
+	}
+	flex := NewObject("")
+	flex.Members = []Member{{Key: "faultCode", Value: NewString("Flex.Code")}, {Key: "faultString", Value: NewString("flex message")}, {Key: "faultDetail", Value: NewString("flex detail")}}
+
+	tests := []struct {
+		name  string
+		data  *Value
+		fault Fault
+	}{
+		{"nil", nil, Fault{}},
+		{"string", NewString("message"), Fault{Message: "message"}},
+		{"status", status, Fault{Code: "App.Code", Message: "message", Detail: "detail", Level: "error", RootCause: status.Members[4].Value, ExtendedData: map[string]AMFAny{"k": "v"}}},
+		{"flex", flex, Fault{Code: "Flex.Code", Message: "flex message", Detail: "flex detail"}},
+	}
+
+	for _, test := range tests {
+		err := statusFault(test.data)
+		fault, ok := err.(*Fault)
+		if !ok {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if fault.Code != test.fault.Code || fault.Message != test.fault.Message || fault.Detail != test.fault.Detail || fault.Level != test.fault.Level ||
+			fault.RootCause != test.fault.RootCause || len(fault.ExtendedData) != len(test.fault.ExtendedData) || fault.ExtendedData["k"] != test.fault.ExtendedData["k"] || fault.Data != test.data {
+			t.Errorf("%s: %+v", test.name, fault)
+		}
+	}
+
+	broken := NewObject("")
+	broken.Members = []Member{
+		{Key: "code", Value: NewString("App.Code")},
+		{Key: "extendedData", Value: &Value{Kind: KindObject, Members: []Member{{Key: "d", Value: &Value{Kind: KindDictionary}}}}},
+	}
+	err := statusFault(broken)
+	var fault *Fault
+	var decodeErr *DecodeError
+	if !errors.As(err, &fault) || fault.Code != "App.Code" || !errors.As(err, &decodeErr) {
+		t.Errorf("undecodable extendedData: %v", err)
+	}
+}
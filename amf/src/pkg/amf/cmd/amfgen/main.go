@@ -0,0 +1,385 @@
+// Amfgen generates MarshalAMF and UnmarshalAMF methods for structs, so the
+// amf Encoder and Decoder don't need reflection to handle them. The output is
+// the same as the reflective encoder, use amf.VerifyCodec to check it: types
+// registered with amf.RegisterClass are written with their class alias and
+// sealed members, values met again as references.
+//
+// Usage:
+//
+//	//go:generate amfgen -type Abc,Test
+//
+// Flags:
+//
+//	-type    comma separated list of struct types, required
+//	-output  output file, default <first type>_amf.go
+//	-import  import path of the amf package, default pkg/amf
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	typeNames  = flag.String("type", "", "comma separated list of struct types")
+	output     = flag.String("output", "", "output file, default <first type>_amf.go")
+	importPath = flag.String("import", "pkg/amf", "import path of the amf package")
+)
+
+//field kinds that have a reflection free codec
+const (
+	kindOther = iota
+	kindSigned
+	kindUnsigned
+	kindFloat
+	kindString
+	kindBool
+)
+
+var basicKinds = map[string]int{
+	"int": kindSigned, "int8": kindSigned, "int16": kindSigned, "int32": kindSigned, "int64": kindSigned, "rune": kindSigned,
+	"uint": kindUnsigned, "uint8": kindUnsigned, "uint16": kindUnsigned, "uint32": kindUnsigned, "uint64": kindUnsigned, "byte": kindUnsigned,
+	"float32": kindFloat, "float64": kindFloat,
+	"string": kindString,
+	"bool":   kindBool,
+}
+
+type field struct {
+	goName     string
+	name       string
+	reservName string
+	tag        string
+	kind       int
+}
+
+type generator struct {
+	pkg   string
+	types map[string]*ast.TypeSpec
+	buf   bytes.Buffer
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: amfgen -type T[,T...] [flags] [directory]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *typeNames == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+
+	names := strings.Split(*typeNames, ",")
+	if *output == "" {
+		*output = strings.ToLower(names[0]) + "_amf.go"
+	}
+	out := *output
+	if !filepath.IsAbs(out) {
+		out = filepath.Join(dir, out)
+	}
+
+	g := new(generator)
+	err := g.parse(dir, out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "amfgen:", err)
+		os.Exit(1)
+	}
+
+	src, err := g.generate(names)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "amfgen:", err)
+		os.Exit(1)
+	}
+
+	err = os.WriteFile(out, src, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "amfgen:", err)
+		os.Exit(1)
+	}
+}
+
+//parse collects the type declarations of the package in dir, skipping tests
+//and the file being generated
+func (g *generator) parse(dir, skip string) error {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return err
+	}
+
+	fset := token.NewFileSet()
+	g.types = make(map[string]*ast.TypeSpec)
+	for _, name := range matches {
+		if strings.HasSuffix(name, "_test.go") || filepath.Clean(name) == filepath.Clean(skip) {
+			continue
+		}
+
+		file, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			return err
+		}
+
+		if g.pkg == "" {
+			g.pkg = file.Name.Name
+		} else if g.pkg != file.Name.Name {
+			return fmt.Errorf("found packages %s and %s in %s", g.pkg, file.Name.Name, dir)
+		}
+
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				g.types[ts.Name.Name] = ts
+			}
+		}
+	}
+
+	if g.pkg == "" {
+		return fmt.Errorf("no go files in %s", dir)
+	}
+
+	return nil
+}
+
+//kindOf returns the codec kind of a type expression, following named types
+//declared in the package down to a basic type
+func (g *generator) kindOf(expr ast.Expr, seen map[string]bool) int {
+	ident, ok := expr.(*ast.Ident)
+	if !ok {
+		return kindOther
+	}
+
+	spec, ok := g.types[ident.Name]
+	if !ok {
+		return basicKinds[ident.Name]
+	}
+
+	if seen[ident.Name] || spec.TypeParams != nil {
+		return kindOther
+	}
+	seen[ident.Name] = true
+	return g.kindOf(spec.Type, seen)
+}
+
+//fields returns the fields of a struct in the order of the reflective
+//encoder, which skips fields it can't access
+func (g *generator) fields(name string, st *ast.StructType) ([]field, error) {
+	var fields []field
+	for _, f := range st.Fields.List {
+		tag := ""
+		if f.Tag != nil {
+			raw, err := strconv.Unquote(f.Tag.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tag of %s: %v", name, err)
+			}
+			tag = reflect.StructTag(raw).Get("amf.name")
+		}
+
+		names := make([]string, 0, len(f.Names))
+		for _, n := range f.Names {
+			names = append(names, n.Name)
+		}
+		if len(names) == 0 {
+			names = append(names, embeddedName(f.Type))
+		}
+
+		kind := g.kindOf(f.Type, make(map[string]bool))
+		for _, n := range names {
+			if !ast.IsExported(n) {
+				continue
+			}
+
+			fd := field{goName: n, name: lowerFirst(n), reservName: n, tag: tag, kind: kind}
+			if tag != "" {
+				fd.name = tag
+				fd.reservName = tag
+			}
+			fields = append(fields, fd)
+		}
+	}
+
+	return fields, nil
+}
+
+func embeddedName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.StarExpr:
+		return embeddedName(t.X)
+	case *ast.SelectorExpr:
+		return t.Sel.Name
+	case *ast.IndexExpr:
+		return embeddedName(t.X)
+	case *ast.IndexListExpr:
+		return embeddedName(t.X)
+	}
+	return "_"
+}
+
+func lowerFirst(name string) string {
+	r, size := utf8.DecodeRuneInString(name)
+	if !unicode.IsUpper(r) {
+		return name
+	}
+	return string(unicode.ToLower(r)) + name[size:]
+}
+
+//decodeKeys maps every key the decoder accepts to the field it selects: the
+//tag, the name, and the name with a lower first rune, the first field wins
+func decodeKeys(fields []field) [][]string {
+	owner := make(map[string]int)
+	for i := len(fields) - 1; i >= 0; i-- {
+		owner[fields[i].goName] = i
+		owner[lowerFirst(fields[i].goName)] = i
+		if fields[i].tag != "" {
+			owner[fields[i].tag] = i
+		}
+	}
+
+	keys := make([][]string, len(fields))
+	for key, i := range owner {
+		keys[i] = append(keys[i], key)
+	}
+	for i := range keys {
+		sort.Strings(keys[i])
+	}
+	return keys
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) generate(names []string) ([]byte, error) {
+	g.printf("// Code generated by \"amfgen -type %s\"; DO NOT EDIT.\n\n", strings.Join(names, ","))
+	g.printf("package %s\n\n", g.pkg)
+	g.printf("import %q\n", *importPath)
+
+	for _, name := range names {
+		spec, ok := g.types[name]
+		if !ok {
+			return nil, fmt.Errorf("type %s not found", name)
+		}
+
+		st, ok := spec.Type.(*ast.StructType)
+		if !ok {
+			return nil, fmt.Errorf("type %s is not a struct", name)
+		}
+
+		if spec.TypeParams != nil {
+			return nil, fmt.Errorf("generic type %s not supported", name)
+		}
+
+		fields, err := g.fields(name, st)
+		if err != nil {
+			return nil, err
+		}
+
+		g.marshal(name, fields)
+		g.unmarshal(name, fields)
+	}
+
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("invalid generated code: %v", err)
+	}
+	return src, nil
+}
+
+func (g *generator) marshal(name string, fields []field) {
+	g.printf("\n// MarshalAMF implements amf.Marshaler.\n")
+	g.printf("func (t *%s) MarshalAMF(encoder *amf.Encoder) error {\n", name)
+	g.printf("ok, err := encoder.EncodeStructStart(t)\n")
+	g.printf("if !ok || err != nil {\nreturn err\n}\n\n")
+
+	for _, f := range fields {
+		g.printf("err = encoder.EncodeFieldKey(%q, %q)\n", f.name, f.reservName)
+		g.printf("if err != nil {\nreturn err\n}\n")
+
+		switch f.kind {
+		case kindSigned:
+			g.printf("err = encoder.EncodeInt(int64(t.%s))\n", f.goName)
+		case kindUnsigned:
+			g.printf("err = encoder.EncodeUint(uint64(t.%s))\n", f.goName)
+		case kindFloat:
+			g.printf("err = encoder.EncodeFloat(float64(t.%s))\n", f.goName)
+		case kindString:
+			g.printf("err = encoder.EncodeString(string(t.%s))\n", f.goName)
+		case kindBool:
+			g.printf("err = encoder.EncodeBool(bool(t.%s))\n", f.goName)
+		default:
+			g.printf("err = encoder.EncodeField(&t.%s)\n", f.goName)
+		}
+		g.printf("if err != nil {\nreturn amf.FieldPath(err, %q)\n}\n\n", f.goName)
+	}
+
+	g.printf("return encoder.EncodeObjectEnd()\n}\n")
+}
+
+func (g *generator) unmarshal(name string, fields []field) {
+	g.printf("\n// UnmarshalAMF implements amf.Unmarshaler.\n")
+	g.printf("func (t *%s) UnmarshalAMF(decoder *amf.Decoder) error {\n", name)
+	g.printf("ok, err := decoder.DecodeObjectStart(t)\n")
+	g.printf("if !ok || err != nil {\nreturn err\n}\n\n")
+	g.printf("for {\n")
+	g.printf("key, err := decoder.DecodeKey()\n")
+	g.printf("if err != nil {\nreturn err\n}\n\n")
+	g.printf("switch key {\n")
+	g.printf("case \"\":\nreturn nil\n")
+
+	for i, keys := range decodeKeys(fields) {
+		if len(keys) == 0 {
+			continue
+		}
+
+		quoted := make([]string, len(keys))
+		for j, key := range keys {
+			quoted[j] = strconv.Quote(key)
+		}
+		g.printf("case %s:\n", strings.Join(quoted, ", "))
+
+		f := fields[i]
+		switch f.kind {
+		case kindSigned:
+			g.printf("err = amf.DecodeInt(decoder, &t.%s)\n", f.goName)
+		case kindUnsigned:
+			g.printf("err = amf.DecodeUint(decoder, &t.%s)\n", f.goName)
+		case kindFloat:
+			g.printf("err = amf.DecodeFloat(decoder, &t.%s)\n", f.goName)
+		case kindString:
+			g.printf("err = amf.DecodeString(decoder, &t.%s)\n", f.goName)
+		case kindBool:
+			g.printf("err = amf.DecodeBool(decoder, &t.%s)\n", f.goName)
+		default:
+			g.printf("err = decoder.DecodeField(&t.%s)\n", f.goName)
+		}
+		g.printf("if err != nil {\nreturn amf.FieldPath(err, %q)\n}\n", f.goName)
+	}
+
+	g.printf("default:\nerr = decoder.UnknownKey(key, t)\n")
+	g.printf("if err != nil {\nreturn err\n}\n")
+	g.printf("}\n")
+	g.printf("}\n}\n")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//TestGenerate runs amfgen on testdata/fixture in a temporary GOPATH and
+//runs the test of the fixture, which compiles the generated code and checks
+//it with amf.VerifyCodec
+func TestGenerate(t *testing.T) {
+	gocmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+
+	root, err := filepath.Abs("../../../../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gopath := t.TempDir()
+	dir := filepath.Join(gopath, "src", "fixture")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"fixture.go", "fixture_test.go"} {
+		src, err := os.ReadFile(filepath.Join("testdata", "fixture", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, name), src, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(dir, "item_amf.go")
+	g := new(generator)
+	err = g.parse(dir, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := g.generate([]string{"Item", "Base", "Extra", "Registered"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(out, src, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(gocmd, "test", "fixture")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=off", "GOFLAGS=", "GOPATH="+gopath+string(filepath.ListSeparator)+root)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s\ngenerated:\n%s", err, output, src)
+	}
+	if !strings.Contains(string(output), "ok") {
+		t.Fatalf("unexpected output:\n%s", output)
+	}
+}
+
+func TestDecodeKeys(t *testing.T) {
+	fields := []field{
+		{goName: "Name", tag: "title"},
+		{goName: "Title"},
+		{goName: "URL"},
+	}
+
+	keys := decodeKeys(fields)
+	want := [][]string{{"Name", "name", "title"}, {"Title"}, {"URL", "uRL"}}
+	for i := range want {
+		if strings.Join(keys[i], ",") != strings.Join(want[i], ",") {
+			t.Errorf("keys of %s: %v, want %v", fields[i].goName, keys[i], want[i])
+		}
+	}
+}
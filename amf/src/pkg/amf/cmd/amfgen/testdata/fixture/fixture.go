@@ -0,0 +1,35 @@
+package fixture
+
+type Base struct {
+	Id int64
+}
+
+type Extra struct {
+	Note string
+}
+
+type Level int
+
+//Registered is registered as a class by the test
+type Registered struct {
+	Code  string
+	Items []*Base
+	Inner *Registered
+}
+
+type Item struct {
+	Base
+	*Extra
+	Name    string `amf.name:"title"`
+	Level   Level
+	Price   float64
+	Count   uint16
+	Enabled bool
+	Owner   *Base
+	Tags    []string
+	Parts   []*Base
+	Attrs   map[string]int
+	Props   map[string]interface{}
+	Class   *Registered
+	secret  string
+}
@@ -0,0 +1,68 @@
+package fixture
+
+import (
+	"testing"
+
+	"pkg/amf"
+)
+
+var (
+	_ amf.Marshaler   = (*Item)(nil)
+	_ amf.Unmarshaler = (*Item)(nil)
+	_ amf.Marshaler   = (*Base)(nil)
+	_ amf.Marshaler   = (*Registered)(nil)
+)
+
+func init() {
+	amf.RegisterClass("fixture.Registered", Registered{})
+}
+
+func TestVerifyCodec(t *testing.T) {
+	items := []*Item{
+		{},
+		{
+			Base:    Base{Id: 1 << 40},
+			Extra:   &Extra{Note: "note"},
+			Name:    "apple",
+			Level:   -3,
+			Price:   1.5,
+			Count:   0xffff,
+			Enabled: true,
+			Owner:   &Base{Id: 7},
+			Tags:    []string{"red", "fruit", "red"},
+			Parts:   []*Base{{Id: 1}, {Id: 2}},
+			Attrs:   map[string]int{"weight": 120},
+			Props:   map[string]interface{}{"origin": "spain"},
+			secret:  "not encoded",
+			Class:   &Registered{Code: "r", Items: []*Base{{Id: 3}}, Inner: &Registered{Code: "inner"}},
+		},
+	}
+	shared := &Base{Id: 9}
+	items = append(items, &Item{Owner: shared, Parts: []*Base{shared, shared}, Class: &Registered{Items: []*Base{shared}}})
+
+	for _, item := range items {
+		err := amf.VerifyCodec(item)
+		if err != nil {
+			t.Errorf("%+v: %v", item, err)
+		}
+	}
+}
+
+func TestVerifyCodecRegistered(t *testing.T) {
+	registered := &Registered{Code: "r", Items: []*Base{{Id: 1}}}
+	registered.Inner = &Registered{Code: "inner", Items: registered.Items}
+	err := amf.VerifyCodec(registered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := amf.Marshal(registered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded interface{}
+	err = amf.Unmarshal(data, &decoded)
+	if r, ok := decoded.(*Registered); err != nil || !ok || r.Code != "r" || r.Inner.Code != "inner" {
+		t.Errorf("decoded %#v, %v", decoded, err)
+	}
+}
@@ -0,0 +1,78 @@
+package amf
+
+import (
+	"reflect"
+)
+
+//wrapperClasses are the externalizable classes of flex wrapping an array or
+//an object, which is their only member
+var wrapperClasses = map[string]bool{
+	"flex.messaging.io.ArrayCollection": true,
+	"flex.messaging.io.ArrayList":       true,
+	"flex.messaging.io.ObjectProxy":     true,
+}
+
+var arrayCollectionTraits = &Traits{Class: "flex.messaging.io.ArrayCollection", Externalizable: true}
+
+//ArrayCollections makes the encoder wrap slices and arrays into flex
+//ArrayCollections, which flex applications usually bind to
+func ArrayCollections(wrap bool) EncoderOption {
+	return func(encoder *Encoder) {
+		encoder.wrapArrays = wrap
+	}
+}
+
+//readWrapped decodes the value wrapped by an ArrayCollection, ArrayList or
+//ObjectProxy into value, references to the wrapper resolve to the wrapped
+//value
+func (decoder *Decoder) readWrapped(value reflect.Value) error {
+	slot := len(decoder.objectCache)
+	err := decoder.addObject(reflect.Value{})
+	if err != nil {
+		return err
+	}
+
+	err = decoder.decode(value)
+	if err != nil {
+		return err
+	}
+
+	if value.Kind() == reflect.Interface {
+		value = value.Elem()
+	}
+	decoder.objectCache[slot] = value
+	return nil
+}
+
+//readWrappedValue reads the document of the value wrapped by an
+//ArrayCollection, ArrayList or ObjectProxy
+func (decoder *Decoder) readWrappedValue() (*Value, error) {
+	slot := len(decoder.objectCache)
+	err := decoder.addObject(reflect.Value{})
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := decoder.readNextValue()
+	if err != nil {
+		return nil, err
+	}
+
+	decoder.objectCache[slot] = reflect.ValueOf(value)
+	return value, nil
+}
+
+//encodeArrayCollection writes a slice wrapped into an ArrayCollection
+func (encoder *Encoder) encodeArrayCollection(value reflect.Value) error {
+	err := encoder.writeMarker(OBJECT_MARKER)
+	if err != nil {
+		return err
+	}
+
+	encoder.objectCount++
+	err = encoder.writeTraits(arrayCollectionTraits)
+	if err != nil {
+		return err
+	}
+	return encoder.encodeSlice(value)
+}
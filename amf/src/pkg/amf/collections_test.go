@@ -0,0 +1,90 @@
+package amf
+
+import (
+	"bytes"
+	"testing"
+)
+
+type collectionItem struct {
+	Name string
+}
+
+func TestArrayCollections(t *testing.T) {
+	in := &struct {
+		List  []AMFAny
+		Items []collectionItem
+	}{[]AMFAny{"a", 1.5}, []collectionItem{{"x"}}}
+
+	data, err := Marshal(in, ArrayCollections(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("flex.messaging.io.ArrayCollection")); n != 1 {
+		t.Errorf("class name written %d times in % x", n, data)
+	}
+
+	plain, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the wrapped payload decodes like the plain one
+	for name, input := range map[string][]byte{"wrapped": data, "plain": plain} {
+		var out struct {
+			List  []AMFAny
+			Items []collectionItem
+		}
+		err = Unmarshal(input, &out)
+		if err != nil || len(out.List) != 2 || out.List[0] != "a" || out.List[1] != 1.5 || len(out.Items) != 1 || out.Items[0].Name != "x" {
+			t.Errorf("%s: decoded %+v, %v", name, out, err)
+		}
+
+		var any AMFAny
+		err = Unmarshal(input, &any)
+		m, ok := any.(map[string]AMFAny)
+		if list, _ := m["list"].([]AMFAny); err != nil || !ok || len(list) != 2 {
+			t.Errorf("%s: decoded into interface %#v, %v", name, any, err)
+		}
+
+		value, err := UnmarshalAs[*Value](input)
+		if err != nil || value.String() != `{"list": ["a", 1.5], "items": [{"name": "x"}]}` {
+			t.Errorf("%s: decoded document %v, %v", name, value, err)
+		}
+	}
+
+	var raw RawValue
+	err = Unmarshal(data, &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Marshal(&raw)
+	if err != nil || !bytes.Equal(again, data) {
+		t.Errorf("raw value written as % x, %v", again, err)
+	}
+}
+
+//TestObjectProxy decodes an ObjectProxy followed by a reference to it, which
+//resolves to the wrapped object
+func TestObjectProxy(t *testing.T) {
+	input := []byte{ARRAY_MARKER, 0x05, 0x01, OBJECT_MARKER, 0x07, 0x3b}
+	input = append(input, "flex.messaging.io.ObjectProxy"...)
+	input = append(input, OBJECT_MARKER, 0x0b, 0x01, 0x09, 'N', 'a', 'm', 'e', STRING_MARKER, 0x03, 'y', 0x01)
+	input = append(input, OBJECT_MARKER, 0x02)
+
+	var items []*collectionItem
+	err := Unmarshal(input, &items)
+	if err != nil || len(items) != 2 || items[0].Name != "y" || items[1].Name != "y" {
+		t.Errorf("decoded %+v, %v", items, err)
+	}
+
+	var anys []AMFAny
+	err = Unmarshal(input, &anys)
+	if err != nil || len(anys) != 2 || anys[0].(map[string]AMFAny)["Name"] != "y" || anys[1].(map[string]AMFAny)["Name"] != "y" {
+		t.Errorf("decoded into interfaces %#v, %v", anys, err)
+	}
+
+	value, err := UnmarshalAs[*Value](input)
+	if err != nil || len(value.Elements) != 2 || value.Elements[0] != value.Elements[1] || value.Elements[0].String() != `{"Name": "y"}` {
+		t.Errorf("decoded document %v, %v", value, err)
+	}
+}
@@ -0,0 +1,121 @@
+package amf
+
+import (
+	"context"
+	"time"
+)
+
+//readDeadliner and writeDeadliner are implemented by net.Conn
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+//readDeadlineGetter and writeDeadlineGetter give the deadline set on a
+//connection before, which net.Conn can't, a wrapper of it remembering its
+//deadlines gets them back after DecodeContext and EncodeContext
+type readDeadlineGetter interface {
+	ReadDeadline() time.Time
+}
+
+type writeDeadlineGetter interface {
+	WriteDeadline() time.Time
+}
+
+//DecodeContext is like Decode, but gives up when ctx is done, checking it
+//before each value. If the reader has SetReadDeadline, like net.Conn, the
+//deadline of ctx is set on it and a blocked read is interrupted when ctx is
+//canceled. Afterwards the deadline the reader gives with ReadDeadline() is
+//set again, or it is cleared. A ctx that can't be canceled leaves the
+//deadline of the reader alone. It returns ctx.Err()
+//if ctx is done before the value is decoded, the decoder shouldn't be used
+//any more then.
+func (decoder *Decoder) DecodeContext(ctx context.Context, value AMFAny) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	if conn, ok := decoder.source.(readDeadliner); ok && ctx.Done() != nil {
+		var previous time.Time
+		if getter, ok := conn.(readDeadlineGetter); ok {
+			previous = getter.ReadDeadline()
+		}
+		stop := setDeadline(ctx, conn.SetReadDeadline, previous)
+		defer stop()
+	}
+
+	decoder.ctx = ctx
+	err = decoder.Decode(value)
+	decoder.ctx = nil
+
+	if err != nil && contextErr(ctx) != nil {
+		return contextErr(ctx)
+	}
+	return err
+}
+
+//EncodeContext is like Encode, but gives up when ctx is done, checking it
+//before each value. If the writer has SetWriteDeadline, like net.Conn, the
+//deadline of ctx is set on it and a blocked write is interrupted when ctx
+//is canceled. Afterwards the deadline the writer gives with WriteDeadline()
+//is set again, or it is cleared. It returns ctx.Err() if ctx is done before
+//the value is written.
+func (encoder *Encoder) EncodeContext(ctx context.Context, value AMFAny) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	if conn, ok := encoder.writer.(writeDeadliner); ok && ctx.Done() != nil {
+		var previous time.Time
+		if getter, ok := conn.(writeDeadlineGetter); ok {
+			previous = getter.WriteDeadline()
+		}
+		stop := setDeadline(ctx, conn.SetWriteDeadline, previous)
+		defer stop()
+	}
+
+	encoder.ctx = ctx
+	err = encoder.Encode(value)
+	encoder.ctx = nil
+
+	if err != nil && contextErr(ctx) != nil {
+		return contextErr(ctx)
+	}
+	return err
+}
+
+//setDeadline sets the deadline of ctx with set, unless previous is earlier,
+//and a deadline in the past once ctx is canceled. The returned func sets
+//previous again.
+func setDeadline(ctx context.Context, set func(time.Time) error, previous time.Time) func() {
+	if deadline, ok := ctx.Deadline(); ok && (previous.IsZero() || deadline.Before(previous)) {
+		set(deadline)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		set(time.Unix(1, 0))
+	})
+
+	return func() {
+		stop()
+		set(previous)
+	}
+}
+
+//contextErr returns the error of ctx, also when its deadline passed but ctx
+//isn't done yet, e.g. a deadline of a connection expired first
+func contextErr(ctx context.Context) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package amf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDecodeContextCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	var value AMFAny
+	err := NewDecoder(client).DecodeContext(ctx, &value)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("blocked read ended with %v", err)
+	}
+
+	err = NewDecoder(client).DecodeContext(ctx, &value)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("decoding with a canceled context: %v", err)
+	}
+}
+
+func TestEncodeContextDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := NewEncoder(server, false).EncodeContext(ctx, "nobody reads")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("blocked write ended with %v", err)
+	}
+}
+
+//TestDecodeContextClearsDeadline checks the deadline of a context isn't left
+//on the connection after the value is decoded
+func TestDecodeContextClearsDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	data, _ := Marshal("hi")
+	go func() {
+		server.Write(data)
+		time.Sleep(50 * time.Millisecond)
+		server.Write(data)
+	}()
+
+	decoder := NewDecoder(client)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var s string
+	err := decoder.DecodeContext(ctx, &s)
+	if err != nil || s != "hi" {
+		t.Fatalf("decoded %q, %v", s, err)
+	}
+
+	err = decoder.Decode(&s)
+	if err != nil || s != "hi" {
+		t.Errorf("decoded %q, %v after the deadline", s, err)
+	}
+}
+
+//cancelReader cancels a context once read from
+type cancelReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (reader *cancelReader) Read(p []byte) (int, error) {
+	reader.cancel()
+	return reader.Reader.Read(p)
+}
+
+func TestDecodeContextBetweenValues(t *testing.T) {
+	data, err := Marshal([]string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var list []string
+	err = NewDecoder(&cancelReader{bytes.NewReader(data), cancel}).DecodeContext(ctx, &list)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("decoded %v, %v", list, err)
+	}
+
+	err = NewDecoder(bytes.NewReader(data)).DecodeContext(context.Background(), &list)
+	if err != nil || len(list) != 3 {
+		t.Errorf("decoded %v, %v", list, err)
+	}
+}
+
+//deadlineConn remembers its deadlines
+type deadlineConn struct {
+	net.Conn
+	read, write time.Time
+	sets        int
+}
+
+func (conn *deadlineConn) SetReadDeadline(t time.Time) error {
+	conn.read = t
+	conn.sets++
+	return conn.Conn.SetReadDeadline(t)
+}
+
+func (conn *deadlineConn) SetWriteDeadline(t time.Time) error {
+	conn.write = t
+	conn.sets++
+	return conn.Conn.SetWriteDeadline(t)
+}
+
+func (conn *deadlineConn) ReadDeadline() time.Time  { return conn.read }
+func (conn *deadlineConn) WriteDeadline() time.Time { return conn.write }
+
+//TestContextRestoresDeadline checks the deadlines set on a connection before
+//are set again afterwards
+func TestContextRestoresDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	data, _ := Marshal("hi")
+	go func() {
+		server.Write(data)
+		io.Copy(io.Discard, server)
+	}()
+
+	previous := time.Now().Add(time.Hour)
+	conn := &deadlineConn{Conn: client}
+	conn.SetReadDeadline(previous)
+	conn.SetWriteDeadline(previous)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var s string
+	err := NewDecoder(conn).DecodeContext(ctx, &s)
+	if err != nil || s != "hi" || !conn.read.Equal(previous) {
+		t.Errorf("decoded %q, %v with read deadline %v", s, err, conn.read)
+	}
+	err = NewEncoder(conn, false).EncodeContext(ctx, "hi")
+	if err != nil || !conn.write.Equal(previous) {
+		t.Errorf("encoded with %v and write deadline %v", err, conn.write)
+	}
+
+	//a context that can't be canceled doesn't touch the deadlines
+	sets := conn.sets
+	err = NewEncoder(conn, false).EncodeContext(context.Background(), "hi")
+	if err != nil || conn.sets != sets {
+		t.Errorf("encoded with %v and %d deadlines set", err, conn.sets-sets)
+	}
+}
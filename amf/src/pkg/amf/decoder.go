@@ -1,92 +1,194 @@
 package amf
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"io"
 	"math"
 	"reflect"
 	"strconv"
-	"unicode"
+	"time"
 )
 
+//byteReader is the reader used by the decoder, an io.Reader that is not an
+//io.ByteReader is buffered
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
 type Decoder struct {
-	reader      io.Reader
+	reader      byteReader
+	source      io.Reader
+	buffered    *bufio.Reader
+	scratch     [8]byte
+	pending     bool
+	marker      byte
+	reflectOnly bool
 	stringCache []string
 	objectCache []reflect.Value
+	traitsCache []*Traits
+	amf0Objects []*Value
+	tokens      []tokenFrame
+	keys        []keyFrame
+	refs        *rawRefs //references met while capturing a RawValue
+	documentOf  func(object reflect.Value) (*Value, error) //documents of objects decoded into go values
+	capture     []byte
+	capturing   bool
+
+	depth         int
+	offset        int64
+	resetOffset   int64
+	maxDepth      int
+	maxString     int
+	maxMembers    int
+	maxReferences int
+	maxBytes      int64
+	strict        bool //unknown members fail instead of being skipped
+	scope         Scope
+	stats         TableStats
+	ctx           context.Context
 }
 
-func NewDecoder(reader io.Reader) *Decoder {
+//DecoderOption configures a Decoder, see NewDecoder and Unmarshal
+type DecoderOption func(*Decoder)
+
+//NewDecoder creates a decoder reading from reader. If reader is not an
+//io.ByteReader, it is read through a bufio.Reader, so the decoder may read
+//ahead of the decoded values, see Buffered.
+func NewDecoder(reader io.Reader, opts ...DecoderOption) *Decoder {
 	decoder := new(Decoder)
-	decoder.reader = reader
+	decoder.maxDepth = defaultMaxDepth
+	decoder.source = reader
+	if r, ok := reader.(byteReader); ok {
+		decoder.reader = r
+	} else {
+		decoder.buffered = bufio.NewReader(reader)
+		decoder.reader = decoder.buffered
+	}
+	for _, opt := range opts {
+		opt(decoder)
+	}
 	decoder.Reset()
+	decoder.stats = TableStats{}
 	return decoder
 }
 
+//Reset clears the reference tables, drops the tokens being read and starts
+//counting MaxBytes again
 func (decoder *Decoder) Reset() {
+	decoder.resetTables()
+	decoder.tokens = decoder.tokens[:0]
+	decoder.keys = decoder.keys[:0]
+	decoder.resetOffset = decoder.offset
+}
+
+//resetTables makes new tables, the old ones may still be used by RawValues
+func (decoder *Decoder) resetTables() {
+	decoder.stats.record(len(decoder.stringCache), len(decoder.objectCache), len(decoder.traitsCache))
+	decoder.stats.Resets++
 	decoder.objectCache = make([]reflect.Value, 0, 10)
 	decoder.stringCache = make([]string, 0, 10)
+	decoder.traitsCache = make([]*Traits, 0, 10)
+	decoder.amf0Objects = nil
 }
 
-func (decoder *Decoder) getField(key string, t reflect.Type) (reflect.StructField, bool) {
-	chars := []rune(key)
-	upperKey := key
-	if unicode.IsLower(chars[0]) {
-		chars[0] = unicode.ToUpper(chars[0])
-		upperKey = string(chars)
+func (decoder *Decoder) decode(value reflect.Value) error {
+	marker, err := decoder.readMarker()
+	if err != nil {
+		return decodeError(err, decoder.offset, 0, value.Type())
 	}
 
-	for i := 0; i < t.NumField(); i++ {
-		f := t.Field(i)
-
-		if f.Name == upperKey {
-			return f, true
-		}
-
-		if f.Tag.Get("amf.name") == key {
-			return f, true
-		}
-
+	offset := decoder.offset - 1
+	err = decoder.decodeMarked(marker, value)
+	if err != nil {
+		return decodeError(err, offset, marker, value.Type())
 	}
 
-	return *new(reflect.StructField), false
+	return nil
 }
 
-func (decoder *Decoder) decode(value reflect.Value) error {
-	marker, err := decoder.readMarker()
+//decodeMarked decodes the value after marker into value
+func (decoder *Decoder) decodeMarked(marker byte, value reflect.Value) error {
+	defer decoder.leave()
+	err := decoder.enter()
 	if err != nil {
 		return err
 	}
 
 	//处理空指针的情况
 	if marker == NULL_MARKER {
-		if value.IsNil() {
-			return nil
+		//the pointer given to Decode can't be set, the value it points to is
+		for value.Kind() == reflect.Ptr && !value.CanSet() && !value.IsNil() {
+			value = value.Elem()
+		}
+		if value.Type() == rawValueType {
+			return decoder.readRaw(marker, value)
 		}
 
 		switch value.Kind() {
 		case reflect.Interface, reflect.Slice, reflect.Map, reflect.Ptr:
+			if value.IsNil() {
+				return nil
+			}
+			if !value.CanSet() {
+				return errors.New("can't set nil to " + value.Type().String())
+			}
 			value.Set(reflect.Zero(value.Type()))
 			return nil
 		default:
-			return errors.New("invalid type:" + value.Type().String() + " for nil")
+			//flex sends null for strings and dates, they decode to the zero value
+			if !value.CanSet() {
+				return errors.New("invalid type:" + value.Type().String() + " for nil")
+			}
+			value.Set(reflect.Zero(value.Type()))
+			return nil
 		}
 	}
-	
+
 	if value.Kind() == reflect.Interface {
 		v := reflect.ValueOf(value.Interface())
-		if v.Kind() == reflect.Ptr || v.Kind() == reflect.Slice || v.Kind() == reflect.Map  {
+		if v.Kind() == reflect.Ptr || v.Kind() == reflect.Slice || v.Kind() == reflect.Map {
 			value = v
 		}
 	}
 
 	//如果当前为空指针则初始化
 	for value.Kind() == reflect.Ptr {
+		if value.Type() == valueType {
+			return decoder.setValue(value, marker)
+		}
 		if value.IsNil() {
+			if !value.CanSet() {
+				return errors.New("can't decode into nil " + value.Type().String())
+			}
 			value.Set(reflect.New(value.Type().Elem()))
 		}
+		if !decoder.reflectOnly && value.CanInterface() && value.Type().Implements(unmarshalerType) {
+			decoder.unreadMarker(marker)
+			return value.Interface().(Unmarshaler).UnmarshalAMF(decoder)
+		}
 		value = value.Elem()
 	}
-	
+
+	if value.Type() == rawValueType {
+		return decoder.readRaw(marker, value)
+	}
+
+	if !decoder.reflectOnly && value.Kind() == reflect.Struct && value.CanAddr() && value.CanInterface() && reflect.PointerTo(value.Type()).Implements(unmarshalerType) {
+		decoder.unreadMarker(marker)
+		return value.Addr().Interface().(Unmarshaler).UnmarshalAMF(decoder)
+	}
+
+	return decoder.decodeMarker(marker, value)
+}
+
+//decodeMarker decodes the value after marker into value, which is not a
+//pointer any more
+func (decoder *Decoder) decodeMarker(marker byte, value reflect.Value) error {
 	switch marker {
 	case FALSE_MARKER:
 		return decoder.setBool(value, false)
@@ -102,26 +204,42 @@ func (decoder *Decoder) decode(value reflect.Value) error {
 		return decoder.readSlice(value)
 	case OBJECT_MARKER:
 		return decoder.readObject(value)
+	case UNDEFINED_MARKER:
+		if !value.CanSet() {
+			return errors.New("can't set undefined to " + value.Type().String())
+		}
+		value.Set(reflect.Zero(value.Type()))
+		return nil
+	case DATE_MARKER:
+		return decoder.readDate(value)
+	case BYTEARRAY_MARKER, XML_MARKER, XMLDOC_MARKER:
+		return decoder.readBytesInto(marker, value)
 	default:
 		return errors.New("unsupported marker:" + strconv.Itoa(int(marker)))
 	}
-
-	return nil
 }
 
-func (decoder *Decoder) readFloat(value reflect.Value) error {
-	bytes, err := decoder.readBytes(8)
+//setValue decodes a document tree into a *Value
+func (decoder *Decoder) setValue(value reflect.Value, marker byte) error {
+	v, err := decoder.readValue(marker)
 	if err != nil {
 		return err
 	}
 
-	n := uint64(0)
-	for _, b := range bytes {
-		n <<= 8
-		n |= uint64(b)
+	if value.CanSet() {
+		value.Set(reflect.ValueOf(v))
+	} else if !value.IsNil() {
+		value.Elem().Set(reflect.ValueOf(v).Elem())
 	}
 
-	v := math.Float64frombits(n)
+	return nil
+}
+
+func (decoder *Decoder) readFloat(value reflect.Value) error {
+	v, err := decoder.readDouble()
+	if err != nil {
+		return err
+	}
 
 	switch value.Kind() {
 	case reflect.Float32, reflect.Float64:
@@ -131,7 +249,7 @@ func (decoder *Decoder) readFloat(value reflect.Value) error {
 	case reflect.Uint32, reflect.Uint, reflect.Uint64:
 		value.SetUint(uint64(v))
 	case reflect.Interface:
-		value.Set(reflect.ValueOf(v))
+		return setInterface(value, reflect.ValueOf(v))
 	default:
 		return errors.New("invalid type:" + value.Type().String() + " for double")
 	}
@@ -156,8 +274,10 @@ func (decoder *Decoder) readInteger(value reflect.Value) error {
 		value.SetInt(int64(vv))
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		value.SetUint(uint64(uv))
+	case reflect.Float32, reflect.Float64:
+		value.SetFloat(float64(vv))
 	case reflect.Interface:
-		value.Set(reflect.ValueOf(uv))
+		return setInterface(value, reflect.ValueOf(vv))
 	default:
 		return errors.New("invalid type:" + value.Type().String() + " for integer")
 	}
@@ -165,28 +285,48 @@ func (decoder *Decoder) readInteger(value reflect.Value) error {
 	return nil
 }
 
-func (decoder *Decoder) readString(value reflect.Value) error {
+func (decoder *Decoder) readUTF8() (string, error) {
 
 	index, err := decoder.readU29()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	ret := ""
 	if (index & 0x01) == 0 {
-		ret = decoder.stringCache[int(index>>1)]
-	} else {
 		index >>= 1
-		bytes, err := decoder.readBytes(int(index))
-		if err != nil {
-			return err
+		if int(index) >= len(decoder.stringCache) {
+			return "", errors.New("invalid string reference:" + strconv.Itoa(int(index)))
 		}
+		if decoder.refs != nil {
+			decoder.refs.add(int(index), decoder.refs.strings)
+		}
+		return decoder.stringCache[index], nil
+	}
+
+	index >>= 1
+	err = decoder.checkString(int(index))
+	if err != nil {
+		return "", err
+	}
 
-		ret = string(bytes)
+	bytes, err := decoder.readBytes(int(index))
+	if err != nil {
+		return "", err
 	}
-	
+
+	ret := string(bytes)
 	if ret != "" {
-		decoder.stringCache = append(decoder.stringCache, ret)
+		err = decoder.addString(ret)
+	}
+
+	return ret, err
+}
+
+func (decoder *Decoder) readString(value reflect.Value) error {
+
+	ret, err := decoder.readUTF8()
+	if err != nil {
+		return err
 	}
 
 	switch value.Kind() {
@@ -207,7 +347,7 @@ func (decoder *Decoder) readString(value reflect.Value) error {
 	case reflect.String:
 		value.SetString(ret)
 	case reflect.Interface:
-		value.Set(reflect.ValueOf(ret))
+		return setInterface(value, reflect.ValueOf(ret))
 	default:
 		return errors.New("invalid type:" + value.Type().String() + " for string")
 	}
@@ -215,101 +355,298 @@ func (decoder *Decoder) readString(value reflect.Value) error {
 	return nil
 }
 
-func (decoder *Decoder) readObject(value reflect.Value) error {
+var timeType = reflect.TypeOf(time.Time{})
+
+//readDate decodes a date into a time.Time
+func (decoder *Decoder) readDate(value reflect.Value) error {
+	index, err := decoder.readU29()
+	if err != nil {
+		return err
+	}
+
+	if (index & 0x01) == 0 {
+		return decoder.setReference(value, int(index>>1))
+	}
+
+	ms, err := decoder.readDouble()
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(time.UnixMilli(int64(ms)))
+	err = decoder.addObject(v)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case value.Type() == timeType:
+		value.Set(v)
+	case value.Kind() == reflect.Interface:
+		return setInterface(value, v)
+	default:
+		return errors.New("invalid type:" + value.Type().String() + " for date")
+	}
+	return nil
+}
 
+//readBytesInto decodes a byte array into a []byte, or xml into a string
+func (decoder *Decoder) readBytesInto(marker byte, value reflect.Value) error {
 	index, err := decoder.readU29()
 	if err != nil {
 		return err
 	}
 
 	if (index & 0x01) == 0 {
-		value.Set(decoder.objectCache[int(index>>1)])
+		return decoder.setReference(value, int(index>>1))
+	}
+
+	length := int(index >> 1)
+	err = decoder.checkString(length)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := decoder.readBytes(length)
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(bytes)
+	if marker != BYTEARRAY_MARKER {
+		v = reflect.ValueOf(string(bytes))
+	}
+	err = decoder.addObject(v)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case value.Kind() == reflect.Interface:
+		return setInterface(value, v)
+	case v.Type().ConvertibleTo(value.Type()) && value.Kind() == v.Kind():
+		value.Set(v.Convert(value.Type()))
+	default:
+		return errors.New("invalid type:" + value.Type().String() + " for marker:" + strconv.Itoa(int(marker)))
+	}
+	return nil
+}
+
+//setInterface stores v into the interface value, which may have methods v
+//doesn't implement
+func setInterface(value reflect.Value, v reflect.Value) error {
+	if !v.Type().AssignableTo(value.Type()) {
+		return errors.New("invalid type:" + value.Type().String() + " for " + v.Type().String())
+	}
+	value.Set(v)
+	return nil
+}
+
+//setReference sets value to an entry of the object table
+func (decoder *Decoder) setReference(value reflect.Value, index int) error {
+	if index >= len(decoder.objectCache) {
+		return errors.New("invalid object reference:" + strconv.Itoa(index))
+	}
+
+	ref := decoder.objectCache[index]
+	if !ref.IsValid() || !value.CanSet() || !ref.Type().AssignableTo(value.Type()) {
+		return errors.New("invalid object reference:" + strconv.Itoa(index) + " for " + value.Type().String())
+	}
+	value.Set(ref)
+	return nil
+}
+
+//readObjectHeader reads the header of an object, ref is true if the object
+//is a reference to index in the object table, otherwise the traits of the
+//object are returned, which may be externalizable
+func (decoder *Decoder) readObjectHeader() (*Traits, int, bool, error) {
+
+	index, err := decoder.readU29()
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if (index & 0x01) == 0 {
+		return nil, int(index >> 1), true, nil
+	}
+
+	traits, err := decoder.readTraits(index >> 1)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	return traits, 0, false, nil
+}
+
+//readMembers reads the sealed members of an object, then the dynamic ones,
+//calling member to decode each value
+func (decoder *Decoder) readMembers(traits *Traits, member func(key string) error) error {
+	n := 0
+	for _, key := range traits.Members {
+		n++
+		err := decoder.checkMembers(n)
+		if err != nil {
+			return err
+		}
+
+		err = member(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !traits.Dynamic {
 		return nil
 	}
 
-	if index != 0x0b {
-		return errors.New("invalid object type")
+	for {
+		key, err := decoder.readUTF8()
+		if err != nil {
+			return err
+		}
+
+		if key == "" {
+			return nil
+		}
+
+		n++
+		err = decoder.checkMembers(n)
+		if err != nil {
+			return err
+		}
+
+		err = member(key)
+		if err != nil {
+			return err
+		}
 	}
+}
 
-	sep, err := decoder.readMarker()
+func (decoder *Decoder) readObject(value reflect.Value) error {
+
+	traits, index, ref, err := decoder.readObjectHeader()
 	if err != nil {
 		return err
 	}
 
-	if sep != 0x01 {
-		return errors.New("type object not allowed")
+	if ref {
+		return decoder.setReference(value, index)
+	}
+
+	if traits.Externalizable {
+		return decoder.readExternal(traits, value)
 	}
 
 	if value.Kind() == reflect.Interface {
+		if info, ok := classByAlias(traits.Class); ok && !info.external {
+			v := reflect.New(info.t)
+			err = setInterface(value, v)
+			if err != nil {
+				return err
+			}
+
+			err = decoder.addObject(v)
+			if err != nil {
+				return err
+			}
+			return decoder.readStruct(traits, v.Elem())
+		}
+
 		var dummy map[string]AMFAny
 		v := reflect.MakeMap(reflect.TypeOf(dummy))
-		value.Set(v)
+		err = setInterface(value, v)
+		if err != nil {
+			return err
+		}
 		value = v
 	}
 
 	if value.Kind() == reflect.Map {
+		keyType := value.Type().Key()
+		if keyType.Kind() != reflect.String {
+			return errors.New("only string key allowed in map:" + value.Type().String())
+		}
+
 		if value.IsNil() {
+			if !value.CanSet() {
+				return errors.New("can't decode into nil " + value.Type().String())
+			}
 			v := reflect.MakeMap(value.Type())
 			value.Set(v)
 			value = v
 		}
-		
-		decoder.objectCache = append(decoder.objectCache, value)
 
-		for {
-			key := ""
-			err = decoder.readString(reflect.ValueOf(&key).Elem())
-			if err != nil {
-				return err
-			}
-			
-
-			if key == "" {
-				break
-			}
+		err = decoder.addObject(value)
+		if err != nil {
+			return err
+		}
 
+		return decoder.readMembers(traits, func(key string) error {
 			v := reflect.New(value.Type().Elem())
-			err = decoder.decode(v)
+			err := decoder.decode(v)
 			if err != nil {
-				return err
+				return prependPath(err, keyElem(key))
 			}
 
-			value.SetMapIndex(reflect.ValueOf(key), v.Elem())
-		}
-		
-		return nil
+			value.SetMapIndex(reflect.ValueOf(key).Convert(keyType), v.Elem())
+			return nil
+		})
 	}
 
 	if value.Kind() != reflect.Struct {
 		return errors.New("struct type expected, found:" + value.Type().String())
 	}
-	
 
-	decoder.objectCache = append(decoder.objectCache, value)
+	err = decoder.addObject(value)
+	if err != nil {
+		return err
+	}
+	return decoder.readStruct(traits, value)
+}
 
-	for {
-	
-		key := ""
-		err = decoder.readString(reflect.ValueOf(&key).Elem())
-		if err != nil {
-			return err
-		}
-		
-		if key == "" {
-			break
-		}
+//StrictMembers makes members that match no field of the struct decoded into
+//an error, by default they are skipped
+func StrictMembers(strict bool) DecoderOption {
+	return func(decoder *Decoder) {
+		decoder.strict = strict
+	}
+}
+
+//readStruct reads the members of an object into the fields of value
+func (decoder *Decoder) readStruct(traits *Traits, value reflect.Value) error {
+	plan := getStructPlan(value.Type())
 
-		f, ok := decoder.getField(key, value.Type())
+	return decoder.readMembers(traits, func(key string) error {
+		f, ok := plan.field(key)
 		if !ok {
-			return errors.New("key:" + key + " not found in struct:" + value.Type().String())
+			return decoder.unknownMember(key, value.Type())
 		}
-		
-		err = decoder.decode(value.FieldByName(f.Name))
+
+		err := decoder.decode(value.FieldByIndex(f.index))
 		if err != nil {
-			return err
+			return prependPath(err, "."+value.Type().FieldByIndex(f.index).Name)
 		}
+		return nil
+	})
+}
+
+//unknownMember skips the value of a member no field of t matches, or fails
+//with StrictMembers
+func (decoder *Decoder) unknownMember(key string, t reflect.Type) error {
+	if decoder.strict {
+		return errors.New("key:" + key + " not found in struct:" + t.String())
+	}
+
+	marker, err := decoder.readMarker()
+	if err != nil {
+		return decodeError(err, decoder.offset, 0, nil)
+	}
+
+	offset := decoder.offset - 1
+	err = decoder.skip(marker)
+	if err != nil {
+		return prependPath(decodeError(err, offset, marker, nil), memberElem(key))
 	}
-	
 	return nil
 }
 
@@ -321,9 +658,7 @@ func (decoder *Decoder) readSlice(value reflect.Value) error {
 	}
 
 	if (index & 0x01) == 0 {
-		slice := decoder.objectCache[int(index>>1)]
-		value.Set(slice)
-		return nil
+		return decoder.setReference(value, int(index>>1))
 	}
 
 	index >>= 1
@@ -335,59 +670,158 @@ func (decoder *Decoder) readSlice(value reflect.Value) error {
 	if sep != 0x01 {
 		return errors.New("ecma array not allowed")
 	}
-	
-	if value.IsNil() {
-		var v reflect.Value
-		if value.Type().Kind() == reflect.Slice {
-			v = reflect.MakeSlice(value.Type(), int(index), int(index))
-		} else if value.Type().Kind() == reflect.Interface {
-			v = reflect.ValueOf(make([]AMFAny,int(index), int(index)))
-		} else {
+
+	length := int(index)
+	err = decoder.checkMembers(length)
+	if err != nil {
+		return err
+	}
+
+	switch value.Kind() {
+	case reflect.Array:
+		if length > value.Len() {
+			return errors.New("array of length:" + strconv.Itoa(length) + " too long for " + value.Type().String())
+		}
+		err = decoder.addObject(value)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < length; i++ {
+			err = decoder.decode(value.Index(i))
+			if err != nil {
+				return prependPath(err, indexElem(i))
+			}
+		}
+		for i := length; i < value.Len(); i++ {
+			value.Index(i).Set(reflect.Zero(value.Type().Elem()))
+		}
+		return nil
+	case reflect.Slice:
+		if !value.IsNil() && value.Len() == length {
+			err = decoder.addObject(value)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < length; i++ {
+				err = decoder.decode(value.Index(i))
+				if err != nil {
+					return prependPath(err, indexElem(i))
+				}
+			}
+			return nil
+		}
+		if !value.CanSet() {
+			return errors.New("can't decode array of length:" + strconv.Itoa(length) + " into " + value.Type().String())
+		}
+	case reflect.Interface:
+		var dummy []AMFAny
+		if !reflect.TypeOf(dummy).AssignableTo(value.Type()) {
 			return errors.New("invalid type:" + value.Type().String() + " for array")
 		}
-		value.Set(v)
-		value = v
+	default:
+		return errors.New("invalid type:" + value.Type().String() + " for array")
 	}
-	
-	decoder.objectCache = append(decoder.objectCache, value)
-	
-	for i := 0; i < int(index); i++ {
-		c := value.Index(i)
-		err = decoder.decode(c)
+
+	t := value.Type()
+	if t.Kind() == reflect.Interface {
+		var dummy []AMFAny
+		t = reflect.TypeOf(dummy)
+	}
+
+	//the length comes from the input, so the slice grows with the elements
+	//actually decoded instead of being allocated up front
+	v := reflect.MakeSlice(t, 0, min(length, maxPrealloc))
+	slot := len(decoder.objectCache)
+	err = decoder.addObject(v)
+	if err != nil {
+		return err
+	}
+
+	zero := reflect.Zero(t.Elem())
+	for i := 0; i < length; i++ {
+		v = reflect.Append(v, zero)
+		err = decoder.decode(v.Index(i))
 		if err != nil {
-			return err
+			return prependPath(err, indexElem(i))
 		}
 	}
-	
+
+	decoder.objectCache[slot] = v
+	value.Set(v)
 	return nil
 }
 
 func (decoder *Decoder) setBool(value reflect.Value, v bool) error {
 
 	switch value.Kind() {
-		case reflect.Bool:
+	case reflect.Bool:
 		value.SetBool(v)
 	case reflect.Interface:
-		value.Set(reflect.ValueOf(v))
+		return setInterface(value, reflect.ValueOf(v))
 	default:
 		return errors.New("invalid type:" + value.Type().String() + " for bool")
 	}
 	return nil
 }
 
+//Decode decodes the next value into value. It returns io.EOF if the input
+//ends before the value, other errors are a *DecodeError, e.g. wrapping
+//io.ErrUnexpectedEOF if the input ends inside the value.
 func (decoder *Decoder) Decode(value AMFAny) error {
-	return decoder.decode(reflect.ValueOf(value))
+	return decoder.DecodeValue(reflect.ValueOf(value))
 }
 
+//DecodeValue is like Decode, value must be a pointer, a map or a slice that
+//can't be set, or a value that can be set
 func (decoder *Decoder) DecodeValue(value reflect.Value) error {
-	return decoder.decode(value)
+	if !value.IsValid() {
+		return errors.New("can't decode into nil")
+	}
+
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+	default:
+		if !value.CanSet() {
+			return errors.New("can't decode into non-pointer " + value.Type().String())
+		}
+	}
+
+	if len(decoder.tokens) > 0 {
+		err := decoder.tokenValue()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := decoder.peekMarker()
+	if err != nil {
+		return err
+	}
+
+	decoder.startValue()
+	err = decoder.decode(value)
+	if decoder.depth > 0 {
+		return err
+	}
+	return topPath(err)
+}
+
+//Buffered returns the data read ahead from the reader that has not been
+//decoded yet
+func (decoder *Decoder) Buffered() io.Reader {
+	if decoder.buffered == nil {
+		return bytes.NewReader(nil)
+	}
+
+	data, _ := decoder.buffered.Peek(decoder.buffered.Buffered())
+	return bytes.NewReader(data)
 }
 
 func (decoder *Decoder) readU29() (uint32, error) {
 
 	var ret uint32 = 0
 	for i := 0; i < 4; i++ {
-		b, err := decoder.readMarker()
+		b, err := decoder.readByte()
 		if err != nil {
 			return 0, err
 		}
@@ -405,24 +839,122 @@ func (decoder *Decoder) readU29() (uint32, error) {
 	return ret, nil
 }
 
+func (decoder *Decoder) readDouble() (float64, error) {
+	err := decoder.readFull(decoder.scratch[:8])
+	if err != nil {
+		return 0, err
+	}
+
+	return math.Float64frombits(binary.BigEndian.Uint64(decoder.scratch[:8])), nil
+}
+
+func (decoder *Decoder) readUint16() (uint16, error) {
+	err := decoder.readFull(decoder.scratch[:2])
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint16(decoder.scratch[:2]), nil
+}
+
+func (decoder *Decoder) readUint32() (uint32, error) {
+	err := decoder.readFull(decoder.scratch[:4])
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(decoder.scratch[:4]), nil
+}
+
 func (decoder *Decoder) readBytes(length int) ([]byte, error) {
-	buffer := make([]byte, length)
-	for length != 0 {
-		l, err := decoder.reader.Read(buffer)
+	err := decoder.checkBytes(length)
+	if err != nil {
+		return nil, err
+	}
+
+	if length <= maxPreallocBytes {
+		buffer := make([]byte, length)
+		err = decoder.readFull(buffer)
 		if err != nil {
 			return nil, err
 		}
-		length -= l
+		return buffer, nil
+	}
+
+	//a long length may be bogus, so read in growing chunks and let the end of
+	//input stop it before everything is allocated
+	buffer := make([]byte, 0, maxPreallocBytes)
+	for len(buffer) < length {
+		if len(buffer) == cap(buffer) {
+			buffer = append(buffer, 0)[:len(buffer)]
+		}
+		n := min(cap(buffer), length)
+		err = decoder.readFull(buffer[len(buffer):n])
+		if err != nil {
+			return nil, err
+		}
+		buffer = buffer[:n]
 	}
 
 	return buffer, nil
 }
 
-func (decoder *Decoder) readMarker() (byte, error) {
-	bytes, err := decoder.readBytes(1)
+//readFull fills buffer, the input ending inside a value is an error
+func (decoder *Decoder) readFull(buffer []byte) error {
+	n, err := io.ReadFull(decoder.reader, buffer)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if decoder.capturing {
+		decoder.capture = append(decoder.capture, buffer...)
+	}
+	return decoder.consume(n)
+}
+
+func (decoder *Decoder) readByte() (byte, error) {
+	b, err := decoder.reader.ReadByte()
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
 	if err != nil {
 		return 0, err
 	}
+	if decoder.capturing {
+		decoder.capture = append(decoder.capture, b)
+	}
+	return b, decoder.consume(1)
+}
+
+//peekMarker reads the marker of the next top level value, io.EOF is
+//returned as it is, since the input ends between values
+func (decoder *Decoder) peekMarker() error {
+	if decoder.pending {
+		return nil
+	}
+
+	marker, err := decoder.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	decoder.unreadMarker(marker)
+	return decoder.consume(1)
+}
+
+//unreadMarker makes the next readMarker return marker again
+func (decoder *Decoder) unreadMarker(marker byte) {
+	decoder.pending = true
+	decoder.marker = marker
+}
+
+func (decoder *Decoder) readMarker() (byte, error) {
+	if decoder.pending {
+		decoder.pending = false
+		return decoder.marker, nil
+	}
 
-	return bytes[0], nil
+	return decoder.readByte()
 }
@@ -0,0 +1,535 @@
+package amf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+type readerItem struct {
+	Id    int
+	Name  string
+	Price float64
+	Data  []byte
+	Tags  []string
+	Attrs map[string]AMFAny
+}
+
+func readerItems() []*readerItem {
+	return []*readerItem{
+		{Id: 1, Name: "apple", Price: 1.5, Data: []byte{1, 2}, Tags: []string{"red", "fruit"}, Attrs: map[string]AMFAny{"origin": "spain"}},
+		{Id: 2, Name: strings.Repeat("long name ", 1000), Data: bytes.Repeat([]byte{0xaa}, 5000), Tags: []string{"red"}, Attrs: map[string]AMFAny{"origin": "spain", "farm": "north"}},
+	}
+}
+
+func TestDecodeReaders(t *testing.T) {
+	var data bytes.Buffer
+	encoder := NewEncoder(&data, false)
+	for _, item := range readerItems() {
+		encoder.Reset()
+		err := encoder.Encode(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(data.Bytes())
+	writer.Close()
+
+	readers := map[string]func() io.Reader{
+		"bytes":   func() io.Reader { return bytes.NewReader(data.Bytes()) },
+		"onebyte": func() io.Reader { return iotest.OneByteReader(bytes.NewReader(data.Bytes())) },
+		"half":    func() io.Reader { return iotest.HalfReader(bytes.NewReader(data.Bytes())) },
+		"dataerr": func() io.Reader { return iotest.DataErrReader(bytes.NewReader(data.Bytes())) },
+		"gzip": func() io.Reader {
+			reader, err := gzip.NewReader(bytes.NewReader(compressed.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return reader
+		},
+		"pipe": func() io.Reader {
+			reader, writer := io.Pipe()
+			go func() {
+				b := data.Bytes()
+				for len(b) > 0 {
+					n := min(len(b), 7)
+					writer.Write(b[:n])
+					b = b[n:]
+				}
+				writer.Close()
+			}()
+			return reader
+		},
+	}
+
+	for name, reader := range readers {
+		decoder := NewDecoder(reader())
+		for i, want := range readerItems() {
+			var item readerItem
+			decoder.Reset()
+			err := decoder.Decode(&item)
+			if err != nil {
+				t.Fatalf("%s: item %d: %v", name, i, err)
+			}
+			if !reflect.DeepEqual(&item, want) {
+				t.Errorf("%s: item %d decoded wrongly", name, i)
+			}
+		}
+
+		var item readerItem
+		err := decoder.Decode(&item)
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("%s: decoding after the end: %v", name, err)
+		}
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	data, err := Marshal(readerItems()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 1; n < len(data); n++ {
+		var item readerItem
+		err := NewDecoder(iotest.OneByteReader(bytes.NewReader(data[:n]))).Decode(&item)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%d of %d bytes: %v", n, len(data), err)
+		}
+	}
+}
+
+func TestDecodeBuffered(t *testing.T) {
+	data, err := Marshal("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, "rest"...)
+
+	decoder := NewDecoder(iotest.HalfReader(bytes.NewReader(data)))
+	var s string
+	err = decoder.Decode(&s)
+	if err != nil || s != "first" {
+		t.Fatalf("decoded %q, %v", s, err)
+	}
+
+	rest, _ := io.ReadAll(decoder.Buffered())
+	if !strings.HasPrefix("rest", string(rest)) {
+		t.Errorf("buffered %q", rest)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	inputs := map[string][]byte{
+		"string reference":     {STRING_MARKER, 0x02},
+		"object reference":     {OBJECT_MARKER, 0x02},
+		"traits reference":     {OBJECT_MARKER, 0x05},
+		"array reference":      {ARRAY_MARKER, 0x02},
+		"date reference":       {DATE_MARKER, 0x02},
+		"xml reference":        {XML_MARKER, 0x02},
+		"bytearray reference":  {BYTEARRAY_MARKER, 0x02},
+		"vector reference":     {VECTOR_INT_MARKER, 0x02},
+		"dictionary reference": {DICTIONARY_MARKER, 0x02},
+		"unknown marker":       {0x20},
+		"key reference":        {OBJECT_MARKER, 0x0b, 0x01, 0x04, STRING_MARKER, 0x01},
+		"negative length":      {ARRAY_MARKER, 0xff, 0xff, 0xff, 0xff},
+	}
+
+	targets := []func() AMFAny{
+		func() AMFAny { return new(AMFAny) },
+		func() AMFAny { return new(fuzzStruct) },
+		func() AMFAny { return new([]int) },
+		func() AMFAny { return new(map[string]string) },
+		func() AMFAny { return new(string) },
+		func() AMFAny { return new(*Value) },
+	}
+
+	for name, input := range inputs {
+		for _, target := range targets {
+			value := target()
+			err := NewDecoder(bytes.NewReader(input)).Decode(value)
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Errorf("%s into %T: %v", name, value, err)
+			}
+		}
+
+		_, err := NewDecoder(bytes.NewReader(input)).ReadValue()
+		if err == nil {
+			t.Errorf("%s read as a document", name)
+		}
+	}
+}
+
+type fuzzStruct struct {
+	Uid    uint32
+	Name   string
+	Score  float64
+	Ok     bool
+	Items  []AMFAny
+	Attrs  map[string]AMFAny
+	Next   *fuzzStruct
+	Values [4]int32
+}
+
+//fuzzSeeds are encodings of the values the decoder usually meets
+func fuzzSeeds(f *testing.F) {
+	seeds := []AMFAny{
+		nil,
+		true,
+		-1,
+		0x200000,
+		3.25,
+		"hello",
+		[]byte{1, 2, 3},
+		[]AMFAny{"a", "a", 1, nil},
+		map[string]AMFAny{"k": "v", "n": map[string]AMFAny{"k": "v"}},
+		&fuzzStruct{Uid: 7, Name: "root", Items: []AMFAny{"x", 2.5}, Attrs: map[string]AMFAny{"a": "x"}, Next: &fuzzStruct{Name: "root"}, Values: [4]int32{1, -2}},
+		&CommandMessage{Operation: CLIENT_PING_OPERATION, MessageId: "M1", Headers: map[string]AMFAny{DSIdHeader: "nil"}},
+		&RemotingMessage{Destination: "svc", Operation: "echo", Body: []AMFAny{"x"}},
+		&Value{Kind: KindVector, VectorType: VECTOR_INT_MARKER, Elements: []*Value{{Kind: KindInteger, Int: 3}}},
+	}
+	for _, seed := range seeds {
+		data, err := Marshal(seed)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	data, err := Marshal(&CommandMessage{Operation: POLL_OPERATION}, SmallMessages(true))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+
+	var packet bytes.Buffer
+	err = WritePacket(&packet, &Packet{Version: 3, Headers: []Header{{Name: "Credentials", Value: map[string]AMFAny{"userid": "u"}}}, Messages: []Message{{Target: "svc.echo", Response: "/1", Data: []AMFAny{"x", 1}}}})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(packet.Bytes())
+}
+
+//FuzzDecode feeds the input to every way of decoding into go values, none
+//may panic
+func FuzzDecode(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var any AMFAny
+		NewDecoder(bytes.NewReader(data)).Decode(&any)
+
+		var s fuzzStruct
+		NewDecoder(bytes.NewReader(data)).Decode(&s)
+
+		var m map[string]string
+		NewDecoder(bytes.NewReader(data)).Decode(&m)
+
+		var list []fuzzStruct
+		NewDecoder(bytes.NewReader(data)).Decode(&list)
+
+		var message CommandMessage
+		NewDecoder(bytes.NewReader(data)).Decode(&message)
+
+		tokens := NewDecoder(bytes.NewReader(data))
+		for {
+			_, err := tokens.Token()
+			if err != nil {
+				break
+			}
+		}
+
+		skipper := NewDecoder(bytes.NewReader(data))
+		for skipper.Skip() == nil {
+		}
+
+		//a raw value read at the start of the input is written back as it is
+		var raw RawValue
+		if NewDecoder(bytes.NewReader(data)).Decode(&raw) == nil {
+			out, err := Marshal(&raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, raw.Data) {
+				t.Fatalf("raw value % x written as % x", raw.Data, out)
+			}
+		}
+
+		//a decoded packet encodes and decodes again
+		packet, err := ReadPacket(bytes.NewReader(data))
+		if err == nil {
+			var buffer bytes.Buffer
+			err = WritePacket(&buffer, packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ReadPacket(&buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+//FuzzReadValue checks that documents read from the input encode and decode
+//again to the same bytes
+func FuzzReadValue(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoder := NewDecoder(bytes.NewReader(data))
+		for {
+			value, err := decoder.ReadValue()
+			if err != nil {
+				break
+			}
+
+			out, err := Marshal(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := UnmarshalAs[*Value](out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out2, err := Marshal(again)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, out2) {
+				t.Fatalf("document % x written again as % x", out, out2)
+			}
+		}
+	})
+}
+
+type traitsUser struct {
+	Name string
+	City string
+}
+
+//traitsUnmarshaler reads its keys with DecodeKey, like the code of amfgen
+type traitsUnmarshaler struct {
+	traitsUser
+	keys []string
+}
+
+func (user *traitsUnmarshaler) UnmarshalAMF(decoder *Decoder) error {
+	ok, err := decoder.DecodeObjectStart(user)
+	if !ok || err != nil {
+		return err
+	}
+	for {
+		key, err := decoder.DecodeKey()
+		if err != nil || key == "" {
+			return err
+		}
+		user.keys = append(user.keys, key)
+		switch key {
+		case "name":
+			err = DecodeString(decoder, &user.Name)
+		case "city":
+			err = DecodeString(decoder, &user.City)
+		default:
+			err = decoder.UnknownKey(key, user)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//traitsInputs are objects of the class C with the members name and city
+var traitsInputs = map[string][]byte{
+	"anonymous dynamic": {OBJECT_MARKER, 0x0b, 0x01, 0x09, 'n', 'a', 'm', 'e', STRING_MARKER, 0x07, 'b', 'o', 'b', 0x09, 'c', 'i', 't', 'y', STRING_MARKER, 0x03, 'x', 0x01},
+	"sealed": {OBJECT_MARKER, 0x23, 0x03, 'C', 0x09, 'n', 'a', 'm', 'e', 0x09, 'c', 'i', 't', 'y', STRING_MARKER, 0x07, 'b', 'o', 'b', STRING_MARKER, 0x03, 'x'},
+	"sealed and dynamic": {OBJECT_MARKER, 0x1b, 0x03, 'C', 0x09, 'n', 'a', 'm', 'e', STRING_MARKER, 0x07, 'b', 'o', 'b', 0x09, 'c', 'i', 't', 'y', STRING_MARKER, 0x03, 'x', 0x01},
+}
+
+func TestDecodeTraits(t *testing.T) {
+	want := traitsUser{Name: "bob", City: "x"}
+	documents := map[string]string{
+		"anonymous dynamic":  `{"name": "bob", "city": "x"}`,
+		"sealed":             `C{name: "bob", city: "x"}`,
+		"sealed and dynamic": `C{name: "bob", "city": "x"}`,
+	}
+	for name, input := range traitsInputs {
+		var user traitsUser
+		err := Unmarshal(input, &user)
+		if err != nil || user != want {
+			t.Errorf("%s into struct: %+v, %v", name, user, err)
+		}
+
+		var m map[string]string
+		err = Unmarshal(input, &m)
+		if err != nil || len(m) != 2 || m["name"] != "bob" || m["city"] != "x" {
+			t.Errorf("%s into map: %v, %v", name, m, err)
+		}
+
+		var any AMFAny
+		err = Unmarshal(input, &any)
+		if m, ok := any.(map[string]AMFAny); err != nil || !ok || m["name"] != "bob" || m["city"] != "x" {
+			t.Errorf("%s into interface: %#v, %v", name, any, err)
+		}
+
+		var generated traitsUnmarshaler
+		err = Unmarshal(input, &generated)
+		if err != nil || generated.traitsUser != want || strings.Join(generated.keys, ",") != "name,city" {
+			t.Errorf("%s through DecodeKey: %+v, %v", name, generated, err)
+		}
+
+		value, err := UnmarshalAs[*Value](input)
+		if err != nil || value.String() != documents[name] {
+			t.Errorf("%s into document: %v, %v", name, value, err)
+		}
+	}
+}
+
+//TestDecodeTraitsReference decodes objects whose traits were sent before
+func TestDecodeTraitsReference(t *testing.T) {
+	sealed := traitsInputs["sealed"]
+	input := []byte{ARRAY_MARKER, 0x07, 0x01}
+	input = append(input, sealed...)
+	input = append(input, OBJECT_MARKER, 0x01, STRING_MARKER, 0x07, 'a', 'm', 'y', STRING_MARKER, 0x03, 'y')
+	//the class name and the member names are string references too
+	input = append(input, OBJECT_MARKER, 0x23, 0x00, 0x02, 0x04, STRING_MARKER, 0x07, 'b', 'o', 'b', STRING_MARKER, 0x03, 'z')
+
+	var users []traitsUser
+	err := Unmarshal(input, &users)
+	want := []traitsUser{{"bob", "x"}, {"amy", "y"}, {"bob", "z"}}
+	if err != nil || !reflect.DeepEqual(users, want) {
+		t.Errorf("decoded %+v, %v", users, err)
+	}
+
+	var generated []traitsUnmarshaler
+	err = Unmarshal(input, &generated)
+	if err != nil || len(generated) != 3 || generated[1].traitsUser != want[1] || generated[2].traitsUser != want[2] {
+		t.Errorf("decoded through DecodeKey %+v, %v", generated, err)
+	}
+
+	value, err := UnmarshalAs[*Value](input)
+	if err != nil || value.Elements[0].Traits != value.Elements[1].Traits || value.Elements[2].Class() != "C" {
+		t.Errorf("decoded document %v, %v", value, err)
+	}
+
+	for _, bad := range [][]byte{
+		{ARRAY_MARKER, 0x03, 0x01, OBJECT_MARKER, 0x05},
+		{OBJECT_MARKER, 0x23, 0x03, 'C', 0x09, 'n', 'a', 'm', 'e'},
+	} {
+		var user traitsUser
+		err := Unmarshal(bad, &user)
+		if err == nil {
+			t.Errorf("% x decoded", bad)
+		}
+	}
+}
+
+type nullTarget struct {
+	Name  string
+	Count int
+	Ok    bool
+	Date  time.Time
+	User  traitsUser
+	Ptr   *traitsUser
+	List  []int
+	Attrs map[string]AMFAny
+	Any   AMFAny
+}
+
+//TestDecodeNull checks that null, which flex sends for unset strings, numbers
+//and dates too, decodes to the zero value of any type
+func TestDecodeNull(t *testing.T) {
+	set := nullTarget{
+		Name:  "name",
+		Count: 3,
+		Ok:    true,
+		Date:  time.Unix(100, 0),
+		User:  traitsUser{Name: "bob"},
+		Ptr:   &traitsUser{Name: "bob"},
+		List:  []int{1},
+		Attrs: map[string]AMFAny{"k": "v"},
+		Any:   "x",
+	}
+
+	input := []byte{OBJECT_MARKER, 0x0b, 0x01}
+	for _, key := range []string{"name", "count", "ok", "date", "user", "ptr", "list", "attrs", "any"} {
+		input = append(input, byte(len(key)<<1|1))
+		input = append(input, key...)
+		input = append(input, NULL_MARKER)
+	}
+	input = append(input, 0x01)
+
+	target := set
+	err := Unmarshal(input, &target)
+	if err != nil || !reflect.DeepEqual(target, nullTarget{}) {
+		t.Errorf("decoded %+v, %v", target, err)
+	}
+
+	targets := []AMFAny{&set.Name, &set.Count, &set.Ok, &set.Date, &set.User, &set.Ptr, &set.List, &set.Attrs, &set.Any}
+	for _, target := range targets {
+		err := Unmarshal([]byte{NULL_MARKER}, target)
+		if err != nil || !reflect.ValueOf(target).Elem().IsZero() {
+			t.Errorf("null decoded into %T as %v, %v", target, reflect.ValueOf(target).Elem(), err)
+		}
+	}
+
+	//the pointer given to Decode is kept, the value it points to is cleared
+	user := &traitsUser{Name: "bob"}
+	err = Unmarshal([]byte{NULL_MARKER}, user)
+	if err != nil || *user != (traitsUser{}) {
+		t.Errorf("null decoded into pointer as %+v, %v", user, err)
+	}
+}
+
+func TestDecodeUnknownMembers(t *testing.T) {
+	inputs := map[string][]byte{
+		//C{name, age, city} with the age member unknown to traitsUser
+		"sealed": {OBJECT_MARKER, 0x33, 0x03, 'C', 0x09, 'n', 'a', 'm', 'e', 0x07, 'a', 'g', 'e', 0x09, 'c', 'i', 't', 'y',
+			STRING_MARKER, 0x07, 'b', 'o', 'b', INTEGER_MARKER, 0x05, STRING_MARKER, 0x03, 'x'},
+		//the city refers to a string of the skipped extra member
+		"dynamic": {OBJECT_MARKER, 0x0b, 0x01, 0x09, 'n', 'a', 'm', 'e', STRING_MARKER, 0x07, 'b', 'o', 'b',
+			0x0b, 'e', 'x', 't', 'r', 'a', OBJECT_MARKER, 0x0b, 0x01, 0x03, 'a', STRING_MARKER, 0x03, 'x', 0x01,
+			0x09, 'c', 'i', 't', 'y', STRING_MARKER, 0x08, 0x01},
+	}
+
+	want := traitsUser{Name: "bob", City: "x"}
+	for name, input := range inputs {
+		var user traitsUser
+		err := Unmarshal(input, &user)
+		if err != nil || user != want {
+			t.Errorf("%s: decoded %+v, %v", name, user, err)
+		}
+
+		var generated traitsUnmarshaler
+		err = Unmarshal(input, &generated)
+		if err != nil || generated.traitsUser != want {
+			t.Errorf("%s: decoded through DecodeKey %+v, %v", name, generated, err)
+		}
+
+		err = Unmarshal(input, &user, StrictMembers(true))
+		if err == nil || !strings.Contains(err.Error(), "not found in struct:amf.traitsUser") {
+			t.Errorf("%s: decoded strictly with %v", name, err)
+		}
+		err = Unmarshal(input, &generated, StrictMembers(true))
+		if err == nil || !strings.Contains(err.Error(), "not found in struct:amf.traitsUnmarshaler") {
+			t.Errorf("%s: decoded strictly through DecodeKey with %v", name, err)
+		}
+	}
+
+	//a skipped member is still checked
+	broken := []byte{OBJECT_MARKER, 0x0b, 0x01, 0x0b, 'e', 'x', 't', 'r', 'a', STRING_MARKER, 0x04, 0x01}
+	var user traitsUser
+	err := Unmarshal(broken, &user)
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Path != "extra" {
+		t.Errorf("broken member skipped with %v", err)
+	}
+}
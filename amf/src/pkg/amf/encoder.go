@@ -1,55 +1,104 @@
 package amf
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"reflect"
 	"strconv"
-	"unicode"
+	"time"
 )
 
 type Encoder struct {
-	writer       io.Writer
-	stringCache  map[string]int
-	objectCache  map[uintptr]int
-	reservStruct bool
+	writer        io.Writer
+	buffer        []byte
+	stringCache   map[string]int
+	objectCache   map[objectKey]int
+	valueCache    map[*Value]int
+	traitsCache   map[*Traits]int
+	amf0Cache     map[*Value]int
+	stringCount   int
+	objectCount   int
+	traitsCount   int
+	reservStruct  bool
+	reflectOnly   bool
+	smallMessages bool
+	wrapArrays    bool
+	depth         int
+	rawNesting    int
+	stream        []streamFrame
+	sealed        []bool //objects begun by EncodeObjectStart and EncodeStructStart, true for registered classes
+	scope         Scope
+	stats         TableStats
+	ctx           context.Context
 }
 
+//Reset clears the reference tables and drops a stream begun before
 func (encoder *Encoder) Reset(){
-	encoder.objectCache = make(map[uintptr]int)
-	encoder.stringCache = make(map[string]int)
+	encoder.resetTables()
+	encoder.stream = encoder.stream[:0]
+	encoder.sealed = encoder.sealed[:0]
 }
 
-func (encoder *Encoder) getFieldName(f reflect.StructField) string {
-	chars := []rune(f.Name)
-	if unicode.IsLower(chars[0]) {
-		return ""
+func (encoder *Encoder) resetTables() {
+	encoder.stats.record(encoder.stringCount, encoder.objectCount, encoder.traitsCount)
+	encoder.stats.Resets++
+	if encoder.stringCache == nil {
+		encoder.objectCache = make(map[objectKey]int)
+		encoder.valueCache = make(map[*Value]int)
+		encoder.traitsCache = make(map[*Traits]int)
+		encoder.stringCache = make(map[string]int)
+	} else {
+		clear(encoder.objectCache)
+		clear(encoder.valueCache)
+		clear(encoder.traitsCache)
+		clear(encoder.stringCache)
 	}
+	clear(encoder.amf0Cache)
+	encoder.stringCount = 0
+	encoder.objectCount = 0
+	encoder.traitsCount = 0
+}
 
-	name := f.Tag.Get("amf.name")
-	if name != "" {
-		return name
+//objectKey identifies a map, slice or struct pointer written before, the
+//type and length tell apart a struct from its first field and a slice from
+//its prefixes. Empty slices have no identity of their own.
+type objectKey struct {
+	pointer uintptr
+	t       reflect.Type
+	length  int
+}
+
+//writeObjectReference writes a reference if the map, slice or struct pointer
+//has been written before, otherwise it registers it in the object table
+func (encoder *Encoder) writeObjectReference(value reflect.Value) (bool, error) {
+	key := objectKey{pointer: value.Pointer(), t: value.Type()}
+	if value.Kind() == reflect.Slice {
+		key.length = value.Len()
 	}
 
-	if !encoder.reservStruct {
-		chars[0] = unicode.ToLower(chars[0])
-		return string(chars)
+	index, ok := encoder.objectCache[key]
+	if ok {
+		return true, encoder.writeU29(uint32(index << 1))
 	}
 
-	return f.Name
+	if key.pointer != 0 && (value.Kind() != reflect.Slice || key.length > 0) {
+		encoder.objectCache[key] = encoder.objectCount
+	}
+	encoder.objectCount++
+	return false, nil
 }
 
 func (encoder *Encoder) encodeBool(value bool) error {
 
-	buffer := make([]byte, 1)
 	if value {
-		buffer[0] = TRUE_MARKER
-	} else {
-		buffer[0] = FALSE_MARKER
+		return encoder.writeMarker(TRUE_MARKER)
 	}
 
-	return encoder.writeBytes(buffer)
+	return encoder.writeMarker(FALSE_MARKER)
 }
 
 func (encoder *Encoder) encodeNull() error {
@@ -59,7 +108,8 @@ func (encoder *Encoder) encodeNull() error {
 
 func (encoder *Encoder) encodeUint(value uint64) error {
 
-	if value >= 0x20000000 {
+	//integers are signed 29 bits, larger ones are sent as doubles
+	if value > 0xfffffff {
 		if value <= 0xffffffff {
 			return encoder.encodeFloat(float64(value))
 		}
@@ -77,8 +127,8 @@ func (encoder *Encoder) encodeUint(value uint64) error {
 
 func (encoder *Encoder) encodeInt(value int64) error {
 
-	if value < -0xfffffff {
-		if value > -0x7fffffff {
+	if value < -0x10000000 || value > 0xfffffff {
+		if value > -0x7fffffff && value <= 0xffffffff {
 			return encoder.encodeFloat(float64(value))
 		}
 		return encoder.encodeString(strconv.FormatInt(value, 10))
@@ -89,26 +139,17 @@ func (encoder *Encoder) encodeInt(value int64) error {
 		return err
 	}
 
-	return encoder.writeU29(uint32(value))
+	return encoder.writeU29(uint32(value) & 0x1fffffff)
 }
 
 func (encoder *Encoder) encodeFloat(value float64) error {
 
-	buffer := make([]byte, 9)
-
-	buffer[0] = DOUBLE_MARKER
-	intValue := math.Float64bits(float64(value))
-
-	buffer[1] = byte((intValue >> 56) & 0xff)
-	buffer[2] = byte((intValue >> 48) & 0xff)
-	buffer[3] = byte((intValue >> 40) & 0xff)
-	buffer[4] = byte((intValue >> 32) & 0xff)
-	buffer[5] = byte((intValue >> 24) & 0xff)
-	buffer[6] = byte((intValue >> 16) & 0xff)
-	buffer[7] = byte((intValue >> 8) & 0xff)
-	buffer[8] = byte(intValue & 0xff)
+	err := encoder.writeMarker(DOUBLE_MARKER)
+	if err != nil {
+		return err
+	}
 
-	return encoder.writeBytes(buffer)
+	return encoder.writeDouble(value)
 }
 
 func (encoder *Encoder) encodeString(value string) error {
@@ -128,26 +169,18 @@ func (encoder *Encoder) encodeMap(value reflect.Value) error {
 		return err
 	}
 
-	index, ok := encoder.objectCache[value.Pointer()]
-	if ok {
-		index <<= 1
-		encoder.writeU29(uint32(index << 1))
-		return nil
-	}
-
-	err = encoder.writeMarker(0x0b)
-	if err != nil {
+	ok, err := encoder.writeObjectReference(value)
+	if ok || err != nil {
 		return err
 	}
-
-	err = encoder.writeString("")
+	err = encoder.writeAnonymousTraits()
 	if err != nil {
 		return err
 	}
 
-	keys := value.MapKeys()
-	for i := 0; i < len(keys); i++ {
-		key := keys[i]
+	iter := value.MapRange()
+	for iter.Next() {
+		key := iter.Key()
 		if key.Kind() != reflect.String {
 			return errors.New("only string key allowed in map")
 		}
@@ -157,14 +190,14 @@ func (encoder *Encoder) encodeMap(value reflect.Value) error {
 			return err
 		}
 
-		v := value.MapIndex(key)
+		v := iter.Value()
 		if v.Kind() == reflect.Struct {
 			v = v.Addr()
 		}
 
 		err = encoder.encode(v)
 		if err != nil {
-			return err
+			return prependPath(err, keyElem(key.String()))
 		}
 	}
 
@@ -178,32 +211,29 @@ func (encoder *Encoder) encodeStruct(value reflect.Value) error {
 		return err
 	}
 
-	index, ok := encoder.objectCache[value.Pointer()]
-	if ok {
-		index <<= 1
-		encoder.writeU29(uint32(index << 1))
-		return nil
-	}
-
-	err = encoder.writeMarker(0x0b)
-	if err != nil {
+	ok, err := encoder.writeObjectReference(value)
+	if ok || err != nil {
 		return err
 	}
+	v := reflect.Indirect(value)
+	t := v.Type()
+	if info, ok := classByType(t); ok {
+		return encoder.encodeClass(encoder.classTraits(info), value)
+	}
 
-	err = encoder.writeString("")
+	err = encoder.writeAnonymousTraits()
 	if err != nil {
 		return err
 	}
 
-	v := reflect.Indirect(value)
-	t := v.Type()
 	switch t.Kind() {
 	case reflect.Struct:
-		for i := 0; i < t.NumField(); i++ {
-			f := t.Field(i)
-			key := encoder.getFieldName(f)
-			if key == "" {
-				continue
+		plan := getStructPlan(t)
+		for i := range plan.fields {
+			f := &plan.fields[i]
+			key := f.name
+			if encoder.reservStruct {
+				key = f.reservName
 			}
 
 			err = encoder.writeString(key)
@@ -211,14 +241,14 @@ func (encoder *Encoder) encodeStruct(value reflect.Value) error {
 				return err
 			}
 
-			fv := v.FieldByName(f.Name)
-			if fv.Kind() == reflect.Struct {
+			fv := v.FieldByIndex(f.index)
+			if f.isStruct {
 				fv = fv.Addr()
 			}
 
 			err = encoder.encode(fv)
 			if err != nil {
-				return err
+				return prependPath(err, "."+t.FieldByIndex(f.index).Name)
 			}
 		}
 	default:
@@ -228,6 +258,54 @@ func (encoder *Encoder) encodeStruct(value reflect.Value) error {
 	return encoder.writeString("")
 }
 
+//encodeClass writes the traits and members of a registered class
+func (encoder *Encoder) encodeClass(info *classInfo, value reflect.Value) error {
+	traits := info.traits[0]
+	if encoder.reservStruct {
+		traits = info.traits[1]
+	}
+
+	err := encoder.writeTraits(traits)
+	if err != nil {
+		return err
+	}
+
+	if info.external {
+		return value.Interface().(Externalizable).WriteExternal(encoder)
+	}
+
+	v := reflect.Indirect(value)
+	plan := getStructPlan(v.Type())
+	for i := range plan.fields {
+		f := &plan.fields[i]
+		fv := v.FieldByIndex(f.index)
+		if f.isStruct {
+			fv = fv.Addr()
+		}
+
+		err = encoder.encode(fv)
+		if err != nil {
+			return prependPath(err, "."+v.Type().FieldByIndex(f.index).Name)
+		}
+	}
+	return nil
+}
+
+//encodeTime writes a date, dates are never written as references
+func (encoder *Encoder) encodeTime(value time.Time) error {
+	err := encoder.writeMarker(DATE_MARKER)
+	if err != nil {
+		return err
+	}
+
+	encoder.objectCount++
+	err = encoder.writeU29(0x01)
+	if err != nil {
+		return err
+	}
+	return encoder.writeDouble(float64(value.UnixMilli()))
+}
+
 func (encoder *Encoder) encodeSlice(value reflect.Value) error {
 
 	err := encoder.writeMarker(ARRAY_MARKER)
@@ -235,13 +313,10 @@ func (encoder *Encoder) encodeSlice(value reflect.Value) error {
 		return err
 	}
 
-	index, ok := encoder.objectCache[value.Pointer()]
-	if ok {
-		index <<= 1
-		encoder.writeU29(uint32(index << 1))
-		return nil
+	ok, err := encoder.writeObjectReference(value)
+	if ok || err != nil {
+		return err
 	}
-
 	err = encoder.writeU29((uint32(value.Len()) << 1) | 0x01)
 	if err != nil {
 		return err
@@ -262,7 +337,7 @@ func (encoder *Encoder) encodeSlice(value reflect.Value) error {
 		}
 		err = encoder.encode(v)
 		if err != nil {
-			return err
+			return prependPath(err, indexElem(i))
 		}
 	}
 
@@ -271,6 +346,23 @@ func (encoder *Encoder) encodeSlice(value reflect.Value) error {
 
 func (encoder *Encoder) encode(v reflect.Value) error {
 
+	if encoder.ctx != nil {
+		err := encoder.ctx.Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := encoder.encodeKind(v)
+	if err != nil {
+		return encodeError(err, v.Type())
+	}
+
+	return nil
+}
+
+func (encoder *Encoder) encodeKind(v reflect.Value) error {
+
 	switch v.Kind() {
 	case reflect.Map:
 		return encoder.encodeMap(v)
@@ -282,18 +374,49 @@ func (encoder *Encoder) encode(v reflect.Value) error {
 		return encoder.encodeString(v.String())
 	case reflect.Array:
 		v = v.Slice(0, v.Len())
+		if encoder.wrapArrays {
+			return encoder.encodeArrayCollection(v)
+		}
 		return encoder.encodeSlice(v)
 	case reflect.Slice:
+		if encoder.wrapArrays {
+			return encoder.encodeArrayCollection(v)
+		}
 		return encoder.encodeSlice(v)
 	case reflect.Float64, reflect.Float32:
 		return encoder.encodeFloat(v.Float())
+	case reflect.Bool:
+		return encoder.encodeBool(v.Bool())
 	case reflect.Interface:
-		v = reflect.ValueOf(v.Interface())
-		return encoder.encode(v)
+		return encoder.encode(v.Elem())
+	case reflect.Invalid:
+		return encoder.encodeNull()
+	case reflect.Struct:
+		if v.Type() == rawValueType {
+			raw := v.Interface().(RawValue)
+			return encoder.writeRaw(&raw)
+		}
+		if v.Type() == timeType {
+			return encoder.encodeTime(v.Interface().(time.Time))
+		}
 	case reflect.Ptr:
 		if v.IsNil() {
 			return encoder.encodeNull()
 		}
+		if v.Type() == valueType {
+			return encoder.writeValue(v.Interface().(*Value))
+		}
+		if v.Type().Elem() == rawValueType {
+			return encoder.writeRaw(v.Interface().(*RawValue))
+		}
+		if v.Type().Elem() == timeType {
+			return encoder.encodeTime(v.Elem().Interface().(time.Time))
+		}
+		if !encoder.reflectOnly && v.CanInterface() {
+			if m, ok := v.Interface().(Marshaler); ok {
+				return m.MarshalAMF(encoder)
+			}
+		}
 		vv := reflect.Indirect(v)
 		if vv.Kind() == reflect.Struct {
 			return encoder.encodeStruct(v)
@@ -304,10 +427,55 @@ func (encoder *Encoder) encode(v reflect.Value) error {
 	return errors.New("unsupported type:" + v.Type().String())
 }
 
+//Encode encodes a value and writes it to the writer with a single Write
 func (encoder *Encoder) Encode(value AMFAny) error {
 
-	v := reflect.ValueOf(value)
-	return encoder.encode(v)
+	err := encoder.streamValue()
+	if err != nil {
+		return err
+	}
+
+	encoder.startValue()
+	encoder.depth++
+	err = encoder.encode(reflect.ValueOf(value))
+	encoder.depth--
+	if encoder.depth > 0 {
+		return err
+	}
+
+	if err != nil && len(encoder.stream) > 0 {
+		return encoder.streamError(topPath(err))
+	}
+	return encoder.flush(topPath(err))
+}
+
+//flush writes the buffered bytes if the encoding succeeded, otherwise the
+//partial output is dropped
+func (encoder *Encoder) flush(err error) error {
+
+	if err != nil {
+		encoder.buffer = encoder.buffer[:0]
+		return err
+	}
+
+	if encoder.writer == nil || len(encoder.buffer) == 0 {
+		return nil
+	}
+
+	//values of a stream are collected into bigger writes
+	if len(encoder.stream) > 0 && len(encoder.buffer) < streamFlushSize {
+		return nil
+	}
+
+	length, err := encoder.writer.Write(encoder.buffer)
+	if err == nil && length != len(encoder.buffer) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		err = fmt.Errorf("write data failed: %w", err)
+	}
+	encoder.buffer = encoder.buffer[:0]
+	return err
 }
 
 func (encoder *Encoder) writeString(value string) error {
@@ -324,28 +492,51 @@ func (encoder *Encoder) writeString(value string) error {
 	}
 
 	if value != "" {
-		encoder.stringCache[value] = len(encoder.stringCache)
+		encoder.stringCache[value] = encoder.stringCount
+		encoder.stringCount++
 	}
-	return encoder.writeBytes([]byte(value))
+	encoder.buffer = append(encoder.buffer, value...)
+	return nil
 }
 
 func (encoder *Encoder) writeMarker(value byte) error {
 
-	return encoder.writeBytes([]byte{value})
+	encoder.buffer = append(encoder.buffer, value)
+	return nil
 }
 
 func (encoder *Encoder) writeBytes(bytes []byte) error {
 
-	length, err := encoder.writer.Write(bytes)
-	if length != len(bytes) || err != nil {
-		return errors.New("write data failed")
-	}
-	return err
+	encoder.buffer = append(encoder.buffer, bytes...)
+	return nil
+}
+
+func (encoder *Encoder) writeDouble(value float64) error {
+
+	return encoder.writeUint64(math.Float64bits(value))
+}
+
+func (encoder *Encoder) writeUint16(value uint16) error {
+
+	encoder.buffer = binary.BigEndian.AppendUint16(encoder.buffer, value)
+	return nil
+}
+
+func (encoder *Encoder) writeUint32(value uint32) error {
+
+	encoder.buffer = binary.BigEndian.AppendUint32(encoder.buffer, value)
+	return nil
+}
+
+func (encoder *Encoder) writeUint64(value uint64) error {
+
+	encoder.buffer = binary.BigEndian.AppendUint64(encoder.buffer, value)
+	return nil
 }
 
 func (encoder *Encoder) writeU29(value uint32) error {
 
-	buffer := make([]byte, 0, 4)
+	buffer := encoder.buffer
 
 	switch {
 	case value < 0x80:
@@ -360,20 +551,36 @@ func (encoder *Encoder) writeU29(value uint32) error {
 	case value < 0x20000000:
 		buffer = append(buffer, byte((value>>22)|0x80))
 		buffer = append(buffer, byte((value>>15)|0x80))
-		buffer = append(buffer, byte((value>>7)|0x80))
+		buffer = append(buffer, byte((value>>8)|0x80))
 		buffer = append(buffer, byte(value&0xff))
 	default:
 		return errors.New("u29 over flow")
 	}
 
-	return encoder.writeBytes(buffer)
+	encoder.buffer = buffer
+	return nil
+}
+
+//EncoderOption configures an Encoder, see NewEncoder and Marshal
+type EncoderOption func(*Encoder)
+
+//ReservStruct keeps struct field names as they are instead of lowering the
+//first rune
+func ReservStruct(reserv bool) EncoderOption {
+	return func(encoder *Encoder) {
+		encoder.reservStruct = reserv
+	}
 }
 
-func NewEncoder(writer io.Writer, reservStruct bool) *Encoder {
+func NewEncoder(writer io.Writer, reservStruct bool, opts ...EncoderOption) *Encoder {
 
 	encoder := new(Encoder)
 	encoder.writer = writer
 	encoder.reservStruct = reservStruct
+	for _, opt := range opts {
+		opt(encoder)
+	}
 	encoder.Reset()
+	encoder.stats = TableStats{}
 	return encoder
 }
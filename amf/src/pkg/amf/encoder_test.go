@@ -0,0 +1,191 @@
+package amf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestWriteU29(t *testing.T) {
+	tests := []struct {
+		value uint32
+		bytes []byte
+	}{
+		{0, []byte{0x00}},
+		{0x7f, []byte{0x7f}},
+		{0x80, []byte{0x81, 0x00}},
+		{0x3fff, []byte{0xff, 0x7f}},
+		{0x4000, []byte{0x81, 0x80, 0x00}},
+		{0x1fffff, []byte{0xff, 0xff, 0x7f}},
+		{0x200000, []byte{0x80, 0xc0, 0x80, 0x00}},
+		{0x200080, []byte{0x80, 0xc0, 0x80, 0x80}},
+		{0x2abcdef, []byte{0x8a, 0xd7, 0xcd, 0xef}},
+		{0xfffffff, []byte{0xbf, 0xff, 0xff, 0xff}},
+		{0x1fffffff, []byte{0xff, 0xff, 0xff, 0xff}},
+	}
+
+	for _, test := range tests {
+		encoder := NewEncoder(nil, false)
+		err := encoder.writeU29(test.value)
+		if err != nil {
+			t.Fatalf("%#x: %v", test.value, err)
+		}
+		if !bytes.Equal(encoder.buffer, test.bytes) {
+			t.Errorf("%#x: encoded % x, want % x", test.value, encoder.buffer, test.bytes)
+		}
+
+		decoder := NewDecoder(bytes.NewReader(test.bytes))
+		value, err := decoder.readU29()
+		if err != nil || value != test.value {
+			t.Errorf("% x: decoded %#x, %v, want %#x", test.bytes, value, err, test.value)
+		}
+	}
+
+	encoder := NewEncoder(nil, false)
+	if err := encoder.writeU29(0x20000000); err == nil {
+		t.Error("0x20000000 encoded")
+	}
+}
+
+func TestIntegerRoundTrip(t *testing.T) {
+	for _, value := range []int32{0, 1, -1, 0x1fffff, 0x200000, 0x200080, 0xfffffff, -0x10000000, 0x10000000, -0x10000001} {
+		data, err := Marshal(value)
+		if err != nil {
+			t.Fatalf("%d: %v", value, err)
+		}
+
+		var decoded int32
+		err = Unmarshal(data, &decoded)
+		if err != nil || decoded != value {
+			t.Errorf("%d: decoded %d, %v from % x", value, decoded, err, data)
+		}
+
+		//integers out of the 29 bits are written as doubles
+		var want AMFAny = value
+		if value < -0x10000000 || value > 0xfffffff {
+			want = float64(value)
+		}
+		var any AMFAny
+		err = Unmarshal(data, &any)
+		if err != nil || any != want {
+			t.Errorf("%d: decoded into interface %#v, %v from % x", value, any, err, data)
+		}
+	}
+}
+
+type appendItem struct {
+	Id    int
+	Name  string
+	Price float64
+	Tags  []string
+}
+
+func TestAppendAMF(t *testing.T) {
+	item := &appendItem{Id: 7, Name: "apple", Price: 1.5, Tags: []string{"red", "fruit"}}
+
+	var buffer bytes.Buffer
+	err := NewEncoder(&buffer, false).Encode(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := []byte("prefix")
+	dst, err = AppendAMF(dst, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dst[:6]) != "prefix" || !bytes.Equal(dst[6:], buffer.Bytes()) {
+		t.Fatalf("appended % x, want % x", dst[6:], buffer.Bytes())
+	}
+
+	dst = make([]byte, 0, 1024)
+	allocs := testing.AllocsPerRun(100, func() {
+		AppendAMF(dst[:0], item)
+	})
+	if allocs > 1 {
+		t.Errorf("%v allocations per AppendAMF", allocs)
+	}
+}
+
+type referenceOuter struct {
+	Inner referenceInner
+	Items []int
+}
+
+type referenceInner struct {
+	Name string
+}
+
+//TestEncodeReferences checks maps, slices and struct pointers written again
+//are written as references
+func TestEncodeReferences(t *testing.T) {
+	shared := map[string]AMFAny{"a": "b"}
+	list := []int{1, 2, 3}
+	outer := &referenceOuter{Inner: referenceInner{"x"}, Items: list}
+
+	tests := []struct {
+		name  string
+		value AMFAny
+		refs  int
+	}{
+		{"map", []AMFAny{shared, shared}, 1},
+		{"slice", []AMFAny{list, list}, 1},
+		{"prefix of a slice", []AMFAny{list, list[:2]}, 0},
+		{"struct pointer", []AMFAny{outer, outer}, 1},
+		{"first field of a struct", []AMFAny{outer, &outer.Inner}, 1},
+		{"empty slices", []AMFAny{[]AMFAny{}, []AMFAny{}}, 0},
+	}
+
+	for _, test := range tests {
+		data, err := Marshal(test.value)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		document, err := UnmarshalAs[*Value](data)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if refs := countShared(document, map[*Value]bool{}); refs != test.refs {
+			t.Errorf("%s: %d references in %v", test.name, refs, document)
+		}
+
+		var decoded AMFAny
+		err = Unmarshal(data, &decoded)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+
+	data, err := Marshal([]AMFAny{shared, shared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]AMFAny
+	err = Unmarshal(data, &decoded)
+	if err != nil || len(decoded) != 2 || !reflect.DeepEqual(decoded[0], shared) || !reflect.DeepEqual(decoded[1], shared) {
+		t.Errorf("decoded %v, %v", decoded, err)
+	}
+}
+
+//countShared counts the nodes of a document met again
+func countShared(value *Value, seen map[*Value]bool) int {
+	if value == nil {
+		return 0
+	}
+	if seen[value] {
+		return 1
+	}
+	seen[value] = true
+
+	n := 0
+	for _, v := range value.Elements {
+		n += countShared(v, seen)
+	}
+	for _, v := range value.Sealed {
+		n += countShared(v, seen)
+	}
+	for _, m := range value.Members {
+		n += countShared(m.Value, seen)
+	}
+	return n
+}
@@ -0,0 +1,305 @@
+package amf
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	commandMessageClass  = "flex.messaging.messages.CommandMessage"
+	remotingMessageClass = "flex.messaging.messages.RemotingMessage"
+	asyncMessageClass    = "flex.messaging.messages.AsyncMessage"
+)
+
+var (
+	errNoBroker    = &Fault{Code: "Server.Processing", Message: "flex messaging needs a broker"}
+	errUnknownDSId = &Fault{Code: "Server.Processing.UnknownDSId", Message: "DSId not issued by the gateway"}
+)
+
+//flexRequest is a flex message received by a gateway, read from its document
+type flexRequest struct {
+	class       string
+	messageId   string
+	clientId    string
+	destination string
+	operation   *Value
+	source      string
+	headers     *Value
+	body        *Value
+	dsId        string
+}
+
+//flexMessageOf returns the flex message carried by the data of a remoting
+//message, a channel sends it as the only element of an array
+func flexMessageOf(data *Value) (*Value, bool) {
+	if data != nil && data.Kind == KindArray && len(data.Elements) == 1 && len(data.Members) == 0 {
+		data = data.Elements[0]
+	}
+	if data == nil || data.Kind != KindObject {
+		return nil, false
+	}
+
+	//small messages are read into their go types, they are turned back into
+	//documents of the full form
+	if data.External != nil {
+		switch data.External.(type) {
+		case *CommandMessage, *AsyncMessage:
+		default:
+			return nil, false
+		}
+
+		b, err := Marshal(data.External)
+		if err != nil {
+			return nil, false
+		}
+		data, err = UnmarshalAs[*Value](b)
+		if err != nil {
+			return nil, false
+		}
+	}
+
+	switch data.Class() {
+	case commandMessageClass, remotingMessageClass, asyncMessageClass:
+		return data, true
+	}
+	return nil, false
+}
+
+//newKey makes a random key signing the DSIds of a gateway
+func newKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+//newDSId makes a DSId the gateway tells it issued without keeping it: a
+//uuid, the time it was issued in milliseconds and their HMAC
+func (gateway *Gateway) newDSId() string {
+	id := newUUID() + "-" + strconv.FormatInt(time.Now().UnixMilli(), 16)
+	return id + "-" + gateway.signDSId(id)
+}
+
+func (gateway *Gateway) signDSId(id string) string {
+	mac := hmac.New(sha256.New, gateway.dsIdKey)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+//issuedDSId tells whether the gateway issued dsId less than the session
+//timeout ago
+func (gateway *Gateway) issuedDSId(dsId string) bool {
+	i := strings.LastIndexByte(dsId, '-')
+	if i < 0 || !hmac.Equal([]byte(dsId[i+1:]), []byte(gateway.signDSId(dsId[:i]))) {
+		return false
+	}
+	j := strings.LastIndexByte(dsId[:i], '-')
+	issued, err := strconv.ParseInt(dsId[j+1:i], 16, 64)
+	return err == nil && time.Since(time.UnixMilli(issued)) < gateway.clients.getTimeout()
+}
+
+func readFlexRequest(data *Value) *flexRequest {
+	in := &flexRequest{
+		class:       data.Class(),
+		messageId:   memberString(data, "messageId"),
+		clientId:    memberString(data, "clientId"),
+		destination: memberString(data, "destination"),
+		source:      memberString(data, "source"),
+	}
+	in.operation, _ = data.Member("operation")
+	in.headers, _ = data.Member("headers")
+	in.body, _ = data.Member("body")
+
+	in.dsId = memberString(in.headers, DSIdHeader)
+	return in
+}
+
+//command returns the operation of a CommandMessage
+func (in *flexRequest) command() int {
+	if in.operation == nil {
+		return UNKNOWN_OPERATION
+	}
+	switch in.operation.Kind {
+	case KindInteger:
+		return int(in.operation.Int)
+	case KindDouble:
+		return int(in.operation.Float)
+	}
+	return UNKNOWN_OPERATION
+}
+
+//ack makes the AcknowledgeMessage answering the request
+func (in *flexRequest) ack(body AMFAny) *AcknowledgeMessage {
+	return &AcknowledgeMessage{
+		Body:          body,
+		ClientId:      in.clientId,
+		CorrelationId: in.messageId,
+		Destination:   in.destination,
+		Headers:       map[string]AMFAny{DSIdHeader: in.dsId},
+		MessageId:     newUUID(),
+		Timestamp:     float64(time.Now().UnixMilli()),
+	}
+}
+
+//fail makes the ErrorMessage answering the request with fault
+func (in *flexRequest) fail(fault *Fault) *ErrorMessage {
+	message := fault.errorMessage()
+	message.ClientId = in.clientId
+	message.CorrelationId = in.messageId
+	message.Destination = in.destination
+	message.Headers = map[string]AMFAny{DSIdHeader: in.dsId}
+	return message
+}
+
+//serveFlex answers a flex message like the AMF endpoints of BlazeDS: pings
+//and logouts are acknowledged with the DSId of the client, RemotingMessages
+//are dispatched to "destination.operation" and acknowledged with the result,
+//messaging goes to the broker of the gateway, errors are answered with an
+//ErrorMessage. A client without DSId, or "nil", is given a new one, a DSId
+//the gateway didn't issue, or disconnected, is rejected. The calls of a client logged in have
+//the principal of the session of its DSId.
+func (gateway *Gateway) serveFlex(call *Call, message *Message, data *Value, authErr error) Message {
+	in := readFlexRequest(data)
+	known := true
+	if in.dsId == "" || in.dsId == "nil" {
+		in.dsId = gateway.newDSId()
+	} else if _, known = gateway.clients.principal(in.dsId); !known && gateway.issuedDSId(in.dsId) {
+		//a DSId is kept once the client comes back with it
+		known = gateway.clients.add(in.dsId, nil)
+	}
+	if principal, ok := gateway.sessions.principal(in.dsId); ok && known {
+		call.Request = call.Request.WithContext(WithPrincipal(call.Request.Context(), principal))
+	}
+
+	var reply AMFAny
+	var err error
+	switch {
+	case !known:
+		err = errUnknownDSId
+	case authErr != nil:
+		err = authErr
+	case in.class == remotingMessageClass:
+		reply, err = gateway.remoting(call, in)
+	case in.class == asyncMessageClass:
+		reply, err = gateway.publish(in, data)
+	default:
+		reply, err = gateway.command(call.Request.Context(), in)
+	}
+
+	if err != nil {
+		return Message{Target: message.Response + "/onStatus", Response: "null", Data: in.fail(gateway.fault(err))}
+	}
+	return Message{Target: message.Response + "/onResult", Response: "null", Data: reply}
+}
+
+func (gateway *Gateway) command(ctx context.Context, in *flexRequest) (AMFAny, error) {
+	broker := gateway.getBroker()
+	switch operation := in.command(); operation {
+	case CLIENT_PING_OPERATION, TRIGGER_CONNECT_OPERATION, CLIENT_SYNC_OPERATION:
+		return in.ack(nil), nil
+	case DISCONNECT_OPERATION:
+		if broker != nil {
+			broker.Disconnect(in.dsId)
+		}
+		gateway.sessions.remove(in.dsId)
+		gateway.clients.close(in.dsId)
+		return in.ack(nil), nil
+	case SUBSCRIBE_OPERATION:
+		if broker == nil {
+			return nil, errNoBroker
+		}
+		err := broker.Subscribe(in.dsId, in.clientId, in.destination, memberString(in.headers, DSSubtopicHeader), memberString(in.headers, DSSelectorHeader))
+		if err != nil {
+			return nil, err
+		}
+		return in.ack(nil), nil
+	case UNSUBSCRIBE_OPERATION:
+		if broker == nil {
+			return nil, errNoBroker
+		}
+		broker.Unsubscribe(in.dsId, in.clientId)
+		return in.ack(nil), nil
+	case POLL_OPERATION:
+		if broker == nil {
+			return nil, errNoBroker
+		}
+		messages, err := broker.Poll(ctx, in.dsId)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) == 0 {
+			return in.ack(nil), nil
+		}
+
+		//flex takes the messages of a poll from a CommandMessage only
+		ack := in.ack(messages)
+		return &CommandMessage{
+			Body:          ack.Body,
+			ClientId:      ack.ClientId,
+			CorrelationId: ack.CorrelationId,
+			Destination:   ack.Destination,
+			Headers:       ack.Headers,
+			MessageId:     ack.MessageId,
+			Operation:     POLL_OPERATION,
+			Timestamp:     ack.Timestamp,
+		}, nil
+	case LOGIN_OPERATION:
+		return gateway.login(ctx, in)
+	case LOGOUT_OPERATION:
+		gateway.sessions.remove(in.dsId)
+		return in.ack("success"), nil
+	default:
+		return nil, &Fault{Code: "Server.Processing", Message: "command operation:" + strconv.Itoa(operation) + " not supported"}
+	}
+}
+
+//remoting calls the handler of a RemotingMessage
+func (gateway *Gateway) remoting(call *Call, in *flexRequest) (AMFAny, error) {
+	call.Service = in.destination
+	if in.operation != nil && in.operation.Kind == KindString {
+		call.Method = in.operation.Str
+	}
+	call.Target = call.Service + "." + call.Method
+	call.Args = callArgs(in.body)
+	call.Message = &RemotingMessage{
+		ClientId:    in.clientId,
+		Destination: in.destination,
+		MessageId:   in.messageId,
+		Operation:   call.Method,
+		Source:      in.source,
+	}
+	if in.headers != nil {
+		in.headers.Decode(&call.Message.Headers, gateway.opts...)
+	}
+
+	result, err := gateway.call(call.Request.Context(), call)
+	if err != nil {
+		return nil, err
+	}
+	return in.ack(result), nil
+}
+
+//publish hands a message published by a producer to the broker
+func (gateway *Gateway) publish(in *flexRequest, data *Value) (AMFAny, error) {
+	broker := gateway.getBroker()
+	if broker == nil {
+		return nil, errNoBroker
+	}
+
+	var message AsyncMessage
+	err := data.Decode(&message, gateway.opts...)
+	if err != nil {
+		return nil, &callError{"Client.InvalidMessage", err}
+	}
+
+	err = broker.Publish(&message)
+	if err != nil {
+		return nil, err
+	}
+	return in.ack(nil), nil
+}
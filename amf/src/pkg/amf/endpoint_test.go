@@ -0,0 +1,183 @@
+package amf
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+//postFlex sends message the way the AMF channels of flex do and returns the
+//message answering it, target is "onResult" or "onStatus", "" for either
+func postFlex(t *testing.T, gateway *Gateway, message AMFAny, target string, opts ...EncoderOption) *Value {
+	t.Helper()
+	var buffer bytes.Buffer
+	packet := &Packet{Version: 3, Messages: []Message{{Target: "null", Response: "/1", Data: []AMFAny{message}}}}
+	err := WritePacket(&buffer, packet, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	gateway.ServeHTTP(recorder, httptest.NewRequest("POST", "/messagebroker/amf", &buffer))
+	response, err := ReadPacket(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "" && response.Messages[0].Target != "/1/"+target {
+		t.Fatalf("answered %s %v", response.Messages[0].Target, response.Messages[0].Data)
+	}
+	return response.Messages[0].Data.(*Value)
+}
+
+//ping connects a flex client and returns the DSId the gateway gave it
+func ping(t *testing.T, gateway *Gateway) string {
+	t.Helper()
+	reply := postFlex(t, gateway, &CommandMessage{Operation: CLIENT_PING_OPERATION, MessageId: "P", Headers: map[string]AMFAny{DSIdHeader: "nil", DSMessagingVersionHeader: 1}}, "onResult")
+	var ack AcknowledgeMessage
+	err := reply.Decode(&ack)
+	if err != nil || ack.CorrelationId != "P" {
+		t.Fatalf("ping answered %+v, %v", ack, err)
+	}
+	dsId, _ := ack.Headers[DSIdHeader].(string)
+	if dsId == "" || dsId == "nil" {
+		t.Fatalf("ping answered DSId %q", dsId)
+	}
+	return dsId
+}
+
+func flexGateway() *Gateway {
+	gateway := mathGateway()
+	gateway.Handle("calc.add", func(ctx context.Context, call *Call) (AMFAny, error) {
+		var a, b float64
+		call.Decode(0, &a)
+		call.Decode(1, &b)
+		if call.Message == nil || call.Message.MessageId == "" || call.Message.Headers["extra"] != "x" {
+			return nil, &Fault{Code: "Test.NoMessage"}
+		}
+		return a + b, nil
+	})
+	return gateway
+}
+
+func TestFlexPing(t *testing.T) {
+	gateway := flexGateway()
+	first := ping(t, gateway)
+	if second := ping(t, gateway); second == first {
+		t.Errorf("two clients given the DSId %s", first)
+	}
+
+	reply := postFlex(t, gateway, &CommandMessage{Operation: CLIENT_PING_OPERATION, MessageId: "P", Headers: map[string]AMFAny{DSIdHeader: "nil"}}, "onResult", SmallMessages(true))
+	if reply.Class() != "flex.messaging.messages.AcknowledgeMessage" {
+		t.Errorf("small ping answered %v", reply)
+	}
+
+	for _, operation := range []int{TRIGGER_CONNECT_OPERATION, CLIENT_SYNC_OPERATION, DISCONNECT_OPERATION} {
+		var ack AcknowledgeMessage
+		reply := postFlex(t, gateway, &CommandMessage{Operation: operation, MessageId: "C", Headers: map[string]AMFAny{DSIdHeader: first}}, "onResult")
+		err := reply.Decode(&ack)
+		if err != nil || ack.CorrelationId != "C" || ack.Headers[DSIdHeader] != first {
+			t.Errorf("operation %d answered %+v, %v", operation, ack, err)
+		}
+	}
+}
+
+func TestFlexRemoting(t *testing.T) {
+	gateway := flexGateway()
+	dsId := ping(t, gateway)
+	headers := map[string]AMFAny{DSIdHeader: dsId, "extra": "x"}
+
+	for _, small := range []bool{false, true} {
+		reply := postFlex(t, gateway, &RemotingMessage{Destination: "calc", Operation: "add", MessageId: "M", ClientId: "C", Body: []AMFAny{1, 2.5}, Headers: headers}, "onResult", SmallMessages(small))
+		var ack AcknowledgeMessage
+		err := reply.Decode(&ack)
+		if err != nil || ack.Body != 3.5 || ack.CorrelationId != "M" || ack.ClientId != "C" || ack.Destination != "calc" || ack.Headers[DSIdHeader] != dsId || ack.MessageId == "" {
+			t.Errorf("small %v: answered %+v, %v", small, ack, err)
+		}
+	}
+
+	tests := []struct {
+		destination string
+		operation   string
+		code        string
+	}{
+		{"calc", "nothing", "Client.UnknownTarget"},
+		{"Math", "fault", "App.Fault"},
+		{"Math", "coded", "App.Coded"},
+		{"Math", "panic", "Server.Processing"},
+	}
+	for _, test := range tests {
+		reply := postFlex(t, gateway, &RemotingMessage{Destination: test.destination, Operation: test.operation, MessageId: "M", Headers: headers}, "onStatus")
+		var message ErrorMessage
+		err := reply.Decode(&message)
+		if err != nil || message.FaultCode != test.code || message.CorrelationId != "M" || message.Headers[DSIdHeader] != dsId {
+			t.Errorf("%s.%s answered %+v, %v", test.destination, test.operation, message, err)
+		}
+	}
+
+	reply := postFlex(t, gateway, &RemotingMessage{Destination: "Math", Operation: "fault", MessageId: "M", Headers: headers}, "onStatus")
+	var message ErrorMessage
+	err := reply.Decode(&message)
+	if err != nil || message.FaultString != "fault" || message.FaultDetail != "detail" {
+		t.Errorf("fault answered %+v, %v", message, err)
+	}
+}
+
+func TestFlexCommands(t *testing.T) {
+	gateway := flexGateway()
+	dsId := ping(t, gateway)
+
+	for _, operation := range []int{SUBSCRIBE_OPERATION, UNSUBSCRIBE_OPERATION, POLL_OPERATION, CLUSTER_REQUEST_OPERATION} {
+		reply := postFlex(t, gateway, &CommandMessage{Operation: operation, MessageId: "C", Destination: "chat", Headers: map[string]AMFAny{DSIdHeader: dsId}}, "onStatus")
+		var message ErrorMessage
+		err := reply.Decode(&message)
+		if err != nil || message.FaultCode != "Server.Processing" || message.CorrelationId != "C" {
+			t.Errorf("operation %d answered %+v, %v", operation, message, err)
+		}
+	}
+
+	reply := postFlex(t, gateway, &AsyncMessage{MessageId: "A", Destination: "chat", Body: "hi", Headers: map[string]AMFAny{DSIdHeader: dsId}}, "onStatus")
+	if reply.Class() != "flex.messaging.messages.ErrorMessage" {
+		t.Errorf("publishing without a broker answered %v", reply)
+	}
+}
+
+//TestFlexMessageOf checks which data of a remoting message is taken for a
+//flex message
+func TestFlexMessageOf(t *testing.T) {
+	command, _ := UnmarshalAs[*Value](mustMarshal(t, &CommandMessage{Operation: CLIENT_PING_OPERATION}))
+	small, _ := UnmarshalAs[*Value](mustMarshal(t, &CommandMessage{Operation: CLIENT_PING_OPERATION}, SmallMessages(true)))
+	ack, _ := UnmarshalAs[*Value](mustMarshal(t, &AcknowledgeMessage{}, SmallMessages(true)))
+	typed := NewObject("com.Other")
+
+	tests := []struct {
+		name string
+		data *Value
+		ok   bool
+	}{
+		{"command", command, true},
+		{"command in array", NewArray(command), true},
+		{"small command", NewArray(small), true},
+		{"two commands", NewArray(command, command), false},
+		{"small acknowledge", NewArray(ack), false},
+		{"other class", NewArray(typed), false},
+		{"nil", nil, false},
+		{"string", NewString("x"), false},
+	}
+
+	for _, test := range tests {
+		message, ok := flexMessageOf(test.data)
+		if ok != test.ok || ok && message.Class() != commandMessageClass {
+			t.Errorf("%s: %v, %v", test.name, message, ok)
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, value AMFAny, opts ...EncoderOption) []byte {
+	t.Helper()
+	data, err := Marshal(value, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,122 @@
+package amf
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//DecodeError is returned by the decoder for input that can't be decoded,
+//use errors.As to get it and errors.Is to check the cause, e.g.
+//io.ErrUnexpectedEOF or ErrStringTooLong
+type DecodeError struct {
+	Offset int64        //offset in the input of the marker of the value
+	Marker byte         //marker of the value, 0 if it couldn't be read
+	Type   reflect.Type //go type decoded into, nil for documents
+	Path   string       //path from the top level value, e.g. Map["hello"].Uid
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	msg := e.Err.Error() + " at offset:" + strconv.FormatInt(e.Offset, 10) + " marker:" + strconv.Itoa(int(e.Marker))
+	if e.Type != nil {
+		msg += " type:" + e.Type.String()
+	}
+	if e.Path != "" {
+		msg += " path:" + e.Path
+	}
+	return msg
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+//EncodeError is returned by the encoder for values that can't be encoded
+type EncodeError struct {
+	Type reflect.Type //go type of the value
+	Path string       //path from the top level value, e.g. Map["hello"].Uid
+	Err  error
+}
+
+func (e *EncodeError) Error() string {
+	msg := e.Err.Error() + " type:" + e.Type.String()
+	if e.Path != "" {
+		msg += " path:" + e.Path
+	}
+	return msg
+}
+
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
+
+//FieldPath adds the struct field name to the path of a DecodeError or
+//EncodeError, for Marshaler and Unmarshaler implementations
+func FieldPath(err error, name string) error {
+	return prependPath(err, "."+name)
+}
+
+func decodeError(err error, offset int64, marker byte, t reflect.Type) error {
+	if _, ok := err.(*DecodeError); ok {
+		return err
+	}
+	return &DecodeError{Offset: offset, Marker: marker, Type: t, Err: err}
+}
+
+func encodeError(err error, t reflect.Type) error {
+	if _, ok := err.(*EncodeError); ok {
+		return err
+	}
+	return &EncodeError{Type: t, Err: err}
+}
+
+func prependPath(err error, elem string) error {
+	switch e := err.(type) {
+	case *DecodeError:
+		e.Path = elem + e.Path
+	case *EncodeError:
+		e.Path = elem + e.Path
+	}
+	return err
+}
+
+//topPath removes the dot before a field name at the start of the path
+func topPath(err error) error {
+	switch e := err.(type) {
+	case *DecodeError:
+		e.Path = strings.TrimPrefix(e.Path, ".")
+	case *EncodeError:
+		e.Path = strings.TrimPrefix(e.Path, ".")
+	}
+	return err
+}
+
+func keyElem(key string) string {
+	return "[" + strconv.Quote(key) + "]"
+}
+
+func indexElem(i int) string {
+	return "[" + strconv.Itoa(i) + "]"
+}
+
+//memberElem is the path element of a member of a document, in the syntax of
+//ParsePath
+func memberElem(name string) string {
+	if isPathName(name) {
+		return "." + name
+	}
+	return keyElem(name)
+}
+
+//entryElem is the path element of a dictionary entry, its key if the path
+//syntax can select it, otherwise its index
+func entryElem(key *Value, i int) string {
+	switch {
+	case key.Kind == KindString:
+		return memberElem(key.Str)
+	case key.Kind == KindInteger && key.Int >= 0:
+		return indexElem(int(key.Int))
+	}
+	return indexElem(i)
+}
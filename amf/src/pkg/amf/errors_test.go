@@ -0,0 +1,88 @@
+package amf
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type errorInner struct {
+	Uid int
+}
+
+type errorOuter struct {
+	Map  map[string]errorInner
+	List []errorInner
+	Ptr  *errorInner
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		value  AMFAny
+		offset int64
+		marker byte
+		typ    reflect.Type
+		path   string
+	}{
+		{map[string]AMFAny{"map": map[string]AMFAny{"hello": map[string]AMFAny{"uid": "x"}}}, 23, STRING_MARKER, reflect.TypeOf(0), `Map["hello"].Uid`},
+		{map[string]AMFAny{"list": []AMFAny{map[string]AMFAny{}, map[string]AMFAny{"uid": true}}}, 22, TRUE_MARKER, reflect.TypeOf(0), "List[1].Uid"},
+		{map[string]AMFAny{"ptr": map[string]AMFAny{"uid": "s"}}, 14, STRING_MARKER, reflect.TypeOf(0), "Ptr.Uid"},
+		{"str", 0, STRING_MARKER, reflect.TypeOf(&errorOuter{}), ""},
+	}
+
+	for _, test := range tests {
+		data, err := Marshal(test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var outer errorOuter
+		err = Unmarshal(data, &outer)
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Fatalf("%v: %v", test.value, err)
+		}
+		if decodeErr.Offset != test.offset || decodeErr.Marker != test.marker || decodeErr.Type != test.typ || decodeErr.Path != test.path {
+			t.Errorf("error %+v, want offset:%d marker:%d type:%v path:%s", decodeErr, test.offset, test.marker, test.typ, test.path)
+		}
+		if !strings.Contains(err.Error(), test.path) {
+			t.Errorf("message %q without path", err)
+		}
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		value AMFAny
+		path  string
+	}{
+		{map[string]AMFAny{"a": []AMFAny{1, make(chan int)}}, `["a"][1]`},
+		{&struct{ A struct{ B []chan int } }{A: struct{ B []chan int }{B: []chan int{nil}}}, "A.B[0]"},
+		{make(chan int), ""},
+	}
+
+	for _, test := range tests {
+		_, err := Marshal(test.value)
+		var encodeErr *EncodeError
+		if !errors.As(err, &encodeErr) {
+			t.Fatalf("%T: %v", test.value, err)
+		}
+		if encodeErr.Path != test.path || encodeErr.Type != reflect.TypeOf(make(chan int)) {
+			t.Errorf("%T: error %+v, want path:%s", test.value, encodeErr, test.path)
+		}
+	}
+}
+
+func TestFieldPath(t *testing.T) {
+	err := FieldPath(FieldPath(&DecodeError{Err: errors.New("bad"), Path: "[0]"}, "Inner"), "Outer")
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Path != ".Outer.Inner[0]" || topPath(err).(*DecodeError).Path != "Outer.Inner[0]" {
+		t.Errorf("path %v", err)
+	}
+
+	plain := errors.New("plain")
+	if FieldPath(plain, "X") != plain {
+		t.Error("plain error changed")
+	}
+}
@@ -0,0 +1,103 @@
+package amf
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+//Fault is the error of a call, sent as the onStatus object of AMF0 remoting
+//or as a flex ErrorMessage. A handler returns a *Fault, or an error
+//implementing FaultCoder, for clients to catch it by its code.
+type Fault struct {
+	Code         string            //faultCode, code of a status object
+	Message      string            //faultString, description of a status object
+	Detail       string            //faultDetail, details of a status object
+	RootCause    AMFAny            //rootCause
+	ExtendedData map[string]AMFAny //extendedData
+	Level        string            //level of a status object, "error" if empty
+	Data         *Value            //the whole status object of a fault received by a Client
+}
+
+func (fault *Fault) Error() string {
+	if fault.Code == "" {
+		return fault.Message
+	}
+	return fault.Code + ": " + fault.Message
+}
+
+func (fault *Fault) FaultCode() string {
+	return fault.Code
+}
+
+//FaultCoder is implemented by the errors of a domain to give the faultCode
+//they are sent with
+type FaultCoder interface {
+	FaultCode() string
+}
+
+//ErrorMapper makes the fault sent to the client for the error of a call,
+//see Gateway.SetErrorMapper
+type ErrorMapper func(err error) *Fault
+
+//FaultOf is the default ErrorMapper. A *Fault in the chain of err is sent as
+//it is, an error with a FaultCoder in its chain with its code and text, and
+//ErrUnauthorized as "Client.Authentication". The mistakes of clients, an
+//unknown target or arguments that don't decode, are FaultCoders with a
+//"Client." code. Other errors, e.g. panics, are logged and sent as a
+//"Server.Processing" fault without their text.
+func FaultOf(err error) *Fault {
+	var fault *Fault
+	if errors.As(err, &fault) {
+		return fault
+	}
+
+	var coder FaultCoder
+	if errors.As(err, &coder) {
+		return &Fault{Code: coder.FaultCode(), Message: err.Error()}
+	}
+	if errors.Is(err, ErrUnauthorized) {
+		return &Fault{Code: "Client.Authentication", Message: ErrUnauthorized.Error()}
+	}
+
+	log.Print("amf: ", err)
+	return &Fault{Code: "Server.Processing", Message: "internal error"}
+}
+
+//faultStatus is the onStatus object of a fault
+type faultStatus struct {
+	Level        string
+	Code         string
+	Description  string
+	Details      string
+	RootCause    AMFAny
+	ExtendedData map[string]AMFAny
+}
+
+func (fault *Fault) status() *faultStatus {
+	status := &faultStatus{
+		Level:        fault.Level,
+		Code:         fault.Code,
+		Description:  fault.Message,
+		Details:      fault.Detail,
+		RootCause:    fault.RootCause,
+		ExtendedData: fault.ExtendedData,
+	}
+	if status.Level == "" {
+		status.Level = "error"
+	}
+	return status
+}
+
+//errorMessage makes the ErrorMessage of the fault
+func (fault *Fault) errorMessage() *ErrorMessage {
+	return &ErrorMessage{
+		ExtendedData: fault.ExtendedData,
+		FaultCode:    fault.Code,
+		FaultDetail:  fault.Detail,
+		FaultString:  fault.Message,
+		MessageId:    newUUID(),
+		RootCause:    fault.RootCause,
+		Timestamp:    float64(time.Now().UnixMilli()),
+	}
+}
@@ -0,0 +1,118 @@
+package amf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestFaultOf(t *testing.T) {
+	fault := &Fault{Code: "App.Fault", Message: "fault"}
+	tests := []struct {
+		name    string
+		err     error
+		code    string
+		message string
+		logged  bool
+	}{
+		{"fault", fault, "App.Fault", "fault", false},
+		{"wrapped fault", fmt.Errorf("call: %w", fault), "App.Fault", "fault", false},
+		{"coder", codedError{}, "App.Coded", "coded", false},
+		{"wrapped coder", fmt.Errorf("call: %w", codedError{}), "App.Coded", "call: coded", false},
+		{"client mistake", &callError{"Client.UnknownTarget", errors.New("no handler for target:a.b")}, "Client.UnknownTarget", "no handler for target:a.b", false},
+		{"unauthorized", fmt.Errorf("user bob: %w", ErrUnauthorized), "Client.Authentication", "unauthorized", false},
+		{"error", errors.New("password=secret"), "Server.Processing", "internal error", true},
+		{"panic", fmt.Errorf("panic in Math.panic: %v", "password=secret"), "Server.Processing", "internal error", true},
+	}
+
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+	for _, test := range tests {
+		logged.Reset()
+		got := FaultOf(test.err)
+		if got.Code != test.code || got.Message != test.message {
+			t.Errorf("%s: %+v", test.name, got)
+		}
+		if strings.Contains(logged.String(), test.err.Error()) != test.logged {
+			t.Errorf("%s: logged %q", test.name, logged.String())
+		}
+	}
+	if FaultOf(fault) != fault {
+		t.Error("fault copied")
+	}
+}
+
+//TestFaultHidden checks the text of errors and panics doesn't reach clients
+func TestFaultHidden(t *testing.T) {
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	response, _ := postPacket(t, mathGateway(), &Packet{Messages: []Message{{Target: "Math.fail", Response: "/1"}, {Target: "Math.panic", Response: "/2"}}})
+	for _, message := range response.Messages {
+		data := message.Data.(*Value)
+		if memberString(data, "code") != "Server.Processing" || memberString(data, "description") != "internal error" || strings.Contains(data.String(), "boom") {
+			t.Errorf("%s answered %v", message.Target, data)
+		}
+	}
+	if !strings.Contains(logged.String(), "panic in Math.panic: boom") || !strings.Contains(logged.String(), "amf: boom") {
+		t.Errorf("logged %q", logged.String())
+	}
+
+	gateway := flexGateway()
+	dsId := ping(t, gateway)
+	reply := postFlex(t, gateway, &RemotingMessage{Destination: "Math", Operation: "panic", MessageId: "M", Headers: map[string]AMFAny{DSIdHeader: dsId}}, "onStatus")
+	var message ErrorMessage
+	err := reply.Decode(&message)
+	if err != nil || message.FaultString != "internal error" || message.FaultDetail != "" {
+		t.Errorf("flex panic answered %+v, %v", message, err)
+	}
+}
+
+//TestFaultClientMistakes checks the mistakes of clients are sent with their
+//reason and not logged
+func TestFaultClientMistakes(t *testing.T) {
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	gateway := mathGateway()
+	gateway.Handle("Math.decode", func(ctx context.Context, call *Call) (AMFAny, error) {
+		var n int
+		err := call.Decode(0, &n)
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			return nil, errors.New("no DecodeError in the chain of " + fmt.Sprint(err))
+		}
+		return nil, err
+	})
+	gateway.RegisterService("Users", serviceUsers{})
+
+	tests := []struct {
+		target  string
+		data    AMFAny
+		code    string
+		message string
+	}{
+		{"Math.none", nil, "Client.UnknownTarget", "no handler for target:Math.none"},
+		{"Math.add", []AMFAny{1}, "Client.InvalidArgument", "argument:1 missing for Math.add"},
+		{"Math.decode", []AMFAny{"x"}, "Client.InvalidArgument", "argument 0 of Math.decode: "},
+		{"Users.get", []AMFAny{1, 2}, "Client.InvalidArgument", "Users.Get expects 1 arguments, got 2"},
+		{"Users.get", []AMFAny{"x"}, "Client.InvalidArgument", "argument 0 of Users.Get: "},
+	}
+	for _, test := range tests {
+		response, _ := postPacket(t, gateway, &Packet{Messages: []Message{{Target: test.target, Response: "/1", Data: test.data}}})
+		data := response.Messages[0].Data.(*Value)
+		if memberString(data, "code") != test.code || !strings.HasPrefix(memberString(data, "description"), test.message) {
+			t.Errorf("%s answered %v", test.target, data)
+		}
+	}
+	if logged.Len() != 0 {
+		t.Errorf("logged %q", logged.String())
+	}
+}
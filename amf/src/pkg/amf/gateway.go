@@ -0,0 +1,248 @@
+package amf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Call is a message of a remoting packet dispatched by a Gateway
+type Call struct {
+	Target   string //e.g. "Service.method"
+	Service  string
+	Method   string
+	Args     []*Value //elements of the data of the message, or the data itself if it isn't an array
+	Headers  []Header
+	Request  *http.Request
+	Response http.ResponseWriter
+	Message  *RemotingMessage //the flex message of the call without its body, nil for plain remoting
+
+	opts []DecoderOption //of the gateway
+}
+
+//Decode decodes the argument i into value, with the decoder options of the
+//gateway. Its errors are sent as a "Client.InvalidArgument" fault.
+func (call *Call) Decode(i int, value AMFAny) error {
+	if i >= len(call.Args) {
+		return &callError{"Client.InvalidArgument", errors.New("argument:" + strconv.Itoa(i) + " missing for " + call.Target)}
+	}
+	err := call.Args[i].Decode(value, call.opts...)
+	if err != nil {
+		return &callError{"Client.InvalidArgument", fmt.Errorf("argument %d of %s: %w", i, call.Target, err)}
+	}
+	return nil
+}
+
+//callError is a mistake of the client in a call, e.g. an unknown target or
+//an argument that doesn't decode, sent with its code and text
+type callError struct {
+	code string
+	err  error
+}
+
+func (err *callError) Error() string {
+	return err.err.Error()
+}
+
+func (err *callError) FaultCode() string {
+	return err.code
+}
+
+func (err *callError) Unwrap() error {
+	return err.err
+}
+
+//HandlerFunc handles a call, its result is sent back to the client with
+//onResult, an error with onStatus
+type HandlerFunc func(ctx context.Context, call *Call) (AMFAny, error)
+
+//Gateway is an http.Handler of flash remoting, like the endpoints of AMFPHP
+//or BlazeDS. Each message of a request is dispatched by its target, e.g.
+//"Service.method", to the handler registered for it, and answered with a
+//message to its response uri followed by "/onResult" or "/onStatus".
+//Messages carrying the flex messages of a channel are answered like BlazeDS
+//does, a RemotingMessage is dispatched to "destination.operation".
+type Gateway struct {
+	mu       sync.RWMutex
+	handlers map[string]HandlerFunc
+	opts     []DecoderOption
+	broker   *Broker
+	mapError ErrorMapper
+	auth     Authenticator
+	sessions *sessionStore
+	clients  *sessionStore //DSIds flex clients came back with, without principals
+	dsIdKey  []byte        //signs the DSIds issued
+}
+
+//gatewayLimits are the limits of the decoder of a gateway, the options given
+//to NewGateway are applied after them
+var gatewayLimits = []DecoderOption{
+	MaxDepth(256),
+	MaxStringLength(16 << 20),
+	MaxMembers(1 << 20),
+	MaxReferences(1 << 20),
+	MaxBytes(64 << 20),
+}
+
+//NewGateway creates a gateway decoding requests, and the arguments of calls,
+//with opts, e.g. StrictMembers. Requests are limited to 64MB, a depth of 256,
+//strings of 16MB and 1M members and references, opts may change the limits.
+func NewGateway(opts ...DecoderOption) *Gateway {
+	return &Gateway{
+		handlers: make(map[string]HandlerFunc),
+		opts:     append(append([]DecoderOption(nil), gatewayLimits...), opts...),
+		sessions: newSessionStore(),
+		clients:  newSessionStore(),
+		dsIdKey:  newKey(),
+	}
+}
+
+//Handle registers handler for target, e.g. "Service.method"
+func (gateway *Gateway) Handle(target string, handler HandlerFunc) {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	gateway.handlers[target] = handler
+}
+
+//SetBroker makes the gateway answer the subscribe, unsubscribe and poll
+//commands and the messages published by flex clients with broker
+func (gateway *Gateway) SetBroker(broker *Broker) {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	gateway.broker = broker
+}
+
+//SetErrorMapper makes the gateway send the errors of calls as the faults
+//mapper makes, FaultOf is used if it is nil or returns nil
+func (gateway *Gateway) SetErrorMapper(mapper ErrorMapper) {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	gateway.mapError = mapper
+}
+
+//fault maps the error of a call to the fault sent back
+func (gateway *Gateway) fault(err error) *Fault {
+	gateway.mu.RLock()
+	mapper := gateway.mapError
+	gateway.mu.RUnlock()
+
+	if mapper != nil {
+		if fault := mapper(err); fault != nil {
+			return fault
+		}
+	}
+	return FaultOf(err)
+}
+
+func (gateway *Gateway) getBroker() *Broker {
+	gateway.mu.RLock()
+	defer gateway.mu.RUnlock()
+	return gateway.broker
+}
+
+func (gateway *Gateway) handler(target string) (HandlerFunc, bool) {
+	gateway.mu.RLock()
+	defer gateway.mu.RUnlock()
+	handler, ok := gateway.handlers[target]
+	return handler, ok
+}
+
+func (gateway *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "amf gateway accepts POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	request, err := ReadPacket(r.Body, gateway.opts...)
+	if err != nil {
+		http.Error(w, "bad amf packet: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, authErr := gateway.sessionContext(w, r, request.Headers)
+	r = r.WithContext(ctx)
+
+	response := &Packet{Version: request.Version}
+	for i := range request.Messages {
+		response.Messages = append(response.Messages, gateway.serve(w, r, request, &request.Messages[i], authErr))
+		if r.Context().Err() != nil {
+			return
+		}
+	}
+
+	var buffer bytes.Buffer
+	err = WritePacket(&buffer, response)
+	if err != nil {
+		http.Error(w, "amf encoding failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amf")
+	w.Write(buffer.Bytes())
+}
+
+//serve calls the handler of a message and returns the message answering it,
+//authErr of the Credentials header fails the call
+func (gateway *Gateway) serve(w http.ResponseWriter, r *http.Request, request *Packet, message *Message, authErr error) Message {
+	call := &Call{
+		Target:   message.Target,
+		Headers:  request.Headers,
+		Request:  r,
+		Response: w,
+		opts:     gateway.opts,
+	}
+	if i := strings.LastIndexByte(message.Target, '.'); i >= 0 {
+		call.Service = message.Target[:i]
+		call.Method = message.Target[i+1:]
+	}
+
+	data, _ := message.Data.(*Value)
+	if flex, ok := flexMessageOf(data); ok {
+		return gateway.serveFlex(call, message, flex, authErr)
+	}
+	if authErr != nil {
+		return Message{Target: message.Response + "/onStatus", Response: "null", Data: gateway.fault(authErr).status()}
+	}
+	call.Args = callArgs(data)
+
+	result, err := gateway.call(r.Context(), call)
+	if err != nil {
+		return Message{Target: message.Response + "/onStatus", Response: "null", Data: gateway.fault(err).status()}
+	}
+	return Message{Target: message.Response + "/onResult", Response: "null", Data: result}
+}
+
+func (gateway *Gateway) call(ctx context.Context, call *Call) (result AMFAny, err error) {
+	handler, ok := gateway.handler(call.Target)
+	if !ok {
+		return nil, &callError{"Client.UnknownTarget", errors.New("no handler for target:" + call.Target)}
+	}
+
+	//a panic fails the call only, not the other messages of the packet
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic in %s: %v", call.Target, p)
+		}
+	}()
+
+	return handler(ctx, call)
+}
+
+//callArgs returns the arguments of a call sent as data, which is an array of
+//them, a single argument or nothing
+func callArgs(data *Value) []*Value {
+	switch {
+	case data == nil || data.Kind == KindNull || data.Kind == KindUndefined:
+		return nil
+	case data.Kind == KindArray && len(data.Members) == 0:
+		return data.Elements
+	default:
+		return []*Value{data}
+	}
+}
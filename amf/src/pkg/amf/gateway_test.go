@@ -0,0 +1,230 @@
+package amf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//postPacket sends packet to handler and returns the packet it answers
+func postPacket(t *testing.T, handler http.Handler, packet *Packet) (*Packet, *httptest.ResponseRecorder) {
+	t.Helper()
+	var buffer bytes.Buffer
+	err := WritePacket(&buffer, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/gateway", &buffer))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+	}
+	response, err := ReadPacket(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, recorder
+}
+
+type codedError struct{}
+
+func (codedError) Error() string     { return "coded" }
+func (codedError) FaultCode() string { return "App.Coded" }
+
+func mathGateway() *Gateway {
+	gateway := NewGateway()
+	gateway.Handle("Math.add", func(ctx context.Context, call *Call) (AMFAny, error) {
+		var a, b int
+		err := call.Decode(0, &a)
+		if err == nil {
+			err = call.Decode(1, &b)
+		}
+		return a + b, err
+	})
+	gateway.Handle("Math.neg", func(ctx context.Context, call *Call) (AMFAny, error) {
+		var a int
+		err := call.Decode(0, &a)
+		return -a, err
+	})
+	gateway.Handle("Math.target", func(ctx context.Context, call *Call) (AMFAny, error) {
+		return call.Service + "|" + call.Method + "|" + call.Target, nil
+	})
+	gateway.Handle("Math.fault", func(ctx context.Context, call *Call) (AMFAny, error) {
+		return nil, &Fault{Code: "App.Fault", Message: "fault", Detail: "detail"}
+	})
+	gateway.Handle("Math.coded", func(ctx context.Context, call *Call) (AMFAny, error) {
+		return nil, codedError{}
+	})
+	gateway.Handle("Math.fail", func(ctx context.Context, call *Call) (AMFAny, error) {
+		return nil, errors.New("boom")
+	})
+	gateway.Handle("Math.panic", func(ctx context.Context, call *Call) (AMFAny, error) {
+		panic("boom")
+	})
+	return gateway
+}
+
+func TestGateway(t *testing.T) {
+	tests := []struct {
+		target string
+		data   AMFAny
+		result AMFAny //result of onResult, nil for onStatus
+		code   string //code of the onStatus object
+	}{
+		{"Math.add", []AMFAny{2, 3}, 5, ""},
+		{"Math.neg", 4, -4, ""},
+		{"Math.target", nil, "Math|target|Math.target", ""},
+		{"Math.add", []AMFAny{2}, nil, "Client.InvalidArgument"},
+		{"Math.fault", nil, nil, "App.Fault"},
+		{"Math.coded", nil, nil, "App.Coded"},
+		{"Math.fail", nil, nil, "Server.Processing"},
+		{"Math.panic", nil, nil, "Server.Processing"},
+		{"Math.nothing", nil, nil, "Client.UnknownTarget"},
+	}
+
+	gateway := mathGateway()
+	for _, version := range []uint16{0, 3} {
+		request := &Packet{Version: version}
+		for i, test := range tests {
+			request.Messages = append(request.Messages, Message{Target: test.target, Response: "/" + string(rune('a'+i)), Data: test.data})
+		}
+
+		response, recorder := postPacket(t, gateway, request)
+		if recorder.Header().Get("Content-Type") != "application/x-amf" {
+			t.Errorf("version %d: content type %q", version, recorder.Header().Get("Content-Type"))
+		}
+		if response.Version != version || len(response.Messages) != len(tests) {
+			t.Fatalf("version %d: answered %+v", version, response)
+		}
+
+		for i, test := range tests {
+			message := response.Messages[i]
+			data := message.Data.(*Value)
+			if message.Response != "null" {
+				t.Errorf("version %d: %s answered to %q", version, test.target, message.Response)
+			}
+
+			if test.result != nil {
+				result := reflect.New(reflect.TypeOf(test.result))
+				data.Decode(result.Interface())
+				if message.Target != request.Messages[i].Response+"/onResult" || result.Elem().Interface() != test.result {
+					t.Errorf("version %d: %s answered %s %v", version, test.target, message.Target, data)
+				}
+				continue
+			}
+
+			if message.Target != request.Messages[i].Response+"/onStatus" || memberString(data, "code") != test.code || memberString(data, "level") != "error" {
+				t.Errorf("version %d: %s answered %s %v", version, test.target, message.Target, data)
+			}
+		}
+	}
+}
+
+func TestGatewayFault(t *testing.T) {
+	response, _ := postPacket(t, mathGateway(), &Packet{Messages: []Message{{Target: "Math.fault", Response: "/1"}}})
+	var status faultStatus
+	err := response.Messages[0].Data.(*Value).Decode(&status)
+	if err != nil || !reflect.DeepEqual(status, faultStatus{Level: "error", Code: "App.Fault", Description: "fault", Details: "detail", ExtendedData: map[string]AMFAny{}}) {
+		t.Errorf("status %+v, %v", status, err)
+	}
+
+	gateway := mathGateway()
+	gateway.SetErrorMapper(func(err error) *Fault {
+		if err.Error() == "boom" {
+			return &Fault{Code: "Mapped"}
+		}
+		return nil
+	})
+	response, _ = postPacket(t, gateway, &Packet{Messages: []Message{{Target: "Math.fail", Response: "/1"}, {Target: "Math.coded", Response: "/2"}}})
+	if code := memberString(response.Messages[0].Data.(*Value), "code"); code != "Mapped" {
+		t.Errorf("mapped error sent as %q", code)
+	}
+	if code := memberString(response.Messages[1].Data.(*Value), "code"); code != "App.Coded" {
+		t.Errorf("unmapped error sent as %q", code)
+	}
+}
+
+func TestGatewayRequests(t *testing.T) {
+	gateway := mathGateway()
+
+	recorder := httptest.NewRecorder()
+	gateway.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/gateway", nil))
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("GET answered %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	gateway.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/gateway", strings.NewReader("\x00\x01")))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("bad packet answered %d", recorder.Code)
+	}
+
+	limited := NewGateway(MaxMembers(1))
+	var buffer bytes.Buffer
+	WritePacket(&buffer, &Packet{Messages: []Message{{Target: "a"}, {Target: "b"}}})
+	recorder = httptest.NewRecorder()
+	limited.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/gateway", &buffer))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("packet over the limits answered %d", recorder.Code)
+	}
+
+	response, _ := postPacket(t, gateway, &Packet{Version: 3})
+	if len(response.Messages) != 0 {
+		t.Errorf("empty packet answered %+v", response)
+	}
+}
+
+func TestGatewayOptions(t *testing.T) {
+	var nested AMFAny = "deep"
+	for i := 0; i < 300; i++ {
+		nested = []AMFAny{nested}
+	}
+	var buffer bytes.Buffer
+	WritePacket(&buffer, &Packet{Version: 3, Messages: []Message{{Target: "Math.add", Response: "/1", Data: nested}}})
+	data := buffer.Bytes()
+
+	for _, test := range []struct {
+		gateway *Gateway
+		code    int
+	}{
+		{mathGateway(), http.StatusBadRequest},
+		{NewGateway(MaxDepth(0)), http.StatusOK},
+	} {
+		recorder := httptest.NewRecorder()
+		test.gateway.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/gateway", bytes.NewReader(data)))
+		if recorder.Code != test.code {
+			t.Errorf("300 nested arrays answered %d, want %d", recorder.Code, test.code)
+		}
+	}
+
+	//the options of the gateway decode the arguments of calls
+	strict := NewGateway(StrictMembers(true))
+	strict.Handle("Test.user", func(ctx context.Context, call *Call) (AMFAny, error) {
+		var user serviceUser
+		return nil, call.Decode(0, &user)
+	})
+	strict.RegisterService("Users", serviceUsers{})
+	argument := map[string]AMFAny{"name": "bob", "unknown": 1}
+	response, _ := postPacket(t, strict, &Packet{Version: 3, Messages: []Message{
+		{Target: "Test.user", Response: "/1", Data: []AMFAny{argument}},
+		{Target: "Users.save", Response: "/2", Data: []AMFAny{argument}},
+	}})
+	for _, message := range response.Messages {
+		if !strings.HasSuffix(message.Target, "/onStatus") {
+			t.Errorf("unknown member decoded strictly answered %s %v", message.Target, message.Data)
+		}
+	}
+
+	lenient := NewGateway()
+	lenient.RegisterService("Users", serviceUsers{})
+	response, _ = postPacket(t, lenient, &Packet{Version: 3, Messages: []Message{{Target: "Users.save", Response: "/1", Data: []AMFAny{argument}}}})
+	if response.Messages[0].Target != "/1/onResult" || response.Messages[0].Data.(*Value).Str != "saved bob" {
+		t.Errorf("unknown member answered %s %v", response.Messages[0].Target, response.Messages[0].Data)
+	}
+}
@@ -0,0 +1,135 @@
+package amf
+
+import (
+	"errors"
+	"reflect"
+)
+
+//Errors of a decoder configured with limits, the input is rejected before
+//anything is allocated for it
+var (
+	ErrMaxDepth          = errors.New("max depth exceeded")
+	ErrStringTooLong     = errors.New("string too long")
+	ErrTooManyMembers    = errors.New("too many members")
+	ErrTooManyReferences = errors.New("too many references")
+	ErrMaxBytes          = errors.New("max bytes exceeded")
+)
+
+//defaultMaxDepth keeps a decoder without MaxDepth from overflowing the stack
+const defaultMaxDepth = 10000
+
+//maxPrealloc and maxPreallocBytes limit what is allocated ahead from lengths
+//read in the input, even without limits
+const (
+	maxPrealloc      = 1024
+	maxPreallocBytes = 64 << 10
+)
+
+//MaxDepth limits how deep values nest, the top level value is at depth 1.
+//0 means no limit, the default is 10000.
+func MaxDepth(n int) DecoderOption {
+	return func(decoder *Decoder) {
+		decoder.maxDepth = n
+	}
+}
+
+//MaxStringLength limits the length in bytes of strings, byte arrays and xml
+func MaxStringLength(n int) DecoderOption {
+	return func(decoder *Decoder) {
+		decoder.maxString = n
+	}
+}
+
+//MaxMembers limits the number of elements of an array, vector or dictionary,
+//and the number of members of an object
+func MaxMembers(n int) DecoderOption {
+	return func(decoder *Decoder) {
+		decoder.maxMembers = n
+	}
+}
+
+//MaxReferences limits the size of each of the string, object and traits
+//reference tables
+func MaxReferences(n int) DecoderOption {
+	return func(decoder *Decoder) {
+		decoder.maxReferences = n
+	}
+}
+
+//MaxBytes limits the bytes consumed since the decoder was created or Reset
+func MaxBytes(n int64) DecoderOption {
+	return func(decoder *Decoder) {
+		decoder.maxBytes = n
+	}
+}
+
+func (decoder *Decoder) enter() error {
+	decoder.depth++
+	if decoder.maxDepth > 0 && decoder.depth > decoder.maxDepth {
+		return ErrMaxDepth
+	}
+	if decoder.ctx != nil {
+		return decoder.ctx.Err()
+	}
+	return nil
+}
+
+func (decoder *Decoder) leave() {
+	decoder.depth--
+}
+
+func (decoder *Decoder) checkString(length int) error {
+	if decoder.maxString > 0 && length > decoder.maxString {
+		return ErrStringTooLong
+	}
+	return nil
+}
+
+//checkMembers is called with the number of members read so far, or with
+//the count announced by the input
+func (decoder *Decoder) checkMembers(n int) error {
+	if decoder.maxMembers > 0 && n > decoder.maxMembers {
+		return ErrTooManyMembers
+	}
+	return nil
+}
+
+//checkBytes fails if reading length more bytes would exceed MaxBytes
+func (decoder *Decoder) checkBytes(length int) error {
+	if decoder.maxBytes > 0 && decoder.offset-decoder.resetOffset+int64(length) > decoder.maxBytes {
+		return ErrMaxBytes
+	}
+	return nil
+}
+
+func (decoder *Decoder) consume(n int) error {
+	decoder.offset += int64(n)
+	if decoder.maxBytes > 0 && decoder.offset-decoder.resetOffset > decoder.maxBytes {
+		return ErrMaxBytes
+	}
+	return nil
+}
+
+func (decoder *Decoder) addString(s string) error {
+	if decoder.maxReferences > 0 && len(decoder.stringCache) >= decoder.maxReferences {
+		return ErrTooManyReferences
+	}
+	decoder.stringCache = append(decoder.stringCache, s)
+	return nil
+}
+
+func (decoder *Decoder) addObject(value reflect.Value) error {
+	if decoder.maxReferences > 0 && len(decoder.objectCache) >= decoder.maxReferences {
+		return ErrTooManyReferences
+	}
+	decoder.objectCache = append(decoder.objectCache, value)
+	return nil
+}
+
+func (decoder *Decoder) addTraits(traits *Traits) error {
+	if decoder.maxReferences > 0 && len(decoder.traitsCache) >= decoder.maxReferences {
+		return ErrTooManyReferences
+	}
+	decoder.traitsCache = append(decoder.traitsCache, traits)
+	return nil
+}
@@ -0,0 +1,121 @@
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func nested(depth int) AMFAny {
+	var value AMFAny = "leaf"
+	for i := 1; i < depth; i++ {
+		value = []AMFAny{value}
+	}
+	return value
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		value AMFAny
+		opts  []DecoderOption
+		err   error
+	}{
+		{"depth within", nested(5), []DecoderOption{MaxDepth(5)}, nil},
+		{"depth over", nested(6), []DecoderOption{MaxDepth(5)}, ErrMaxDepth},
+		{"default depth", nested(10001), nil, ErrMaxDepth},
+		{"string within", strings.Repeat("x", 10), []DecoderOption{MaxStringLength(10)}, nil},
+		{"string over", strings.Repeat("x", 11), []DecoderOption{MaxStringLength(10)}, ErrStringTooLong},
+		{"bytes over", &Value{Kind: KindByteArray, Bytes: make([]byte, 11)}, []DecoderOption{MaxStringLength(10)}, ErrStringTooLong},
+		{"key over", map[string]AMFAny{strings.Repeat("k", 11): 1}, []DecoderOption{MaxStringLength(10)}, ErrStringTooLong},
+		{"array within", make([]AMFAny, 3), []DecoderOption{MaxMembers(3)}, nil},
+		{"array over", make([]AMFAny, 4), []DecoderOption{MaxMembers(3)}, ErrTooManyMembers},
+		{"object over", map[string]AMFAny{"a": 1, "b": 2, "c": 3, "d": 4}, []DecoderOption{MaxMembers(3)}, ErrTooManyMembers},
+		{"strings within", []string{"a", "b", "a"}, []DecoderOption{MaxReferences(2)}, nil},
+		{"strings over", []string{"a", "b", "c"}, []DecoderOption{MaxReferences(2)}, ErrTooManyReferences},
+		{"objects over", []AMFAny{[]AMFAny{}, []AMFAny{}}, []DecoderOption{MaxReferences(2)}, ErrTooManyReferences},
+		{"bytes within", strings.Repeat("x", 20), []DecoderOption{MaxBytes(22)}, nil},
+		{"bytes total over", strings.Repeat("x", 20), []DecoderOption{MaxBytes(21)}, ErrMaxBytes},
+	}
+
+	for _, test := range tests {
+		data, err := Marshal(test.value)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		var value AMFAny
+		err = NewDecoder(bytes.NewReader(data), test.opts...).Decode(&value)
+		if !errors.Is(err, test.err) || (test.err == nil) != (err == nil) {
+			t.Errorf("%s: decoded with %v, want %v", test.name, err, test.err)
+		}
+
+		_, err = NewDecoder(bytes.NewReader(data), test.opts...).ReadValue()
+		if !errors.Is(err, test.err) || (test.err == nil) != (err == nil) {
+			t.Errorf("%s: read document with %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestMaxBytesReset(t *testing.T) {
+	data, err := Marshal("0123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder(bytes.NewReader(append(data, data...)), MaxBytes(int64(len(data))))
+	for i := 0; i < 2; i++ {
+		var s string
+		decoder.Reset()
+		err = decoder.Decode(&s)
+		if err != nil {
+			t.Fatalf("value %d: %v", i, err)
+		}
+	}
+}
+
+//TestDeclaredLengths checks that lengths announced by hostile input don't
+//allocate before the input proves them
+func TestDeclaredLengths(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		typed bool //decodes into go values, vectors and dictionaries are documents only
+	}{
+		{"array", []byte{ARRAY_MARKER, 0xff, 0xff, 0xff, 0xff, 0x01}, true},
+		{"string", []byte{STRING_MARKER, 0xff, 0xff, 0xff, 0xff, 'x'}, true},
+		{"bytearray", []byte{BYTEARRAY_MARKER, 0xff, 0xff, 0xff, 0xff, 'x'}, true},
+		{"vector", []byte{VECTOR_INT_MARKER, 0xff, 0xff, 0xff, 0xff, 0x00}, false},
+		{"dictionary", []byte{DICTIONARY_MARKER, 0xff, 0xff, 0xff, 0xff, 0x00}, false},
+	}
+
+	for _, test := range tests {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		var value AMFAny
+		if test.typed {
+			err := NewDecoder(bytes.NewReader(test.input)).Decode(&value)
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%s: %v", test.name, err)
+			}
+		}
+		_, err := NewDecoder(bytes.NewReader(test.input)).ReadValue()
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%s: read document with %v", test.name, err)
+		}
+
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4<<20 {
+			t.Errorf("%s: %d bytes allocated", test.name, allocated)
+		}
+
+		_, err = NewDecoder(bytes.NewReader(test.input), MaxMembers(100), MaxStringLength(100)).ReadValue()
+		if !errors.Is(err, ErrTooManyMembers) && !errors.Is(err, ErrStringTooLong) {
+			t.Errorf("%s: read with limits: %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+var encoderPool sync.Pool
+
+//getEncoder returns an encoder without writer, reusing the reference tables
+//of a pooled one
+func getEncoder(opts []EncoderOption) *Encoder {
+	encoder, ok := encoderPool.Get().(*Encoder)
+	if !ok {
+		return NewEncoder(nil, false, opts...)
+	}
+
+	*encoder = Encoder{
+		stringCache: encoder.stringCache,
+		objectCache: encoder.objectCache,
+		valueCache:  encoder.valueCache,
+		traitsCache: encoder.traitsCache,
+		amf0Cache:   encoder.amf0Cache,
+	}
+	for _, opt := range opts {
+		opt(encoder)
+	}
+	encoder.Reset()
+	encoder.stats = TableStats{}
+	return encoder
+}
+
+func putEncoder(encoder *Encoder) {
+	encoder.buffer = nil
+	encoderPool.Put(encoder)
+}
+
+//AppendAMF appends the encoding of value to dst and returns the extended
+//buffer. Apart from growing dst and the reference tables, which are pooled,
+//encoding does not allocate.
+func AppendAMF(dst []byte, value AMFAny, opts ...EncoderOption) ([]byte, error) {
+	encoder := getEncoder(opts)
+	defer putEncoder(encoder)
+
+	encoder.buffer = dst
+	err := topPath(encoder.encode(reflect.ValueOf(value)))
+	if err != nil {
+		return dst, err
+	}
+
+	return encoder.buffer, nil
+}
+
+//Marshal encodes a value with a new Encoder and returns the bytes, the field
+//names of structs are lowered unless ReservStruct(true) is given
+func Marshal(value AMFAny, opts ...EncoderOption) ([]byte, error) {
+	data, err := AppendAMF(nil, value, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+//Unmarshal decodes exactly one value from data into the value pointed by
+//value, with a new Decoder
+func Unmarshal(data []byte, value AMFAny, opts ...DecoderOption) error {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.New("non-nil pointer expected for unmarshal")
+	}
+
+	reader := bytes.NewReader(data)
+	decoder := NewDecoder(reader, opts...)
+	err := decoder.Decode(value)
+	if err != nil {
+		return err
+	}
+
+	if reader.Len() != 0 {
+		return errors.New(strconv.Itoa(reader.Len()) + " bytes left after value")
+	}
+
+	return nil
+}
+
+//UnmarshalAs decodes data as a value of type T, e.g.
+//
+//	user, err := amf.UnmarshalAs[*User](data)
+//	doc, err := amf.UnmarshalAs[*amf.Value](data)
+func UnmarshalAs[T any](data []byte, opts ...DecoderOption) (T, error) {
+	var ret T
+	err := Unmarshal(data, &ret, opts...)
+	return ret, err
+}
@@ -0,0 +1,117 @@
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type marshalUser struct {
+	Name    string
+	Age     int
+	Created time.Time
+	Tags    []string
+	Friend  *marshalUser
+}
+
+func TestMarshal(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	user := &marshalUser{Name: "bob", Age: 30, Created: created, Tags: []string{"a"}, Friend: &marshalUser{Name: "alice"}}
+
+	tests := []struct {
+		name   string
+		value  AMFAny
+		reserv bool
+	}{
+		{"string", "héllo", false},
+		{"int", 42, false},
+		{"float", 1.5, false},
+		{"bool", true, false},
+		{"nil", nil, false},
+		{"slice", []AMFAny{1, "x", nil}, false},
+		{"map", map[string]AMFAny{"k": "v"}, false},
+		{"struct", user, false},
+		{"struct with go names", user, true},
+	}
+
+	for _, test := range tests {
+		var buffer bytes.Buffer
+		err := NewEncoder(&buffer, test.reserv).Encode(test.value)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		data, err := Marshal(test.value, ReservStruct(test.reserv))
+		if err != nil || !bytes.Equal(data, buffer.Bytes()) {
+			t.Errorf("%s: marshaled % x, want % x, %v", test.name, data, buffer.Bytes(), err)
+		}
+
+		//the pooled encoder doesn't keep references of the previous value
+		again, err := Marshal(test.value, ReservStruct(test.reserv))
+		if err != nil || !bytes.Equal(again, data) {
+			t.Errorf("%s: marshaled again as % x, %v", test.name, again, err)
+		}
+
+		var decoded AMFAny
+		err = NewDecoder(bytes.NewReader(data)).Decode(&decoded)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var unmarshaled AMFAny
+		err = Unmarshal(data, &unmarshaled)
+		if err != nil || !reflect.DeepEqual(unmarshaled, decoded) {
+			t.Errorf("%s: unmarshaled %#v, want %#v, %v", test.name, unmarshaled, decoded, err)
+		}
+	}
+
+	data, err := Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalAs[marshalUser](data)
+	if err != nil || decoded.Name != "bob" || decoded.Age != 30 || !decoded.Created.Equal(created) || len(decoded.Tags) != 1 || decoded.Friend == nil || decoded.Friend.Name != "alice" {
+		t.Errorf("unmarshaled %+v, %v", decoded, err)
+	}
+	pointer, err := UnmarshalAs[*marshalUser](data)
+	if err != nil || pointer == nil || pointer.Name != "bob" {
+		t.Errorf("unmarshaled %+v, %v", pointer, err)
+	}
+	document, err := UnmarshalAs[*Value](data)
+	if err != nil || document.Kind != KindObject || memberString(document, "name") != "bob" {
+		t.Errorf("unmarshaled document %v, %v", document, err)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	data, _ := Marshal("x")
+	var s string
+	var limited []AMFAny
+	nested, _ := Marshal([]AMFAny{[]AMFAny{[]AMFAny{}}})
+
+	tests := []struct {
+		name  string
+		data  []byte
+		value AMFAny
+		opts  []DecoderOption
+	}{
+		{"not a pointer", data, s, nil},
+		{"nil pointer", data, (*string)(nil), nil},
+		{"bytes left", append(data, 0x01), &s, nil},
+		{"empty", nil, &s, nil},
+		{"truncated", data[:len(data)-1], &s, nil},
+		{"option", nested, &limited, []DecoderOption{MaxDepth(2)}},
+	}
+	for _, test := range tests {
+		if err := Unmarshal(test.data, test.value, test.opts...); err == nil {
+			t.Errorf("%s: unmarshaled", test.name)
+		}
+	}
+
+	if _, err := UnmarshalAs[[]AMFAny](nested, MaxDepth(2)); !errors.Is(err, ErrMaxDepth) {
+		t.Errorf("option of UnmarshalAs: %v", err)
+	}
+	if _, err := Marshal(make(chan int)); err == nil {
+		t.Error("channel marshaled")
+	}
+}
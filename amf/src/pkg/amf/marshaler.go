@@ -0,0 +1,440 @@
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strconv"
+)
+
+//Marshaler is implemented by types that encode themselves, the amfgen tool
+//generates it for structs with the same output as the reflective encoder
+type Marshaler interface {
+	MarshalAMF(encoder *Encoder) error
+}
+
+//Unmarshaler is implemented by types that decode themselves. UnmarshalAMF
+//starts reading at the marker of the value, which is never null.
+type Unmarshaler interface {
+	UnmarshalAMF(decoder *Decoder) error
+}
+
+var (
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	anyType         = reflect.TypeOf((*AMFAny)(nil)).Elem()
+)
+
+//EncodeObjectStart writes the header of an anonymous dynamic object, like
+//the encoder does for maps
+func (encoder *Encoder) EncodeObjectStart() error {
+	err := encoder.writeMarker(OBJECT_MARKER)
+	if err != nil {
+		return err
+	}
+
+	encoder.objectCount++
+	encoder.sealed = append(encoder.sealed, false)
+	return encoder.writeAnonymousTraits()
+}
+
+func (encoder *Encoder) writeAnonymousTraits() error {
+	encoder.traitsCount++
+	err := encoder.writeMarker(0x0b)
+	if err != nil {
+		return err
+	}
+
+	return encoder.writeString("")
+}
+
+//EncodeStructStart writes the header of the object of the struct value
+//points to, like the encoder does for structs: a reference if it was written
+//before, the sealed traits of its class if it is registered by RegisterClass,
+//an anonymous dynamic object otherwise. It returns false if the object is
+//written whole, a reference or an externalizable class.
+func (encoder *Encoder) EncodeStructStart(value AMFAny) (bool, error) {
+	v := reflect.ValueOf(value)
+	err := encoder.writeMarker(OBJECT_MARKER)
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := encoder.writeObjectReference(v)
+	if ok || err != nil {
+		return false, err
+	}
+
+	info, ok := classByType(v.Type().Elem())
+	if !ok {
+		encoder.sealed = append(encoder.sealed, false)
+		return true, encoder.writeAnonymousTraits()
+	}
+	if info.external {
+		return false, encoder.encodeClass(encoder.classTraits(info), v)
+	}
+
+	info = encoder.classTraits(info)
+	traits := info.traits[0]
+	if encoder.reservStruct {
+		traits = info.traits[1]
+	}
+	encoder.sealed = append(encoder.sealed, true)
+	return true, encoder.writeTraits(traits)
+}
+
+//EncodeFieldKey writes the key of a struct field, name or reservName
+//depending on how the encoder is configured, the members of a registered
+//class have no key
+func (encoder *Encoder) EncodeFieldKey(name, reservName string) error {
+	if len(encoder.sealed) > 0 && encoder.sealed[len(encoder.sealed)-1] {
+		return nil
+	}
+	if encoder.reservStruct {
+		return encoder.writeString(reservName)
+	}
+	return encoder.writeString(name)
+}
+
+//EncodeObjectEnd closes an object started with EncodeObjectStart or
+//EncodeStructStart
+func (encoder *Encoder) EncodeObjectEnd() error {
+	sealed := false
+	if n := len(encoder.sealed); n > 0 {
+		sealed = encoder.sealed[n-1]
+		encoder.sealed = encoder.sealed[:n-1]
+	}
+	if sealed {
+		return nil
+	}
+	return encoder.writeString("")
+}
+
+//EncodeField encodes the struct field pointed by value the way the encoder
+//does for fields of structs without Marshaler
+func (encoder *Encoder) EncodeField(value AMFAny) error {
+	v := reflect.ValueOf(value).Elem()
+	if v.Kind() == reflect.Struct {
+		v = v.Addr()
+	}
+	return encoder.encode(v)
+}
+
+func (encoder *Encoder) EncodeNull() error {
+	err := encoder.encodeNull()
+	if err != nil {
+		return encodeError(err, anyType)
+	}
+	return nil
+}
+
+func (encoder *Encoder) EncodeBool(value bool) error {
+	err := encoder.encodeBool(value)
+	if err != nil {
+		return encodeError(err, reflect.TypeOf(value))
+	}
+	return nil
+}
+
+func (encoder *Encoder) EncodeInt(value int64) error {
+	err := encoder.encodeInt(value)
+	if err != nil {
+		return encodeError(err, reflect.TypeOf(value))
+	}
+	return nil
+}
+
+func (encoder *Encoder) EncodeUint(value uint64) error {
+	err := encoder.encodeUint(value)
+	if err != nil {
+		return encodeError(err, reflect.TypeOf(value))
+	}
+	return nil
+}
+
+func (encoder *Encoder) EncodeFloat(value float64) error {
+	err := encoder.encodeFloat(value)
+	if err != nil {
+		return encodeError(err, reflect.TypeOf(value))
+	}
+	return nil
+}
+
+func (encoder *Encoder) EncodeString(value string) error {
+	err := encoder.encodeString(value)
+	if err != nil {
+		return encodeError(err, reflect.TypeOf(value))
+	}
+	return nil
+}
+
+//DecodeObjectStart reads the header of the object decoded into value, which
+//must be a pointer to struct. It returns false if the object was a reference
+//and value is already set, or if the marker was not an object.
+func (decoder *Decoder) DecodeObjectStart(value AMFAny) (bool, error) {
+	v := reflect.ValueOf(value).Elem()
+
+	marker, err := decoder.readMarker()
+	if err != nil {
+		return false, decodeError(err, decoder.offset, 0, v.Type())
+	}
+	offset := decoder.offset - 1
+
+	ok := false
+	if marker == OBJECT_MARKER {
+		ok, err = decoder.readObjectStart(v)
+	} else {
+		err = decoder.decodeMarker(marker, v)
+	}
+
+	if err != nil {
+		return false, decodeError(err, offset, marker, v.Type())
+	}
+	return ok, nil
+}
+
+func (decoder *Decoder) readObjectStart(v reflect.Value) (bool, error) {
+	traits, index, ref, err := decoder.readObjectHeader()
+	if err != nil {
+		return false, err
+	}
+
+	if ref {
+		if index >= len(decoder.objectCache) || !decoder.objectCache[index].IsValid() || decoder.objectCache[index].Type() != v.Type() {
+			return false, errors.New("invalid object reference:" + strconv.Itoa(index) + " for " + v.Type().String())
+		}
+		v.Set(decoder.objectCache[index])
+		return false, nil
+	}
+
+	if traits.Externalizable {
+		return false, errors.New("externalizable class:" + traits.Class + " not supported")
+	}
+
+	err = decoder.addObject(v)
+	if err != nil {
+		return false, err
+	}
+
+	decoder.keys = append(decoder.keys, keyFrame{traits: traits})
+	return true, nil
+}
+
+//keyFrame is an object started with DecodeObjectStart
+type keyFrame struct {
+	traits *Traits
+	next   int //next sealed member
+}
+
+//DecodeKey reads the next key of the object started last, the sealed
+//members come first, "" ends the object
+func (decoder *Decoder) DecodeKey() (string, error) {
+	if len(decoder.keys) == 0 {
+		return "", errors.New("key outside of object")
+	}
+
+	frame := &decoder.keys[len(decoder.keys)-1]
+	if frame.next < len(frame.traits.Members) {
+		frame.next++
+		return frame.traits.Members[frame.next-1], nil
+	}
+
+	if frame.traits.Dynamic {
+		key, err := decoder.readUTF8()
+		if err != nil || key != "" {
+			return key, err
+		}
+	}
+
+	decoder.keys = decoder.keys[:len(decoder.keys)-1]
+	return "", nil
+}
+
+//DecodeField decodes into the struct field pointed by value the way the
+//decoder does for fields of structs without Unmarshaler
+func (decoder *Decoder) DecodeField(value AMFAny) error {
+	return decoder.decode(reflect.ValueOf(value).Elem())
+}
+
+//UnknownKey skips the value of a key that doesn't match any field of value,
+//with StrictMembers it returns the error of the decoder for the key instead
+func (decoder *Decoder) UnknownKey(key string, value AMFAny) error {
+	return decoder.unknownMember(key, reflect.TypeOf(value).Elem())
+}
+
+type signed interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64
+}
+
+type unsigned interface {
+	~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+//DecodeInt decodes an integer into value without reflection, other markers
+//are handled like DecodeField does
+func DecodeInt[T signed](decoder *Decoder, value *T) error {
+	marker, err := decoder.readMarker()
+	if err != nil {
+		return decodeError(err, decoder.offset, 0, reflect.TypeOf(*value))
+	}
+	offset := decoder.offset - 1
+
+	if marker != INTEGER_MARKER {
+		decoder.unreadMarker(marker)
+		return decoder.DecodeField(value)
+	}
+
+	uv, err := decoder.readU29()
+	if err != nil {
+		return decodeError(err, offset, marker, reflect.TypeOf(*value))
+	}
+
+	vv := int32(uv)
+	if uv > 0xfffffff {
+		vv = int32(uv - 0x20000000)
+	}
+	*value = T(vv)
+	return nil
+}
+
+//DecodeUint decodes an integer into value without reflection, other markers
+//are handled like DecodeField does
+func DecodeUint[T unsigned](decoder *Decoder, value *T) error {
+	marker, err := decoder.readMarker()
+	if err != nil {
+		return decodeError(err, decoder.offset, 0, reflect.TypeOf(*value))
+	}
+	offset := decoder.offset - 1
+
+	if marker != INTEGER_MARKER {
+		decoder.unreadMarker(marker)
+		return decoder.DecodeField(value)
+	}
+
+	uv, err := decoder.readU29()
+	if err != nil {
+		return decodeError(err, offset, marker, reflect.TypeOf(*value))
+	}
+
+	*value = T(uv)
+	return nil
+}
+
+//DecodeFloat decodes a double into value without reflection, other markers
+//are handled like DecodeField does
+func DecodeFloat[T ~float32 | ~float64](decoder *Decoder, value *T) error {
+	marker, err := decoder.readMarker()
+	if err != nil {
+		return decodeError(err, decoder.offset, 0, reflect.TypeOf(*value))
+	}
+	offset := decoder.offset - 1
+
+	if marker != DOUBLE_MARKER {
+		decoder.unreadMarker(marker)
+		return decoder.DecodeField(value)
+	}
+
+	v, err := decoder.readDouble()
+	if err != nil {
+		return decodeError(err, offset, marker, reflect.TypeOf(*value))
+	}
+
+	*value = T(v)
+	return nil
+}
+
+//DecodeString decodes a string into value without reflection, other markers
+//are handled like DecodeField does
+func DecodeString[T ~string](decoder *Decoder, value *T) error {
+	marker, err := decoder.readMarker()
+	if err != nil {
+		return decodeError(err, decoder.offset, 0, reflect.TypeOf(*value))
+	}
+	offset := decoder.offset - 1
+
+	if marker != STRING_MARKER {
+		decoder.unreadMarker(marker)
+		return decoder.DecodeField(value)
+	}
+
+	v, err := decoder.readUTF8()
+	if err != nil {
+		return decodeError(err, offset, marker, reflect.TypeOf(*value))
+	}
+
+	*value = T(v)
+	return nil
+}
+
+//DecodeBool decodes a boolean into value without reflection, other markers
+//are handled like DecodeField does
+func DecodeBool[T ~bool](decoder *Decoder, value *T) error {
+	marker, err := decoder.readMarker()
+	if err != nil {
+		return decodeError(err, decoder.offset, 0, reflect.TypeOf(*value))
+	}
+
+	switch marker {
+	case TRUE_MARKER:
+		*value = true
+	case FALSE_MARKER:
+		*value = false
+	default:
+		decoder.unreadMarker(marker)
+		return decoder.DecodeField(value)
+	}
+
+	return nil
+}
+
+//VerifyCodec checks that the Marshaler and Unmarshaler of value, usually
+//generated by amfgen, behave like the reflective encoder and decoder: both
+//must produce the same bytes and decode them to equal values. Maps of more
+//than one key are encoded in random order, values to check shouldn't have them.
+func VerifyCodec(value AMFAny) error {
+	for _, reserv := range []bool{false, true} {
+		generated := new(bytes.Buffer)
+		err := NewEncoder(generated, reserv).Encode(value)
+		if err != nil {
+			return err
+		}
+
+		reflective := new(bytes.Buffer)
+		encoder := NewEncoder(reflective, reserv)
+		encoder.reflectOnly = true
+		err = encoder.Encode(value)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(generated.Bytes(), reflective.Bytes()) {
+			return errors.New("generated encoding of " + reflect.TypeOf(value).String() + " differs from reflection")
+		}
+	}
+
+	data := new(bytes.Buffer)
+	err := NewEncoder(data, false).Encode(value)
+	if err != nil {
+		return err
+	}
+
+	t := reflect.TypeOf(value).Elem()
+	generated := reflect.New(t)
+	err = NewDecoder(bytes.NewReader(data.Bytes())).Decode(generated.Interface())
+	if err != nil {
+		return err
+	}
+
+	reflective := reflect.New(t)
+	decoder := NewDecoder(bytes.NewReader(data.Bytes()))
+	decoder.reflectOnly = true
+	err = decoder.Decode(reflective.Interface())
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(generated.Interface(), reflective.Interface()) {
+		return errors.New("generated decoding of " + t.String() + " differs from reflection")
+	}
+
+	return nil
+}
@@ -0,0 +1,435 @@
+package amf
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+//operations of a CommandMessage
+const (
+	SUBSCRIBE_OPERATION               = 0
+	UNSUBSCRIBE_OPERATION             = 1
+	POLL_OPERATION                    = 2
+	CLIENT_SYNC_OPERATION             = 4
+	CLIENT_PING_OPERATION             = 5
+	CLUSTER_REQUEST_OPERATION         = 7
+	LOGIN_OPERATION                   = 8
+	LOGOUT_OPERATION                  = 9
+	SUBSCRIPTION_INVALIDATE_OPERATION = 10
+	MULTI_SUBSCRIBE_OPERATION         = 11
+	DISCONNECT_OPERATION              = 12
+	TRIGGER_CONNECT_OPERATION         = 13
+	UNKNOWN_OPERATION                 = 10000
+)
+
+//headers of flex messages
+const (
+	DSIdHeader                 = "DSId"
+	DSEndpointHeader           = "DSEndpoint"
+	DSMessagingVersionHeader   = "DSMessagingVersion"
+	DSRequestTimeoutHeader     = "DSRequestTimeout"
+	DSSubtopicHeader           = "DSSubtopic"
+	DSSelectorHeader           = "DSSelector"
+	DSCredentialsCharsetHeader = "DSCredentialsCharset"
+)
+
+//RemotingMessage is a call of a RemoteObject, Operation is the method of
+//the destination and the body holds the arguments
+type RemotingMessage struct {
+	Body        AMFAny
+	ClientId    string
+	Destination string
+	Headers     map[string]AMFAny
+	MessageId   string
+	Operation   string
+	Source      string
+	TimeToLive  float64
+	Timestamp   float64
+}
+
+//AsyncMessage is a message published to a destination
+type AsyncMessage struct {
+	Body          AMFAny
+	ClientId      string
+	CorrelationId string
+	Destination   string
+	Headers       map[string]AMFAny
+	MessageId     string
+	TimeToLive    float64
+	Timestamp     float64
+}
+
+//CommandMessage is a message to the messaging system itself, e.g. to ping,
+//login or subscribe, see the *_OPERATION constants
+type CommandMessage struct {
+	Body          AMFAny
+	ClientId      string
+	CorrelationId string
+	Destination   string
+	Headers       map[string]AMFAny
+	MessageId     string
+	Operation     int
+	TimeToLive    float64
+	Timestamp     float64
+}
+
+//AcknowledgeMessage answers a message, CorrelationId is the MessageId of
+//the message answered
+type AcknowledgeMessage struct {
+	Body          AMFAny
+	ClientId      string
+	CorrelationId string
+	Destination   string
+	Headers       map[string]AMFAny
+	MessageId     string
+	TimeToLive    float64
+	Timestamp     float64
+}
+
+//ErrorMessage answers a message that failed
+type ErrorMessage struct {
+	Body          AMFAny
+	ClientId      string
+	CorrelationId string
+	Destination   string
+	ExtendedData  map[string]AMFAny
+	FaultCode     string
+	FaultDetail   string
+	FaultString   string
+	Headers       map[string]AMFAny
+	MessageId     string
+	RootCause     AMFAny
+	TimeToLive    float64
+	Timestamp     float64
+}
+
+func init() {
+	RegisterClass("flex.messaging.messages.RemotingMessage", RemotingMessage{})
+	RegisterClass("flex.messaging.messages.AsyncMessage", AsyncMessage{})
+	RegisterClass("flex.messaging.messages.CommandMessage", CommandMessage{})
+	RegisterClass("flex.messaging.messages.AcknowledgeMessage", AcknowledgeMessage{})
+	RegisterClass("flex.messaging.messages.ErrorMessage", ErrorMessage{})
+
+	registerSmall("flex.messaging.messages.AsyncMessage", "DSA", &AsyncMessage{})
+	registerSmall("flex.messaging.messages.CommandMessage", "DSC", &CommandMessage{})
+	registerSmall("flex.messaging.messages.AcknowledgeMessage", "DSK", &AcknowledgeMessage{})
+}
+
+//registerSmall registers the small form of a message class
+func registerSmall(alias, small string, value Externalizable) {
+	info, _ := classByAlias(alias)
+	info.small = registerClass(small, value, true)
+}
+
+//messageFields points to the fields of a message read and written by the
+//small forms
+type messageFields struct {
+	body          *AMFAny
+	clientId      *string
+	destination   *string
+	headers       *map[string]AMFAny
+	messageId     *string
+	timestamp     *float64
+	timeToLive    *float64
+	correlationId *string
+}
+
+const hasNextFlag = 0x80
+
+//readFlags reads the flag bytes of a small message, the high bit of a byte
+//tells another one follows
+func readFlags(decoder *Decoder) ([]byte, error) {
+	var flags []byte
+	for {
+		b, err := decoder.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		flags = append(flags, b)
+		if b&hasNextFlag == 0 {
+			return flags, nil
+		}
+	}
+}
+
+//skipFlagged reads and drops the values of the flags above reserved, added
+//by later versions of flex
+func skipFlagged(decoder *Decoder, flags byte, reserved uint) error {
+	if flags>>reserved == 0 {
+		return nil
+	}
+
+	for j := reserved; j < 6; j++ {
+		if (flags>>j)&0x01 != 0 {
+			var dummy AMFAny
+			err := decoder.DecodeField(&dummy)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//readUUID reads a uuid sent as 16 bytes and formats it the way flex does
+func readUUID(decoder *Decoder) (string, error) {
+	var b []byte
+	err := decoder.DecodeField(&b)
+	if err != nil {
+		return "", err
+	}
+
+	if len(b) != 16 {
+		return "", errors.New("invalid uuid of length:" + strconv.Itoa(len(b)))
+	}
+	return formatUUID(b), nil
+}
+
+//formatUUID formats 16 bytes the way flex does
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+//newUUID makes a random uuid for the ids of messages and clients
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+//read reads the fields of AbstractMessage, and of AsyncMessage if
+//correlationId is set
+func (fields messageFields) read(decoder *Decoder) error {
+	flags, err := readFlags(decoder)
+	if err != nil {
+		return err
+	}
+
+	for i, f := range flags {
+		reserved := uint(0)
+		switch i {
+		case 0:
+			values := []AMFAny{fields.body, fields.clientId, fields.destination, fields.headers, fields.messageId, fields.timestamp, fields.timeToLive}
+			for j, v := range values {
+				if f&(1<<j) == 0 {
+					continue
+				}
+				err = decoder.DecodeField(v)
+				if err != nil {
+					return err
+				}
+			}
+			reserved = 7
+		case 1:
+			if f&0x01 != 0 {
+				*fields.clientId, err = readUUID(decoder)
+				if err != nil {
+					return err
+				}
+			}
+			if f&0x02 != 0 {
+				*fields.messageId, err = readUUID(decoder)
+				if err != nil {
+					return err
+				}
+			}
+			reserved = 2
+		}
+
+		err = skipFlagged(decoder, f, reserved)
+		if err != nil {
+			return err
+		}
+	}
+
+	if fields.correlationId == nil {
+		return nil
+	}
+
+	flags, err = readFlags(decoder)
+	if err != nil {
+		return err
+	}
+
+	for i, f := range flags {
+		reserved := uint(0)
+		if i == 0 {
+			if f&0x01 != 0 {
+				err = decoder.DecodeField(fields.correlationId)
+				if err != nil {
+					return err
+				}
+			}
+			if f&0x02 != 0 {
+				*fields.correlationId, err = readUUID(decoder)
+				if err != nil {
+					return err
+				}
+			}
+			reserved = 2
+		}
+
+		err = skipFlagged(decoder, f, reserved)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//write writes the fields of AbstractMessage, and of AsyncMessage if
+//correlationId is set, leaving out the empty ones
+func (fields messageFields) write(encoder *Encoder) error {
+	values := []AMFAny{fields.body, fields.clientId, fields.destination, fields.headers, fields.messageId, fields.timestamp, fields.timeToLive}
+	set := []bool{
+		*fields.body != nil,
+		*fields.clientId != "",
+		*fields.destination != "",
+		*fields.headers != nil,
+		*fields.messageId != "",
+		*fields.timestamp != 0,
+		*fields.timeToLive != 0,
+	}
+
+	flags := byte(0)
+	for j := range set {
+		if set[j] {
+			flags |= 1 << j
+		}
+	}
+
+	err := encoder.writeMarker(flags)
+	if err != nil {
+		return err
+	}
+
+	for j, v := range values {
+		if !set[j] {
+			continue
+		}
+		err = encoder.EncodeField(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	if fields.correlationId == nil {
+		return nil
+	}
+
+	if *fields.correlationId == "" {
+		return encoder.writeMarker(0)
+	}
+
+	err = encoder.writeMarker(0x01)
+	if err != nil {
+		return err
+	}
+	return encoder.EncodeField(fields.correlationId)
+}
+
+func (message *AsyncMessage) fields() messageFields {
+	return messageFields{&message.Body, &message.ClientId, &message.Destination, &message.Headers, &message.MessageId, &message.Timestamp, &message.TimeToLive, &message.CorrelationId}
+}
+
+//ReadExternal reads the small form DSA
+func (message *AsyncMessage) ReadExternal(decoder *Decoder) error {
+	return message.fields().read(decoder)
+}
+
+//WriteExternal writes the small form DSA
+func (message *AsyncMessage) WriteExternal(encoder *Encoder) error {
+	return message.fields().write(encoder)
+}
+
+func (message *AcknowledgeMessage) fields() messageFields {
+	return messageFields{&message.Body, &message.ClientId, &message.Destination, &message.Headers, &message.MessageId, &message.Timestamp, &message.TimeToLive, &message.CorrelationId}
+}
+
+//ReadExternal reads the small form DSK
+func (message *AcknowledgeMessage) ReadExternal(decoder *Decoder) error {
+	err := message.fields().read(decoder)
+	if err != nil {
+		return err
+	}
+
+	flags, err := readFlags(decoder)
+	if err != nil {
+		return err
+	}
+	for _, f := range flags {
+		err = skipFlagged(decoder, f, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//WriteExternal writes the small form DSK
+func (message *AcknowledgeMessage) WriteExternal(encoder *Encoder) error {
+	err := message.fields().write(encoder)
+	if err != nil {
+		return err
+	}
+	return encoder.writeMarker(0)
+}
+
+func (message *CommandMessage) fields() messageFields {
+	return messageFields{&message.Body, &message.ClientId, &message.Destination, &message.Headers, &message.MessageId, &message.Timestamp, &message.TimeToLive, &message.CorrelationId}
+}
+
+//ReadExternal reads the small form DSC
+func (message *CommandMessage) ReadExternal(decoder *Decoder) error {
+	err := message.fields().read(decoder)
+	if err != nil {
+		return err
+	}
+
+	flags, err := readFlags(decoder)
+	if err != nil {
+		return err
+	}
+
+	for i, f := range flags {
+		reserved := uint(0)
+		if i == 0 {
+			if f&0x01 != 0 {
+				err = decoder.DecodeField(&message.Operation)
+				if err != nil {
+					return err
+				}
+			}
+			reserved = 1
+		}
+
+		err = skipFlagged(decoder, f, reserved)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//WriteExternal writes the small form DSC
+func (message *CommandMessage) WriteExternal(encoder *Encoder) error {
+	err := message.fields().write(encoder)
+	if err != nil {
+		return err
+	}
+
+	if message.Operation == 0 {
+		return encoder.writeMarker(0)
+	}
+
+	err = encoder.writeMarker(0x01)
+	if err != nil {
+		return err
+	}
+	return encoder.EncodeField(&message.Operation)
+}
@@ -0,0 +1,205 @@
+package amf
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+//Packet is the envelope of flash remoting, the body of an application/x-amf
+//http request or response
+type Packet struct {
+	Version  uint16 //0 for AMF0 clients, 3 for clients using AMF3
+	Headers  []Header
+	Messages []Message
+}
+
+type Header struct {
+	Name           string
+	MustUnderstand bool
+	Value          AMFAny
+}
+
+//Message is a body of a packet, a call of Target or its result
+type Message struct {
+	Target   string //e.g. "Service.method" or "/1/onResult"
+	Response string //e.g. "/1", the target of the result is Response + "/onResult"
+	Data     AMFAny
+}
+
+//ReadPacket decodes a packet. Header values and message data are read as
+//*Value, the AMF3 reference tables are cleared for each of them.
+func ReadPacket(reader io.Reader, opts ...DecoderOption) (*Packet, error) {
+	decoder := NewDecoder(reader, opts...)
+	decoder.scope = MessageScope
+	return decoder.readPacket()
+}
+
+func (decoder *Decoder) readPacket() (*Packet, error) {
+	packet := new(Packet)
+	var err error
+	packet.Version, err = decoder.readUint16()
+	if err != nil {
+		return nil, decodeError(err, decoder.offset, 0, nil)
+	}
+
+	if packet.Version != 0 && packet.Version != 3 {
+		return nil, decodeError(errors.New("unsupported packet version:"+strconv.Itoa(int(packet.Version))), 0, 0, nil)
+	}
+
+	count, err := decoder.readUint16()
+	if err == nil {
+		err = decoder.checkMembers(int(count))
+	}
+	if err != nil {
+		return nil, decodeError(err, decoder.offset, 0, nil)
+	}
+
+	packet.Headers = make([]Header, count)
+	for i := range packet.Headers {
+		header := &packet.Headers[i]
+		header.Name, err = decoder.readShortString()
+		if err != nil {
+			return nil, decodeError(err, decoder.offset, 0, nil)
+		}
+
+		mustUnderstand, err := decoder.readByte()
+		if err != nil {
+			return nil, decodeError(err, decoder.offset, 0, nil)
+		}
+		header.MustUnderstand = mustUnderstand != 0
+
+		header.Value, err = decoder.readPacketValue()
+		if err != nil {
+			return nil, topPath(prependPath(err, "Headers"+indexElem(i)))
+		}
+	}
+
+	count, err = decoder.readUint16()
+	if err == nil {
+		err = decoder.checkMembers(int(count))
+	}
+	if err != nil {
+		return nil, decodeError(err, decoder.offset, 0, nil)
+	}
+
+	packet.Messages = make([]Message, count)
+	for i := range packet.Messages {
+		message := &packet.Messages[i]
+		message.Target, err = decoder.readShortString()
+		if err != nil {
+			return nil, decodeError(err, decoder.offset, 0, nil)
+		}
+
+		message.Response, err = decoder.readShortString()
+		if err != nil {
+			return nil, decodeError(err, decoder.offset, 0, nil)
+		}
+
+		message.Data, err = decoder.readPacketValue()
+		if err != nil {
+			return nil, topPath(prependPath(err, "Messages"+indexElem(i)))
+		}
+	}
+
+	return packet, nil
+}
+
+//readPacketValue reads the length and the value of a header or message
+func (decoder *Decoder) readPacketValue() (*Value, error) {
+	//the length is -1 from most clients, the value ends by itself anyway
+	_, err := decoder.readUint32()
+	if err != nil {
+		return nil, decodeError(err, decoder.offset, 0, nil)
+	}
+
+	value, err := decoder.readNextAMF0()
+	if err != nil {
+		return nil, err
+	}
+
+	return value, decoder.EndMessage()
+}
+
+//WritePacket encodes a packet and writes it with a single Write. Values of
+//a version 3 packet are written as AMF3 after the AVM+ marker, those of a
+//version 0 packet as AMF0.
+func WritePacket(writer io.Writer, packet *Packet, opts ...EncoderOption) error {
+	encoder := NewEncoder(writer, false, opts...)
+	encoder.scope = MessageScope
+	return encoder.flush(encoder.writePacket(packet))
+}
+
+func (encoder *Encoder) writePacket(packet *Packet) error {
+	if packet.Version != 0 && packet.Version != 3 {
+		return errors.New("unsupported packet version:" + strconv.Itoa(int(packet.Version)))
+	}
+
+	if len(packet.Headers) > 0xffff || len(packet.Messages) > 0xffff {
+		return errors.New("too many headers or messages for a packet")
+	}
+
+	encoder.writeUint16(packet.Version)
+	encoder.writeUint16(uint16(len(packet.Headers)))
+	for i := range packet.Headers {
+		header := &packet.Headers[i]
+		err := encoder.writeShortString(header.Name)
+		if err != nil {
+			return err
+		}
+
+		if header.MustUnderstand {
+			encoder.writeMarker(1)
+		} else {
+			encoder.writeMarker(0)
+		}
+
+		err = encoder.writePacketValue(header.Value, packet.Version)
+		if err != nil {
+			return topPath(prependPath(err, "Headers"+indexElem(i)))
+		}
+	}
+
+	encoder.writeUint16(uint16(len(packet.Messages)))
+	for i := range packet.Messages {
+		message := &packet.Messages[i]
+		err := encoder.writeShortString(message.Target)
+		if err != nil {
+			return err
+		}
+
+		err = encoder.writeShortString(message.Response)
+		if err != nil {
+			return err
+		}
+
+		err = encoder.writePacketValue(message.Data, packet.Version)
+		if err != nil {
+			return topPath(prependPath(err, "Messages"+indexElem(i)))
+		}
+	}
+
+	return nil
+}
+
+//writePacketValue writes the length and the value of a header or message
+func (encoder *Encoder) writePacketValue(value AMFAny, version uint16) error {
+	encoder.writeUint32(0)
+	start := len(encoder.buffer)
+
+	var err error
+	if version == 3 {
+		encoder.writeMarker(AMF0_AVMPLUS_MARKER)
+		err = encoder.encode(reflect.ValueOf(value))
+	} else {
+		err = encoder.writeAMF0Any(value)
+	}
+	if err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint32(encoder.buffer[start-4:], uint32(len(encoder.buffer)-start))
+	return encoder.EndMessage()
+}
@@ -0,0 +1,260 @@
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAMF0Values(t *testing.T) {
+	object := NewObject("")
+	object.Members = []Member{{Key: "a", Value: NewBool(true)}}
+	typed := NewObject("C")
+	typed.Members = []Member{{Key: "a", Value: NewBool(true)}}
+	empty := NewObject("")
+
+	tests := []struct {
+		name  string
+		value *Value
+		bytes []byte
+	}{
+		{"double", NewDouble(1.5), []byte{AMF0_NUMBER_MARKER, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"integer", NewInteger(2), []byte{AMF0_NUMBER_MARKER, 0x40, 0, 0, 0, 0, 0, 0, 0}},
+		{"true", NewBool(true), []byte{AMF0_BOOLEAN_MARKER, 1}},
+		{"false", NewBool(false), []byte{AMF0_BOOLEAN_MARKER, 0}},
+		{"string", NewString("hi"), []byte{AMF0_STRING_MARKER, 0, 2, 'h', 'i'}},
+		{"null", NewNull(), []byte{AMF0_NULL_MARKER}},
+		{"nil", nil, []byte{AMF0_NULL_MARKER}},
+		{"undefined", NewUndefined(), []byte{AMF0_UNDEFINED_MARKER}},
+		{"date", &Value{Kind: KindDate, Float: 1000}, []byte{AMF0_DATE_MARKER, 0x40, 0x8f, 0x40, 0, 0, 0, 0, 0, 0, 0}},
+		{"xml", &Value{Kind: KindXMLDocument, Str: "<a/>"}, []byte{AMF0_XMLDOC_MARKER, 0, 0, 0, 4, '<', 'a', '/', '>'}},
+		{"object", object, []byte{AMF0_OBJECT_MARKER, 0, 1, 'a', AMF0_BOOLEAN_MARKER, 1, 0, 0, AMF0_OBJECT_END_MARKER}},
+		{"typed object", typed, []byte{AMF0_TYPED_OBJECT_MARKER, 0, 1, 'C', 0, 1, 'a', AMF0_BOOLEAN_MARKER, 1, 0, 0, AMF0_OBJECT_END_MARKER}},
+		{"strict array", NewArray(NewBool(true)), []byte{AMF0_STRICT_ARRAY_MARKER, 0, 0, 0, 1, AMF0_BOOLEAN_MARKER, 1}},
+		{"ecma array", &Value{Kind: KindArray, Members: []Member{{Key: "k", Value: NewNull()}}}, []byte{AMF0_ECMA_ARRAY_MARKER, 0, 0, 0, 1, 0, 1, 'k', AMF0_NULL_MARKER, 0, 0, AMF0_OBJECT_END_MARKER}},
+		{"reference", NewArray(empty, empty), []byte{AMF0_STRICT_ARRAY_MARKER, 0, 0, 0, 2, AMF0_OBJECT_MARKER, 0, 0, AMF0_OBJECT_END_MARKER, AMF0_REFERENCE_MARKER, 0, 1}},
+		{"avm+", NewByteArray([]byte{1}), []byte{AMF0_AVMPLUS_MARKER, BYTEARRAY_MARKER, 0x03, 1}},
+	}
+
+	for _, test := range tests {
+		encoder := NewEncoder(nil, false)
+		err := encoder.WriteAMF0Value(test.value)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !bytes.Equal(encoder.buffer, test.bytes) {
+			t.Errorf("%s: encoded % x, want % x", test.name, encoder.buffer, test.bytes)
+		}
+
+		value, err := NewDecoder(bytes.NewReader(test.bytes)).ReadAMF0Value()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		again := NewEncoder(nil, false)
+		again.WriteAMF0Value(value)
+		if !bytes.Equal(again.buffer, test.bytes) {
+			t.Errorf("%s: decoded value encoded as % x", test.name, again.buffer)
+		}
+	}
+
+	value, err := NewDecoder(bytes.NewReader(tests[len(tests)-2].bytes)).ReadAMF0Value()
+	if err != nil || value.Elements[0] != value.Elements[1] {
+		t.Errorf("reference decoded to another value, %v", err)
+	}
+}
+
+func TestAMF0LongString(t *testing.T) {
+	s := strings.Repeat("x", 0x10000)
+	encoder := NewEncoder(nil, false)
+	err := encoder.WriteAMF0Value(NewString(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(encoder.buffer, []byte{AMF0_LONG_STRING_MARKER, 0, 1, 0, 0}) {
+		t.Errorf("encoded % x", encoder.buffer[:5])
+	}
+
+	value, err := NewDecoder(bytes.NewReader(encoder.buffer)).ReadAMF0Value()
+	if err != nil || value.Str != s {
+		t.Errorf("decoded %d bytes, %v", len(value.Str), err)
+	}
+
+	key := NewObject("")
+	key.Members = []Member{{Key: s, Value: NewNull()}}
+	err = NewEncoder(nil, false).WriteAMF0Value(key)
+	if err == nil {
+		t.Error("key too long for amf0 encoded")
+	}
+}
+
+type packetUser struct {
+	Name string
+	Age  int
+	Tags []string
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	user := &packetUser{Name: "bob", Age: 3, Tags: []string{"a", "b"}}
+	date := time.UnixMilli(100000).UTC()
+	shared := NewObject("")
+	shared.Members = []Member{{Key: "n", Value: NewInteger(1)}}
+
+	for _, version := range []uint16{0, 3} {
+		packet := &Packet{
+			Version: version,
+			Headers: []Header{{Name: CredentialsHeader, MustUnderstand: true, Value: map[string]AMFAny{"userid": "x", "password": "y"}}},
+			Messages: []Message{
+				{Target: "Svc.get", Response: "/1", Data: []AMFAny{user, shared, shared, "s", 1.5}},
+				{Target: "/2/onResult", Data: NewDate(date)},
+			},
+		}
+
+		var buffer bytes.Buffer
+		err := WritePacket(&buffer, packet)
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+
+		decoded, err := ReadPacket(&buffer)
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		if decoded.Version != version || len(decoded.Headers) != 1 || len(decoded.Messages) != 2 {
+			t.Fatalf("version %d: decoded %+v", version, decoded)
+		}
+
+		header := decoded.Headers[0]
+		if header.Name != CredentialsHeader || !header.MustUnderstand || memberString(header.Value.(*Value), "userid") != "x" {
+			t.Errorf("version %d: header %+v", version, header)
+		}
+
+		message := decoded.Messages[0]
+		if message.Target != "Svc.get" || message.Response != "/1" {
+			t.Errorf("version %d: message %q %q", version, message.Target, message.Response)
+		}
+		var data []AMFAny
+		err = message.Data.(*Value).Decode(&data)
+		if err != nil || len(data) != 5 || data[3] != "s" || data[4] != 1.5 {
+			t.Errorf("version %d: data %v, %v", version, data, err)
+		}
+		elements := message.Data.(*Value).Elements
+		if elements[1] != elements[2] {
+			t.Errorf("version %d: reference decoded to another value", version)
+		}
+		var decodedUser packetUser
+		err = elements[0].Decode(&decodedUser)
+		if err != nil || !reflect.DeepEqual(&decodedUser, user) {
+			t.Errorf("version %d: user %+v, %v", version, decodedUser, err)
+		}
+
+		message = decoded.Messages[1]
+		if message.Target != "/2/onResult" || message.Response != "" || !message.Data.(*Value).Time().Equal(date) {
+			t.Errorf("version %d: message %q %q %v", version, message.Target, message.Response, message.Data)
+		}
+	}
+}
+
+func TestPacketBytes(t *testing.T) {
+	packet := &Packet{
+		Headers:  []Header{{Name: "h", MustUnderstand: true, Value: true}},
+		Messages: []Message{{Target: "t", Response: "/1", Data: "x"}},
+	}
+
+	tests := []struct {
+		version uint16
+		bytes   []byte
+	}{
+		{0, []byte{0, 0, 0, 1, 0, 1, 'h', 1, 0, 0, 0, 2, AMF0_BOOLEAN_MARKER, 1, 0, 1, 0, 1, 't', 0, 2, '/', '1', 0, 0, 0, 4, AMF0_STRING_MARKER, 0, 1, 'x'}},
+		{3, []byte{0, 3, 0, 1, 0, 1, 'h', 1, 0, 0, 0, 2, AMF0_AVMPLUS_MARKER, TRUE_MARKER, 0, 1, 0, 1, 't', 0, 2, '/', '1', 0, 0, 0, 4, AMF0_AVMPLUS_MARKER, STRING_MARKER, 0x03, 'x'}},
+	}
+
+	for _, test := range tests {
+		packet.Version = test.version
+		var buffer bytes.Buffer
+		err := WritePacket(&buffer, packet)
+		if err != nil {
+			t.Fatalf("version %d: %v", test.version, err)
+		}
+		if !bytes.Equal(buffer.Bytes(), test.bytes) {
+			t.Errorf("version %d: encoded % x, want % x", test.version, buffer.Bytes(), test.bytes)
+		}
+	}
+}
+
+//TestPacketScope checks that the reference tables don't reach from one
+//message into the next
+func TestPacketScope(t *testing.T) {
+	packet := &Packet{Version: 3, Messages: []Message{{Target: "a", Data: "shared"}, {Target: "b", Data: "shared"}}}
+	var buffer bytes.Buffer
+	err := WritePacket(&buffer, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(buffer.Bytes(), []byte("shared")); n != 2 {
+		t.Errorf("string written %d times", n)
+	}
+
+	decoded, err := ReadPacket(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, message := range decoded.Messages {
+		if message.Data.(*Value).Str != "shared" {
+			t.Errorf("message %d: %v", i, message.Data)
+		}
+	}
+}
+
+func TestPacketErrors(t *testing.T) {
+	var buffer bytes.Buffer
+	err := WritePacket(&buffer, &Packet{Version: 3, Messages: []Message{{Target: "t", Data: []AMFAny{"x"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := buffer.Bytes()
+
+	for n := 1; n < len(valid); n++ {
+		_, err := ReadPacket(bytes.NewReader(valid[:n]))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%d of %d bytes: %v", n, len(valid), err)
+		}
+	}
+
+	_, err = ReadPacket(bytes.NewReader([]byte{0, 1, 0, 0, 0, 0}))
+	if err == nil || !strings.Contains(err.Error(), "unsupported packet version:1") {
+		t.Errorf("version 1 read with %v", err)
+	}
+
+	_, err = ReadPacket(bytes.NewReader(valid), MaxMembers(0x10000), MaxBytes(int64(len(valid)-1)))
+	if !errors.Is(err, ErrMaxBytes) {
+		t.Errorf("read over the limit with %v", err)
+	}
+
+	malformed := []byte{0, 3, 0, 1, 0, 1, 'a', 0, 0, 0, 0, 0, AMF0_STRICT_ARRAY_MARKER, 0, 0, 0, 1, AMF0_OBJECT_MARKER, 0, 1, 'k', AMF0_STRING_MARKER, 0, 5}
+	_, err = ReadPacket(bytes.NewReader(malformed))
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Path != "Headers[0][0].k" {
+		t.Errorf("malformed header read with %v", err)
+	}
+
+	malformed = []byte{0, 3, 0, 0, 0, 1, 0, 1, 't', 0, 0, 0, 0, 0, 0, 0x20}
+	_, err = ReadPacket(bytes.NewReader(malformed))
+	if !errors.As(err, &decodeErr) || decodeErr.Path != "Messages[0]" {
+		t.Errorf("malformed message read with %v", err)
+	}
+
+	err = WritePacket(io.Discard, &Packet{Version: 2})
+	if err == nil {
+		t.Error("version 2 written")
+	}
+
+	err = WritePacket(io.Discard, &Packet{Version: 3, Messages: []Message{{Target: "t", Data: []AMFAny{"x", make(chan int)}}}})
+	var encodeErr *EncodeError
+	if !errors.As(err, &encodeErr) || encodeErr.Path != "Messages[0][1]" {
+		t.Errorf("channel written with %v", err)
+	}
+}
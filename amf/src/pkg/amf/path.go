@@ -0,0 +1,469 @@
+package amf
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//Path selects values inside a document tree, e.g.
+//
+//	body[0].items[*].uid
+//	headers["Credentials"].userid
+//
+//a name selects an object member, an associative array member or a dictionary
+//entry with a string key, an index selects a dense array element, a vector item
+//or a dictionary entry with a numeric key, and * selects every child.
+type Path []pathElem
+
+type pathElem struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+func (elem pathElem) String() string {
+	switch {
+	case elem.wildcard:
+		return "[*]"
+	case elem.isIndex:
+		return "[" + strconv.Itoa(elem.index) + "]"
+	}
+	return "[" + strconv.Quote(elem.name) + "]"
+}
+
+//ParsePath compiles a path expression, the empty path selects the root
+func ParsePath(expr string) (Path, error) {
+	path := make(Path, 0, 4)
+	s := expr
+
+	for i := 0; s != ""; i++ {
+		switch s[0] {
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, errors.New("unclosed [ in path:" + expr)
+			}
+
+			inner := s[1:end]
+			if len(inner) > 0 && (inner[0] == '"' || inner[0] == '\'') {
+				//the key may contain ], so look for the closing quote first
+				quoted, rest, err := unquotePathKey(s[1:])
+				if err != nil {
+					return nil, errors.New("invalid key in path:" + expr)
+				}
+				if rest == "" || rest[0] != ']' {
+					return nil, errors.New("unclosed [ in path:" + expr)
+				}
+				path = append(path, pathElem{name: quoted})
+				s = rest[1:]
+				continue
+			}
+
+			switch {
+			case inner == "*":
+				path = append(path, pathElem{wildcard: true})
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil || n < 0 {
+					return nil, errors.New("invalid index:" + inner + " in path:" + expr)
+				}
+				path = append(path, pathElem{index: n, isIndex: true})
+			}
+			s = s[end+1:]
+		case '.':
+			if i == 0 {
+				return nil, errors.New("path:" + expr + " starts with .")
+			}
+			s = s[1:]
+			fallthrough
+		default:
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+
+			name := s[:end]
+			if name == "" {
+				return nil, errors.New("empty name in path:" + expr)
+			}
+
+			if name == "*" {
+				path = append(path, pathElem{wildcard: true})
+			} else {
+				path = append(path, pathElem{name: name})
+			}
+			s = s[end:]
+		}
+	}
+
+	return path, nil
+}
+
+func unquotePathKey(s string) (string, string, error) {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case quote:
+			if quote == '\'' {
+				return strings.Replace(s[1:i], "\\'", "'", -1), s[i+1:], nil
+			}
+			key, err := strconv.Unquote(s[:i+1])
+			return key, s[i+1:], err
+		}
+	}
+	return "", "", errors.New("unclosed quote")
+}
+
+func (path Path) String() string {
+	var b strings.Builder
+	for i, elem := range path {
+		if !elem.isIndex && !elem.wildcard && isPathName(elem.name) {
+			if i > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(elem.name)
+			continue
+		}
+		b.WriteString(elem.String())
+	}
+	return b.String()
+}
+
+func isPathName(name string) bool {
+	return name != "" && name != "*" && !strings.ContainsAny(name, ".[]\"' \t\r\n")
+}
+
+//Get returns all values selected by the path, in document order
+func (path Path) Get(root *Value) []*Value {
+	current := []*Value{root}
+	for _, elem := range path {
+		next := make([]*Value, 0, len(current))
+		for _, v := range current {
+			next = elem.children(v, next)
+		}
+		current = next
+	}
+	return current
+}
+
+//Set replaces the values selected by the path. A missing last member is
+//added to dynamic objects, arrays and dictionaries, and an index equal to the
+//length appends to arrays and vectors.
+func (path Path) Set(root *Value, value *Value) error {
+	if len(path) == 0 {
+		return errors.New("can't set the root of a document")
+	}
+
+	parents := path[:len(path)-1].Get(root)
+	if len(parents) == 0 {
+		return errors.New("path:" + path.String() + " not found")
+	}
+
+	last := path[len(path)-1]
+	for _, parent := range parents {
+		err := last.set(parent, value)
+		if err != nil {
+			return errors.New(err.Error() + " in path:" + path.String())
+		}
+	}
+
+	return nil
+}
+
+//Delete removes the values selected by the path and returns how many were
+//removed. Sealed members of typed objects can't be removed.
+func (path Path) Delete(root *Value) (int, error) {
+	if len(path) == 0 {
+		return 0, errors.New("can't delete the root of a document")
+	}
+
+	last := path[len(path)-1]
+	count := 0
+	for _, parent := range path[:len(path)-1].Get(root) {
+		n, err := last.remove(parent)
+		count += n
+		if err != nil {
+			return count, errors.New(err.Error() + " in path:" + path.String())
+		}
+	}
+
+	return count, nil
+}
+
+func (elem pathElem) children(v *Value, out []*Value) []*Value {
+	if v == nil {
+		return out
+	}
+
+	switch v.Kind {
+	case KindArray:
+		switch {
+		case elem.wildcard:
+			out = append(out, v.Elements...)
+			for _, m := range v.Members {
+				out = append(out, m.Value)
+			}
+		case elem.isIndex:
+			if elem.index < len(v.Elements) {
+				out = append(out, v.Elements[elem.index])
+			}
+		default:
+			if i := memberIndex(v.Members, elem.name); i >= 0 {
+				out = append(out, v.Members[i].Value)
+			}
+		}
+	case KindVector:
+		switch {
+		case elem.wildcard:
+			out = append(out, v.Elements...)
+		case elem.isIndex:
+			if elem.index < len(v.Elements) {
+				out = append(out, v.Elements[elem.index])
+			}
+		}
+	case KindObject:
+		switch {
+		case elem.wildcard:
+			out = append(out, v.Sealed...)
+			for _, m := range v.Members {
+				out = append(out, m.Value)
+			}
+		case !elem.isIndex:
+			if m, ok := v.Member(elem.name); ok {
+				out = append(out, m)
+			}
+		}
+	case KindDictionary:
+		for _, e := range v.Entries {
+			if elem.wildcard || elem.matchKey(e.Key) {
+				out = append(out, e.Value)
+			}
+		}
+	}
+
+	return out
+}
+
+func (elem pathElem) matchKey(key *Value) bool {
+	if key == nil {
+		return false
+	}
+
+	switch key.Kind {
+	case KindString:
+		if elem.isIndex {
+			return key.Str == strconv.Itoa(elem.index)
+		}
+		return key.Str == elem.name
+	case KindInteger:
+		return elem.isIndex && key.Int == int64(elem.index)
+	case KindDouble:
+		return elem.isIndex && key.Float == float64(elem.index)
+	}
+
+	return false
+}
+
+func memberIndex(members []Member, key string) int {
+	for i, m := range members {
+		if m.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (elem pathElem) set(parent *Value, value *Value) error {
+	if parent == nil {
+		return errors.New("can't set member of nil")
+	}
+
+	switch parent.Kind {
+	case KindArray, KindVector:
+		switch {
+		case elem.wildcard:
+			for i := range parent.Elements {
+				parent.Elements[i] = value
+			}
+			for i := range parent.Members {
+				parent.Members[i].Value = value
+			}
+		case elem.isIndex:
+			switch {
+			case elem.index < len(parent.Elements):
+				parent.Elements[elem.index] = value
+			case elem.index == len(parent.Elements) && !parent.Fixed:
+				parent.Elements = append(parent.Elements, value)
+			default:
+				return errors.New("index:" + strconv.Itoa(elem.index) + " out of range")
+			}
+		case parent.Kind == KindVector:
+			return errors.New("key:" + elem.name + " not allowed in vector")
+		default:
+			if i := memberIndex(parent.Members, elem.name); i >= 0 {
+				parent.Members[i].Value = value
+			} else {
+				parent.Members = append(parent.Members, Member{elem.name, value})
+			}
+		}
+	case KindObject:
+		if elem.isIndex {
+			return errors.New("index:" + strconv.Itoa(elem.index) + " not allowed in object")
+		}
+
+		if elem.wildcard {
+			for i := range parent.Sealed {
+				parent.Sealed[i] = value
+			}
+			for i := range parent.Members {
+				parent.Members[i].Value = value
+			}
+			return nil
+		}
+
+		if parent.Traits != nil {
+			for i, name := range parent.Traits.Members {
+				if name == elem.name && i < len(parent.Sealed) {
+					parent.Sealed[i] = value
+					return nil
+				}
+			}
+		}
+
+		if i := memberIndex(parent.Members, elem.name); i >= 0 {
+			parent.Members[i].Value = value
+			return nil
+		}
+
+		if parent.Traits != nil && !parent.Traits.Dynamic {
+			return errors.New("key:" + elem.name + " not found in sealed class:" + parent.Traits.Class)
+		}
+		parent.Members = append(parent.Members, Member{elem.name, value})
+	case KindDictionary:
+		found := false
+		for i, e := range parent.Entries {
+			if elem.wildcard || elem.matchKey(e.Key) {
+				parent.Entries[i].Value = value
+				found = true
+			}
+		}
+
+		if !found && !elem.wildcard {
+			key := NewString(elem.name)
+			if elem.isIndex {
+				key = NewInteger(int32(elem.index))
+			}
+			parent.Entries = append(parent.Entries, Entry{key, value})
+		}
+	default:
+		return errors.New("can't set member of " + parent.Kind.String())
+	}
+
+	return nil
+}
+
+func (elem pathElem) remove(parent *Value) (int, error) {
+	if parent == nil {
+		return 0, nil
+	}
+
+	switch parent.Kind {
+	case KindArray, KindVector:
+		if parent.Fixed && (elem.wildcard || elem.isIndex) {
+			return 0, errors.New("can't remove items of fixed vector")
+		}
+
+		switch {
+		case elem.wildcard:
+			n := len(parent.Elements) + len(parent.Members)
+			parent.Elements = parent.Elements[:0]
+			parent.Members = nil
+			return n, nil
+		case elem.isIndex:
+			if elem.index >= len(parent.Elements) {
+				return 0, nil
+			}
+			parent.Elements = append(parent.Elements[:elem.index], parent.Elements[elem.index+1:]...)
+			return 1, nil
+		}
+
+		if i := memberIndex(parent.Members, elem.name); i >= 0 {
+			parent.Members = append(parent.Members[:i], parent.Members[i+1:]...)
+			return 1, nil
+		}
+	case KindObject:
+		if elem.isIndex {
+			return 0, nil
+		}
+
+		if elem.wildcard {
+			if len(parent.Sealed) > 0 {
+				return 0, errors.New("can't remove sealed members of class:" + parent.Class())
+			}
+			n := len(parent.Members)
+			parent.Members = nil
+			return n, nil
+		}
+
+		if i := memberIndex(parent.Members, elem.name); i >= 0 {
+			parent.Members = append(parent.Members[:i], parent.Members[i+1:]...)
+			return 1, nil
+		}
+
+		if _, ok := parent.Member(elem.name); ok {
+			return 0, errors.New("can't remove sealed member:" + elem.name + " of class:" + parent.Class())
+		}
+	case KindDictionary:
+		entries := parent.Entries[:0]
+		for _, e := range parent.Entries {
+			if !elem.wildcard && !elem.matchKey(e.Key) {
+				entries = append(entries, e)
+			}
+		}
+		n := len(parent.Entries) - len(entries)
+		parent.Entries = entries
+		return n, nil
+	}
+
+	return 0, nil
+}
+
+//Get returns all values selected by the path expression
+func (value *Value) Get(expr string) ([]*Value, error) {
+	path, err := ParsePath(expr)
+	if err != nil {
+		return nil, err
+	}
+	return path.Get(value), nil
+}
+
+//Lookup returns the first value selected by the path expression
+func (value *Value) Lookup(expr string) (*Value, bool) {
+	values, err := value.Get(expr)
+	if err != nil || len(values) == 0 {
+		return nil, false
+	}
+	return values[0], true
+}
+
+//Set replaces the values selected by the path expression, see Path.Set
+func (value *Value) Set(expr string, v *Value) error {
+	path, err := ParsePath(expr)
+	if err != nil {
+		return err
+	}
+	return path.Set(value, v)
+}
+
+//Delete removes the values selected by the path expression, see Path.Delete
+func (value *Value) Delete(expr string) (int, error) {
+	path, err := ParsePath(expr)
+	if err != nil {
+		return 0, err
+	}
+	return path.Delete(value)
+}
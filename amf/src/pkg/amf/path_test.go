@@ -0,0 +1,190 @@
+package amf
+
+import (
+	"testing"
+)
+
+//pathDocument is
+//
+//	{"body": [{"uid": "a", "tags": ["x"]}, {"uid": "b"}, "k": "assoc"], "point": test.Point{x: 1, y: 2},
+//	 "dict": dictionary{"s": "string key", 3: "int key"}, "vec": vector[1, 2]}
+func pathDocument() *Value {
+	first := &Value{Kind: KindObject, Traits: &Traits{Dynamic: true}, Members: []Member{{Key: "uid", Value: NewString("a")}, {Key: "tags", Value: NewArray(NewString("x"))}}}
+	second := &Value{Kind: KindObject, Traits: &Traits{Dynamic: true}, Members: []Member{{Key: "uid", Value: NewString("b")}}}
+	body := NewArray(first, second)
+	body.Members = []Member{{Key: "k", Value: NewString("assoc")}}
+
+	root := &Value{Kind: KindObject, Traits: &Traits{Dynamic: true}}
+	root.Members = []Member{
+		{Key: "body", Value: body},
+		{Key: "point", Value: &Value{Kind: KindObject, Traits: &Traits{Class: "test.Point", Members: []string{"x", "y"}}, Sealed: []*Value{NewInteger(1), NewInteger(2)}}},
+		{Key: "dict", Value: &Value{Kind: KindDictionary, Entries: []Entry{{NewString("s"), NewString("string key")}, {NewInteger(3), NewString("int key")}}}},
+		{Key: "vec", Value: &Value{Kind: KindVector, VectorType: VECTOR_INT_MARKER, Fixed: true, Elements: []*Value{NewInteger(1), NewInteger(2)}}},
+	}
+	return root
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		expr, text string
+	}{
+		{"", ""},
+		{"body", "body"},
+		{"body[0].items[*].uid", "body[0].items[*].uid"},
+		{"body.*", "body[*]"},
+		{`headers["Credentials"].userid`, "headers.Credentials.userid"},
+		{`a["b.c"]`, `a["b.c"]`},
+		{`a['it\'s']`, `a["it's"]`},
+		{`a["x]y"]`, `a["x]y"]`},
+		{`["*"]`, `["*"]`},
+		{"[3][4]", "[3][4]"},
+	}
+	for _, test := range tests {
+		path, err := ParsePath(test.expr)
+		if err != nil || path.String() != test.text {
+			t.Errorf("%q parsed as %q, %v", test.expr, path, err)
+		}
+	}
+
+	for _, expr := range []string{".a", "a..b", "a[", "a[x]", "a[-1]", `a["b]`, `a["b"x]`, "a[1"} {
+		if _, err := ParsePath(expr); err == nil {
+			t.Errorf("%q parsed", expr)
+		}
+	}
+}
+
+func TestPathGet(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"", []string{`{"body": [{"uid": "a", "tags": ["x"]}, {"uid": "b"}, "k": "assoc"], "point": test.Point{x: 1, y: 2}, "dict": dictionary{"s": "string key", 3: "int key"}, "vec": vector[1, 2]}`}},
+		{"body[*].uid", []string{`"a"`, `"b"`}},
+		{"body[1].uid", []string{`"b"`}},
+		{"body.k", []string{`"assoc"`}},
+		{"body[*]", []string{`{"uid": "a", "tags": ["x"]}`, `{"uid": "b"}`, `"assoc"`}},
+		{"body[0].tags[0]", []string{`"x"`}},
+		{"body[2]", nil},
+		{"point.y", []string{"2"}},
+		{"point[*]", []string{"1", "2"}},
+		{"point[0]", nil},
+		{"dict.s", []string{`"string key"`}},
+		{"dict[3]", []string{`"int key"`}},
+		{"dict[*]", []string{`"string key"`, `"int key"`}},
+		{"vec[1]", []string{"2"}},
+		{"vec.length", nil},
+		{"missing.deeper", nil},
+		{"body[0].uid.deeper", nil},
+	}
+
+	root := pathDocument()
+	for _, test := range tests {
+		values, err := root.Get(test.expr)
+		if err != nil || len(values) != len(test.want) {
+			t.Errorf("%q: got %v, %v", test.expr, values, err)
+			continue
+		}
+		for i, value := range values {
+			if value.String() != test.want[i] {
+				t.Errorf("%q: got %v", test.expr, values)
+				break
+			}
+		}
+	}
+
+	if value, ok := root.Lookup("body[*].uid"); !ok || value.Str != "a" {
+		t.Errorf("looked up %v, %v", value, ok)
+	}
+	if _, ok := root.Lookup("nothing"); ok {
+		t.Error("looked up a missing member")
+	}
+	if _, err := root.Get("a["); err == nil {
+		t.Error("invalid path got")
+	}
+}
+
+func TestPathSet(t *testing.T) {
+	tests := []struct {
+		expr, check, want string
+	}{
+		{"body[0].uid", "body[*].uid", `"v" "b"`},
+		{"body[0].tags[*]", "body[0].tags[*]", `"v"`},
+		{"dict[*]", "dict[*]", `"v" "v"`},
+		{"body[2]", "body[2]", `"v"`},
+		{"body.k", "body.k", `"v"`},
+		{"body.new", "body.new", `"v"`},
+		{"point.x", "point[*]", `"v" 2`},
+		{"dict[3]", "dict[*]", `"string key" "v"`},
+		{"dict[4]", "dict[4]", `"v"`},
+		{"dict.t", "dict.t", `"v"`},
+		{"vec[0]", "vec[*]", `"v" 2`},
+		{"new", "new", `"v"`},
+	}
+	for _, test := range tests {
+		root := pathDocument()
+		err := root.Set(test.expr, NewString("v"))
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		if got := joinValues(root, test.check); got != test.want {
+			t.Errorf("%q: %s is %s", test.expr, test.check, got)
+		}
+	}
+
+	//the wildcard selects the string of the associative part too
+	errs := []string{"", "body[*].uid", "body[5]", "vec[2]", "vec.k", "point.z", "point[0]", "body[0].uid.x", "missing.x", "a["}
+	for _, expr := range errs {
+		if err := pathDocument().Set(expr, NewNull()); err == nil {
+			t.Errorf("%q set", expr)
+		}
+	}
+}
+
+func TestPathDelete(t *testing.T) {
+	tests := []struct {
+		expr  string
+		n     int
+		check string
+		want  string
+	}{
+		{"body[0]", 1, "body[*].uid", `"b"`},
+		{"body[*]", 3, "body[*]", ""},
+		{"body.k", 1, "body[*]", `{"uid": "a", "tags": ["x"]} {"uid": "b"}`},
+		{"body[*].uid", 2, "body[*].uid", ""},
+		{"body[5]", 0, "body[*].uid", `"a" "b"`},
+		{"dict[3]", 1, "dict[*]", `"string key"`},
+		{"dict[*]", 2, "dict[*]", ""},
+		{"missing", 0, "body[1].uid", `"b"`},
+		{"point[0]", 0, "point.x", "1"},
+	}
+	for _, test := range tests {
+		root := pathDocument()
+		n, err := root.Delete(test.expr)
+		if err != nil || n != test.n {
+			t.Errorf("%q: deleted %d, %v", test.expr, n, err)
+			continue
+		}
+		if got := joinValues(root, test.check); got != test.want {
+			t.Errorf("%q: %s is %s", test.expr, test.check, got)
+		}
+	}
+
+	for _, expr := range []string{"", "point.x", "point[*]", "vec[0]", "vec[*]", "a["} {
+		if _, err := pathDocument().Delete(expr); err == nil {
+			t.Errorf("%q deleted", expr)
+		}
+	}
+}
+
+func joinValues(root *Value, expr string) string {
+	values, _ := root.Get(expr)
+	text := ""
+	for i, value := range values {
+		if i > 0 {
+			text += " "
+		}
+		text += value.String()
+	}
+	return text
+}
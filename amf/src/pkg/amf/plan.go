@@ -0,0 +1,104 @@
+package amf
+
+import (
+	"reflect"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+//fieldPlan is a struct field that takes part in encoding and decoding
+type fieldPlan struct {
+	index      []int
+	name       string //key when the encoder is not reserv
+	reservName string //key when the encoder is reserv
+	isStruct   bool   //struct fields are encoded by address
+}
+
+//structPlan is computed once per struct type, so encoding and decoding don't
+//need to look at tags or names of fields again
+type structPlan struct {
+	fields []fieldPlan
+	keys   map[string]int //decoding key to index in fields
+}
+
+//structPlans caches the plans by type. Plans are never dropped, a program
+//making struct types at run time with reflect.StructOf keeps one per type.
+var structPlans sync.Map
+
+func getStructPlan(t reflect.Type) *structPlan {
+	if plan, ok := structPlans.Load(t); ok {
+		return plan.(*structPlan)
+	}
+
+	plan, _ := structPlans.LoadOrStore(t, newStructPlan(t))
+	return plan.(*structPlan)
+}
+
+func newStructPlan(t reflect.Type) *structPlan {
+	plan := new(structPlan)
+	plan.keys = make(map[string]int)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := getFieldName(f, false)
+		if name == "" {
+			continue
+		}
+
+		plan.fields = append(plan.fields, fieldPlan{
+			index:      f.Index,
+			name:       name,
+			reservName: getFieldName(f, true),
+			isStruct:   f.Type.Kind() == reflect.Struct,
+		})
+	}
+
+	//a key matches a field by its amf.name tag, its exact go name or its go
+	//name with the first rune lowered, like the decoder always did. When
+	//several fields match a key, the first one in the struct wins.
+	for i := len(plan.fields) - 1; i >= 0; i-- {
+		f := t.FieldByIndex(plan.fields[i].index)
+		plan.keys[f.Name] = i
+		plan.keys[lowerFirst(f.Name)] = i
+		if tag := f.Tag.Get("amf.name"); tag != "" {
+			plan.keys[tag] = i
+		}
+	}
+
+	return plan
+}
+
+//getFieldName returns the key of a struct field, or "" if it can't be accessed
+func getFieldName(f reflect.StructField, reservStruct bool) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+
+	name := f.Tag.Get("amf.name")
+	if name != "" {
+		return name
+	}
+
+	if !reservStruct {
+		return lowerFirst(f.Name)
+	}
+
+	return f.Name
+}
+
+func lowerFirst(name string) string {
+	r, size := utf8.DecodeRuneInString(name)
+	if !unicode.IsUpper(r) {
+		return name
+	}
+	return string(unicode.ToLower(r)) + name[size:]
+}
+
+func (plan *structPlan) field(key string) (*fieldPlan, bool) {
+	i, ok := plan.keys[key]
+	if !ok {
+		return nil, false
+	}
+	return &plan.fields[i], true
+}
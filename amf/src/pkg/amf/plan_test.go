@@ -0,0 +1,143 @@
+package amf
+
+import (
+	"reflect"
+	"testing"
+	"unicode"
+)
+
+//baselineField is the linear lookup the decoder did before plans, the plans
+//must match keys to the same fields
+func baselineField(key string, t reflect.Type) (string, bool) {
+	chars := []rune(key)
+	upperKey := key
+	if unicode.IsLower(chars[0]) {
+		chars[0] = unicode.ToUpper(chars[0])
+		upperKey = string(chars)
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Name == upperKey || f.Tag.Get("amf.name") == key {
+			return f.Name, true
+		}
+	}
+	return "", false
+}
+
+type planBase struct {
+	Base int
+}
+
+type planFields struct {
+	Name     string
+	Tagged   int `amf.name:"uid"`
+	Other    int `amf.name:"name"`
+	URL      string
+	Éclair   bool
+	hidden   int
+	Both     int
+	Second   int `amf.name:"both"`
+	planBase
+	Items []string
+}
+
+func TestStructPlanKeys(t *testing.T) {
+	tests := []struct {
+		key   string
+		field string
+	}{
+		{"name", "Name"},
+		{"Name", "Name"},
+		{"uid", "Tagged"},
+		{"tagged", "Tagged"},
+		{"Tagged", "Tagged"},
+		{"uRL", "URL"},
+		{"URL", "URL"},
+		{"éclair", "Éclair"},
+		{"both", "Both"},
+		{"second", "Second"},
+		{"planBase", ""},
+		{"base", ""},
+		{"items", "Items"},
+		{"hidden", ""},
+		{"url", ""},
+		{"missing", ""},
+	}
+
+	typ := reflect.TypeOf(planFields{})
+	plan := getStructPlan(typ)
+	if getStructPlan(typ) != plan {
+		t.Error("plan not cached")
+	}
+
+	for _, test := range tests {
+		var name string
+		if f, ok := plan.field(test.key); ok {
+			name = typ.FieldByIndex(f.index).Name
+		}
+		if name != test.field {
+			t.Errorf("key:%s matched field:%q, want %q", test.key, name, test.field)
+		}
+
+		baseline, _ := baselineField(test.key, typ)
+		if name != baseline {
+			t.Errorf("key:%s matched field:%q, the decoder used to match %q", test.key, name, baseline)
+		}
+	}
+}
+
+func TestStructPlanNames(t *testing.T) {
+	tests := []struct {
+		field      string
+		name       string
+		reservName string
+	}{
+		{"Name", "name", "Name"},
+		{"Tagged", "uid", "uid"},
+		{"URL", "uRL", "URL"},
+		{"Éclair", "éclair", "Éclair"},
+		{"Second", "both", "both"},
+	}
+
+	typ := reflect.TypeOf(planFields{})
+	plan := getStructPlan(typ)
+	for _, test := range tests {
+		found := false
+		for _, f := range plan.fields {
+			if typ.FieldByIndex(f.index).Name != test.field {
+				continue
+			}
+			found = true
+			if f.name != test.name || f.reservName != test.reservName {
+				t.Errorf("field:%s named %q/%q, want %q/%q", test.field, f.name, f.reservName, test.name, test.reservName)
+			}
+		}
+		if !found {
+			t.Errorf("field:%s not planned", test.field)
+		}
+	}
+
+	for _, f := range plan.fields {
+		if name := typ.FieldByIndex(f.index).Name; name == "hidden" || name == "planBase" {
+			t.Errorf("field:%s planned", name)
+		}
+	}
+}
+
+func TestStructPlanDecode(t *testing.T) {
+	data, err := Marshal(map[string]AMFAny{"name": "a", "uid": 3, "both": 5, "Second": 6, "items": []string{"x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded planFields
+	err = Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := planFields{Name: "a", Tagged: 3, Both: 5, Second: 6, Items: []string{"x"}}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("decoded %+v, want %+v", decoded, want)
+	}
+}
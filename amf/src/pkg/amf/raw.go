@@ -0,0 +1,209 @@
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strconv"
+)
+
+//RawValue is an encoded value kept as it is. Decoding into a RawValue copies
+//the bytes of the value instead of decoding them, together with the
+//reference tables they depend on, so it could be decoded later with Decode.
+//Encoding a RawValue writes the bytes unchanged when its references still
+//hold at that place of the output, otherwise the value is encoded again,
+//with the objects it references that were decoded into go values encoded
+//from these values.
+//A RawValue with nil Data is encoded as null.
+type RawValue struct {
+	Data []byte
+
+	strings []string
+	objects []reflect.Value
+	traits  []*Traits
+}
+
+var rawValueType = reflect.TypeOf(RawValue{})
+
+//rawRefs records the references met in a raw value, to the tables as they
+//were before it, or to entries added by the value itself
+type rawRefs struct {
+	strings int
+	objects int
+	traits  int
+	inner   bool
+	outer   bool
+}
+
+func (refs *rawRefs) add(index int, base int) {
+	if index < base {
+		refs.outer = true
+	} else {
+		refs.inner = true
+	}
+}
+
+//Skip reads the next value without decoding it, the reference tables are
+//kept up to date so the values after it are decoded as usual
+func (decoder *Decoder) Skip() error {
+	if len(decoder.tokens) > 0 {
+		err := decoder.tokenValue()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := decoder.peekMarker()
+	if err != nil {
+		return err
+	}
+
+	decoder.startValue()
+	marker, err := decoder.readMarker()
+	if err != nil {
+		return err
+	}
+
+	offset := decoder.offset - 1
+	err = decoder.skip(marker)
+	if err != nil {
+		return topPath(decodeError(err, offset, marker, nil))
+	}
+	return nil
+}
+
+//skip reads the value after marker as tokens, which only fill the reference
+//tables
+func (decoder *Decoder) skip(marker byte) error {
+	depth := len(decoder.tokens)
+	_, err := decoder.readMarkedToken(marker)
+	for err == nil && len(decoder.tokens) > depth {
+		_, err = decoder.Token()
+	}
+
+	if err != nil {
+		decoder.tokens = decoder.tokens[:depth]
+	}
+	return err
+}
+
+//readRaw copies the value after marker into value, a RawValue
+func (decoder *Decoder) readRaw(marker byte, value reflect.Value) error {
+	refs := &rawRefs{
+		strings: len(decoder.stringCache),
+		objects: len(decoder.objectCache),
+		traits:  len(decoder.traitsCache),
+	}
+	raw := RawValue{
+		strings: decoder.stringCache[:refs.strings:refs.strings],
+		objects: decoder.objectCache[:refs.objects:refs.objects],
+		traits:  decoder.traitsCache[:refs.traits:refs.traits],
+	}
+
+	decoder.refs = refs
+	decoder.capture = append(decoder.capture[:0], marker)
+	decoder.capturing = true
+	err := decoder.skip(marker)
+	decoder.capturing = false
+	decoder.refs = nil
+	if err != nil {
+		return err
+	}
+
+	raw.Data = bytes.Clone(decoder.capture)
+	value.Set(reflect.ValueOf(raw))
+	return nil
+}
+
+//decoder returns a decoder of the data with the reference tables of the
+//place it was read from
+func (raw *RawValue) decoder(opts []DecoderOption) (*Decoder, *bytes.Reader) {
+	reader := bytes.NewReader(raw.Data)
+	decoder := NewDecoder(reader, opts...)
+	decoder.stringCache = raw.strings
+	decoder.objectCache = raw.objects
+	decoder.traitsCache = raw.traits
+	return decoder, reader
+}
+
+//Decode decodes the raw value into value, like Unmarshal
+func (raw *RawValue) Decode(value AMFAny, opts ...DecoderOption) error {
+	decoder, reader := raw.decoder(opts)
+	err := decoder.Decode(value)
+	if err != nil {
+		return err
+	}
+
+	if reader.Len() != 0 {
+		return errors.New(strconv.Itoa(reader.Len()) + " bytes left after value")
+	}
+
+	return nil
+}
+
+func (encoder *Encoder) writeRaw(raw *RawValue) error {
+	if raw.Data == nil {
+		return encoder.encodeNull()
+	}
+
+	decoder, reader := raw.decoder(nil)
+	refs := &rawRefs{strings: len(raw.strings), objects: len(raw.objects), traits: len(raw.traits)}
+	decoder.refs = refs
+	err := decoder.Skip()
+	if err != nil {
+		return err
+	}
+
+	if reader.Len() != 0 {
+		return errors.New(strconv.Itoa(reader.Len()) + " bytes left after raw value")
+	}
+
+	//references into the tables as they were at the place the value was read
+	//don't hold here, nor do references to its own entries if the tables of
+	//the encoder have another size
+	if refs.outer || refs.inner && (refs.strings != encoder.stringCount || refs.objects != encoder.objectCount || refs.traits != encoder.traitsCount) {
+		decoder, _ = raw.decoder(nil)
+		decoder.documentOf = encoder.rawDocument
+		value, err := decoder.ReadValue()
+		if err != nil {
+			return err
+		}
+		return encoder.writeValue(value)
+	}
+
+	for _, s := range decoder.stringCache[refs.strings:] {
+		if _, ok := encoder.stringCache[s]; !ok {
+			encoder.stringCache[s] = encoder.stringCount
+		}
+		encoder.stringCount++
+	}
+	encoder.objectCount += len(decoder.objectCache) - refs.objects
+	encoder.traitsCount += len(decoder.traitsCache) - refs.traits
+
+	return encoder.writeBytes(raw.Data)
+}
+
+//maxRawNesting stops raw values whose references lead back to themselves
+const maxRawNesting = 32
+
+//rawDocument turns an object decoded into a go value back into a document,
+//encoding it like the encoder does
+func (encoder *Encoder) rawDocument(object reflect.Value) (*Value, error) {
+	if encoder.rawNesting >= maxRawNesting {
+		return nil, errors.New("raw value references itself")
+	}
+
+	if object.Kind() == reflect.Struct {
+		ptr := reflect.New(object.Type())
+		ptr.Elem().Set(object)
+		object = ptr
+	}
+
+	converter := NewEncoder(nil, encoder.reservStruct)
+	converter.rawNesting = encoder.rawNesting + 1
+	err := converter.encode(object)
+	if err != nil {
+		return nil, err
+	}
+	return NewDecoder(bytes.NewReader(converter.buffer)).ReadValue()
+}
@@ -0,0 +1,194 @@
+package amf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type rawItem struct {
+	Name string
+	Tags []string
+}
+
+type rawEnvelope struct {
+	Target string
+	Body   RawValue
+	After  string
+}
+
+func TestRawValue(t *testing.T) {
+	in := &struct {
+		Target string
+		Body   []*rawItem
+		After  string
+	}{"svc", []*rawItem{{"a", []string{"svc", "x"}}, {"a", []string{"x"}}}, "x"}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var envelope rawEnvelope
+	err = Unmarshal(data, &envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Target != "svc" || envelope.After != "x" {
+		t.Errorf("decoded %+v", envelope)
+	}
+
+	var items []*rawItem
+	err = envelope.Body.Decode(&items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(items, in.Body) {
+		t.Errorf("body decoded %+v", items)
+	}
+
+	//in its place the raw value is written as it is
+	out, err := Marshal(&envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("written % x, want % x", out, data)
+	}
+
+	//alone its reference to "svc" doesn't hold, it is encoded again
+	out, err = Marshal(&envelope.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items = nil
+	err = Unmarshal(out, &items)
+	if err != nil || !reflect.DeepEqual(items, in.Body) {
+		t.Errorf("body written alone decoded %+v, %v", items, err)
+	}
+
+	var null RawValue
+	out, err = Marshal(&null)
+	if err != nil || !bytes.Equal(out, []byte{NULL_MARKER}) {
+		t.Errorf("nil raw value written % x, %v", out, err)
+	}
+}
+
+type rawOwner struct {
+	Name string
+}
+
+type rawHolder struct {
+	Owner *rawOwner
+	Tags  []string
+	Data  []byte
+	Stamp time.Time
+	Body  RawValue
+}
+
+//TestRawValueGoReferences checks a raw value referencing objects decoded
+//into go values, which can't be read as documents
+func TestRawValueGoReferences(t *testing.T) {
+	stamp := time.UnixMilli(1700000000000).UTC()
+	owner := NewObject("")
+	owner.Members = []Member{{"name", NewString("ann")}}
+	tags := NewArray(NewString("red"))
+	data := NewByteArray([]byte{1, 2})
+	date := NewDate(stamp)
+	holder := NewObject("")
+	holder.Members = []Member{
+		{"owner", owner},
+		{"tags", tags},
+		{"data", data},
+		{"stamp", date},
+		{"body", NewArray(owner, tags, data, date, NewString("x"))},
+	}
+	encoded, err := Marshal(holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded rawHolder
+	err = Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := Marshal(&decoded.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := UnmarshalAs[*Value](out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := NewArray(owner, NewArray(NewString("red")), NewByteArray([]byte{1, 2}), NewDate(stamp), NewString("x"))
+	wantBytes, _ := Marshal(want)
+	gotBytes, _ := Marshal(body)
+	if !bytes.Equal(gotBytes, wantBytes) {
+		t.Errorf("body written alone as %v", body)
+	}
+
+	//written in another place of an output the references don't hold either
+	out, err = Marshal([]AMFAny{"first", &decoded.Body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again []*Value
+	err = Unmarshal(out, &again)
+	if err != nil || len(again) != 2 {
+		t.Fatalf("decoded %v, %v", again, err)
+	}
+	gotBytes, _ = Marshal(again[1])
+	if !bytes.Equal(gotBytes, wantBytes) {
+		t.Errorf("body written in an array as %v", again[1])
+	}
+}
+
+func TestRawValueSelfReference(t *testing.T) {
+	holder := NewObject("")
+	holder.Members = []Member{{"owner", NewObject("")}, {"body", NewArray()}}
+	holder.Members[1].Value.Elements = []*Value{holder}
+	encoded, err := Marshal(holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded rawHolder
+	err = Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Marshal(&decoded.Body)
+	if err == nil {
+		t.Error("raw value referencing the struct holding it written")
+	}
+}
+
+func TestSkip(t *testing.T) {
+	//the second value references strings of the skipped one
+	var buffer bytes.Buffer
+	encoder := NewEncoder(&buffer, false)
+	err := encoder.Encode(&rawItem{Name: "a", Tags: []string{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = encoder.Encode([]string{"b", "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder(bytes.NewReader(buffer.Bytes()))
+	err = decoder.Skip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var second []string
+	err = decoder.Decode(&second)
+	if err != nil || !reflect.DeepEqual(second, []string{"b", "a"}) {
+		t.Errorf("decoded %v, %v after skip", second, err)
+	}
+	if err = decoder.Skip(); err == nil {
+		t.Error("skipped past the end")
+	}
+}
@@ -0,0 +1,123 @@
+package amf
+
+import (
+	"errors"
+)
+
+//Scope is how long the entries of the reference tables live. Values may
+//only refer to strings, objects and traits met before in the same scope.
+type Scope int
+
+const (
+	//SessionScope keeps the tables until Reset, like a connection whose peer
+	//keeps them too, e.g. RTMP shared objects. It is the default.
+	SessionScope Scope = iota
+	//ValueScope clears the tables before each top level value
+	ValueScope
+	//MessageScope clears the tables at the end of each message, see EndMessage
+	MessageScope
+)
+
+func (scope Scope) String() string {
+	switch scope {
+	case SessionScope:
+		return "session"
+	case ValueScope:
+		return "value"
+	case MessageScope:
+		return "message"
+	}
+	return "unknown"
+}
+
+//TableStats are the sizes of the reference tables
+type TableStats struct {
+	Strings int
+	Objects int
+	Traits  int
+
+	MaxStrings int //largest size of the tables since created
+	MaxObjects int
+	MaxTraits  int
+	Resets     int //times the tables were cleared, by Reset too
+}
+
+//EncodeScope sets how long the reference tables of the encoder live
+func EncodeScope(scope Scope) EncoderOption {
+	return func(encoder *Encoder) {
+		encoder.scope = scope
+	}
+}
+
+//DecodeScope sets how long the reference tables of the decoder live, which
+//must match the scope of the encoder of the input
+func DecodeScope(scope Scope) DecoderOption {
+	return func(decoder *Decoder) {
+		decoder.scope = scope
+	}
+}
+
+//EndMessage marks the end of a message, the tables are cleared if the scope
+//is MessageScope
+func (encoder *Encoder) EndMessage() error {
+	if len(encoder.stream) > 0 || encoder.depth > 0 {
+		return errors.New("message ended inside a value")
+	}
+
+	if encoder.scope == MessageScope {
+		encoder.resetTables()
+	}
+	return nil
+}
+
+//EndMessage marks the end of a message, the tables are cleared if the scope
+//is MessageScope
+func (decoder *Decoder) EndMessage() error {
+	if len(decoder.tokens) > 0 || decoder.depth > 0 {
+		return errors.New("message ended inside a value")
+	}
+
+	if decoder.scope == MessageScope {
+		decoder.resetTables()
+	}
+	return nil
+}
+
+//Stats returns the sizes of the reference tables
+func (encoder *Encoder) Stats() TableStats {
+	stats := encoder.stats
+	stats.Strings = encoder.stringCount
+	stats.Objects = encoder.objectCount
+	stats.Traits = encoder.traitsCount
+	stats.record(stats.Strings, stats.Objects, stats.Traits)
+	return stats
+}
+
+//Stats returns the sizes of the reference tables
+func (decoder *Decoder) Stats() TableStats {
+	stats := decoder.stats
+	stats.Strings = len(decoder.stringCache)
+	stats.Objects = len(decoder.objectCache)
+	stats.Traits = len(decoder.traitsCache)
+	stats.record(stats.Strings, stats.Objects, stats.Traits)
+	return stats
+}
+
+func (stats *TableStats) record(strings, objects, traits int) {
+	stats.MaxStrings = max(stats.MaxStrings, strings)
+	stats.MaxObjects = max(stats.MaxObjects, objects)
+	stats.MaxTraits = max(stats.MaxTraits, traits)
+}
+
+//startValue clears the tables before a top level value in ValueScope
+func (encoder *Encoder) startValue() {
+	if encoder.scope == ValueScope && encoder.depth == 0 && len(encoder.stream) == 0 {
+		encoder.resetTables()
+	}
+}
+
+func (decoder *Decoder) startValue() {
+	if decoder.scope == ValueScope && decoder.depth == 0 && len(decoder.tokens) == 0 {
+		decoder.resetTables()
+	}
+}
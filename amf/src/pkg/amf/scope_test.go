@@ -0,0 +1,84 @@
+package amf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestScopes(t *testing.T) {
+	full := []byte{STRING_MARKER, 0x0b, 'h', 'e', 'l', 'l', 'o'}
+	ref := []byte{STRING_MARKER, 0x00}
+	tests := []struct {
+		scope  Scope
+		values [][]byte //encodings of the three values, a message ends after the second one
+		resets int
+	}{
+		{SessionScope, [][]byte{full, ref, ref}, 0},
+		{ValueScope, [][]byte{full, full, full}, 3},
+		{MessageScope, [][]byte{full, ref, full}, 1},
+	}
+
+	for _, test := range tests {
+		var buffer bytes.Buffer
+		encoder := NewEncoder(&buffer, false, EncodeScope(test.scope))
+		for i := 0; i < 3; i++ {
+			err := encoder.Encode("hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 1 {
+				encoder.EndMessage()
+			}
+		}
+
+		want := bytes.Join(test.values, nil)
+		if !bytes.Equal(buffer.Bytes(), want) {
+			t.Errorf("%v: encoded % x, want % x", test.scope, buffer.Bytes(), want)
+		}
+		if stats := encoder.Stats(); stats.Resets != test.resets || stats.MaxStrings != 1 {
+			t.Errorf("%v: encoder stats %+v", test.scope, stats)
+		}
+
+		decoder := NewDecoder(bytes.NewReader(want), DecodeScope(test.scope))
+		for i := 0; i < 3; i++ {
+			var s string
+			err := decoder.Decode(&s)
+			if err != nil || s != "hello" {
+				t.Errorf("%v: value %d decoded %q, %v", test.scope, i, s, err)
+			}
+			if i == 1 {
+				decoder.EndMessage()
+			}
+		}
+		if stats := decoder.Stats(); stats.Resets != test.resets || stats.MaxStrings != 1 {
+			t.Errorf("%v: decoder stats %+v", test.scope, stats)
+		}
+
+		//a decoder clearing its tables more often than the encoder fails on
+		//references across the values
+		if test.scope != ValueScope {
+			decoder = NewDecoder(bytes.NewReader(want), DecodeScope(ValueScope))
+			var first, second string
+			decoder.Decode(&first)
+			err := decoder.Decode(&second)
+			if err == nil {
+				t.Errorf("%v: decoded a reference across values in value scope", test.scope)
+			}
+		}
+	}
+}
+
+func TestEndMessageInsideValue(t *testing.T) {
+	encoder := NewEncoder(&bytes.Buffer{}, false, EncodeScope(MessageScope))
+	encoder.BeginArray(1)
+	if err := encoder.EndMessage(); err == nil {
+		t.Error("message ended inside a stream")
+	}
+
+	data, _ := Marshal([]string{"a"})
+	decoder := NewDecoder(bytes.NewReader(data), DecodeScope(MessageScope))
+	decoder.Token()
+	if err := decoder.EndMessage(); err == nil {
+		t.Error("message ended inside tokens")
+	}
+}
@@ -0,0 +1,529 @@
+package amf
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//Selector filters the messages of a subscription by their headers, like the
+//selectors of flex consumers, a subset of SQL 92: comparisons, AND, OR,
+//NOT, IS [NOT] NULL, [NOT] IN, [NOT] LIKE and [NOT] BETWEEN
+type Selector struct {
+	text string
+	expr selectorExpr
+}
+
+//maxSelectorLength and maxSelectorDepth keep selectors sent by clients from
+//using up memory and the stack
+const (
+	maxSelectorLength = 4096
+	maxSelectorDepth  = 100
+)
+
+//ParseSelector parses a selector, "" selects every message. Selectors are
+//limited to 4096 bytes and 100 nested parentheses or NOTs.
+func ParseSelector(text string) (*Selector, error) {
+	selector := &Selector{text: text}
+	if strings.TrimSpace(text) == "" {
+		return selector, nil
+	}
+	if len(text) > maxSelectorLength {
+		return nil, errors.New("selector longer than:" + strconv.Itoa(maxSelectorLength))
+	}
+
+	parser := &selectorParser{}
+	err := parser.tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+
+	selector.expr, err = parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, errors.New("unexpected:" + parser.tokens[parser.pos].text + " in selector")
+	}
+	return selector, nil
+}
+
+func (selector *Selector) String() string {
+	return selector.text
+}
+
+//Match tells whether the headers of a message are selected, headers missing
+//are null and a comparison with null is never true
+func (selector *Selector) Match(headers map[string]AMFAny) bool {
+	if selector == nil || selector.expr == nil {
+		return true
+	}
+	return selector.expr.eval(headers) == true
+}
+
+//selectorExpr evaluates to a bool, a float64, a string or nil for unknown
+type selectorExpr interface {
+	eval(headers map[string]AMFAny) AMFAny
+}
+
+type selectorLiteral struct {
+	value AMFAny
+}
+
+type selectorIdent struct {
+	name string
+}
+
+type selectorNot struct {
+	x selectorExpr
+}
+
+type selectorLogic struct {
+	and  bool
+	x, y selectorExpr
+}
+
+type selectorCompare struct {
+	op   string
+	x, y selectorExpr
+}
+
+type selectorIsNull struct {
+	x   selectorExpr
+	not bool
+}
+
+type selectorIn struct {
+	x    selectorExpr
+	list []selectorExpr
+	not  bool
+}
+
+type selectorLike struct {
+	x       selectorExpr
+	pattern *regexp.Regexp
+	not     bool
+}
+
+type selectorBetween struct {
+	x, low, high selectorExpr
+	not          bool
+}
+
+func (expr selectorLiteral) eval(headers map[string]AMFAny) AMFAny {
+	return expr.value
+}
+
+func (expr selectorIdent) eval(headers map[string]AMFAny) AMFAny {
+	return selectorValue(headers[expr.name])
+}
+
+func (expr selectorNot) eval(headers map[string]AMFAny) AMFAny {
+	if b, ok := expr.x.eval(headers).(bool); ok {
+		return !b
+	}
+	return nil
+}
+
+func (expr selectorLogic) eval(headers map[string]AMFAny) AMFAny {
+	x, xok := expr.x.eval(headers).(bool)
+	if xok && x != expr.and {
+		return x
+	}
+	y, yok := expr.y.eval(headers).(bool)
+	if yok && y != expr.and {
+		return y
+	}
+	if xok && yok {
+		return expr.and
+	}
+	return nil
+}
+
+func (expr selectorCompare) eval(headers map[string]AMFAny) AMFAny {
+	return compareSelector(expr.op, expr.x.eval(headers), expr.y.eval(headers))
+}
+
+func (expr selectorIsNull) eval(headers map[string]AMFAny) AMFAny {
+	return (expr.x.eval(headers) == nil) != expr.not
+}
+
+func (expr selectorIn) eval(headers map[string]AMFAny) AMFAny {
+	x := expr.x.eval(headers)
+	if x == nil {
+		return nil
+	}
+	for _, e := range expr.list {
+		if compareSelector("=", x, e.eval(headers)) == true {
+			return !expr.not
+		}
+	}
+	return expr.not
+}
+
+func (expr selectorLike) eval(headers map[string]AMFAny) AMFAny {
+	s, ok := expr.x.eval(headers).(string)
+	if !ok {
+		return nil
+	}
+	return expr.pattern.MatchString(s) != expr.not
+}
+
+func (expr selectorBetween) eval(headers map[string]AMFAny) AMFAny {
+	x := expr.x.eval(headers)
+	low := compareSelector(">=", x, expr.low.eval(headers))
+	high := compareSelector("<=", x, expr.high.eval(headers))
+	if low == nil || high == nil {
+		return nil
+	}
+	return (low == true && high == true) != expr.not
+}
+
+//selectorValue turns the value of a header into a float64, a string, a bool
+//or nil
+func selectorValue(value AMFAny) AMFAny {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return v.Bool()
+	}
+	return nil
+}
+
+func compareSelector(op string, x, y AMFAny) AMFAny {
+	if x == nil || y == nil {
+		return nil
+	}
+
+	var c int
+	switch xv := x.(type) {
+	case float64:
+		yv, ok := y.(float64)
+		if !ok {
+			return nil
+		}
+		switch {
+		case xv < yv:
+			c = -1
+		case xv > yv:
+			c = 1
+		}
+	case string:
+		yv, ok := y.(string)
+		if !ok {
+			return nil
+		}
+		c = strings.Compare(xv, yv)
+	case bool:
+		yv, ok := y.(bool)
+		if !ok || op != "=" && op != "<>" {
+			return nil
+		}
+		if xv != yv {
+			c = 1
+		}
+	default:
+		return nil
+	}
+
+	switch op {
+	case "=":
+		return c == 0
+	case "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+type selectorToken struct {
+	kind byte //'i' identifier or keyword, 'n' number, 's' string, 'o' operator
+	text string
+}
+
+type selectorParser struct {
+	tokens []selectorToken
+	pos    int
+	depth  int
+}
+
+func (parser *selectorParser) tokenize(text string) error {
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'':
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(text) {
+					return errors.New("unterminated string in selector")
+				}
+				if text[i] == '\'' {
+					if i+1 < len(text) && text[i+1] == '\'' {
+						b.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(text[i])
+				i++
+			}
+			parser.tokens = append(parser.tokens, selectorToken{'s', b.String()})
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(text) && (text[j] >= '0' && text[j] <= '9' || text[j] == '.' || text[j] == 'e' || text[j] == 'E') {
+				j++
+			}
+			parser.tokens = append(parser.tokens, selectorToken{'n', text[i:j]})
+			i = j
+		case c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(text) && (text[j] == '_' || text[j] == '$' || text[j] == '.' || text[j] >= 'a' && text[j] <= 'z' || text[j] >= 'A' && text[j] <= 'Z' || text[j] >= '0' && text[j] <= '9') {
+				j++
+			}
+			parser.tokens = append(parser.tokens, selectorToken{'i', text[i:j]})
+			i = j
+		case strings.HasPrefix(text[i:], "<>") || strings.HasPrefix(text[i:], "<=") || strings.HasPrefix(text[i:], ">="):
+			parser.tokens = append(parser.tokens, selectorToken{'o', text[i : i+2]})
+			i += 2
+		case strings.IndexByte("=<>(),-", c) >= 0:
+			parser.tokens = append(parser.tokens, selectorToken{'o', text[i : i+1]})
+			i++
+		default:
+			return errors.New("unexpected character:" + string(c) + " in selector")
+		}
+	}
+	return nil
+}
+
+func (parser *selectorParser) peek() selectorToken {
+	if parser.pos < len(parser.tokens) {
+		return parser.tokens[parser.pos]
+	}
+	return selectorToken{}
+}
+
+//keyword consumes the next token if it is the keyword
+func (parser *selectorParser) keyword(word string) bool {
+	token := parser.peek()
+	if token.kind == 'i' && strings.EqualFold(token.text, word) {
+		parser.pos++
+		return true
+	}
+	return false
+}
+
+//operator consumes the next token if it is the operator
+func (parser *selectorParser) operator(op string) bool {
+	token := parser.peek()
+	if token.kind == 'o' && token.text == op {
+		parser.pos++
+		return true
+	}
+	return false
+}
+
+func (parser *selectorParser) parseOr() (selectorExpr, error) {
+	x, err := parser.parseAnd()
+	for err == nil && parser.keyword("OR") {
+		var y selectorExpr
+		y, err = parser.parseAnd()
+		x = selectorLogic{and: false, x: x, y: y}
+	}
+	return x, err
+}
+
+func (parser *selectorParser) parseAnd() (selectorExpr, error) {
+	x, err := parser.parseNot()
+	for err == nil && parser.keyword("AND") {
+		var y selectorExpr
+		y, err = parser.parseNot()
+		x = selectorLogic{and: true, x: x, y: y}
+	}
+	return x, err
+}
+
+//parseNot is on the path of every nested expression, it counts the depth
+func (parser *selectorParser) parseNot() (selectorExpr, error) {
+	parser.depth++
+	defer func() { parser.depth-- }()
+	if parser.depth > maxSelectorDepth {
+		return nil, errors.New("selector nested deeper than:" + strconv.Itoa(maxSelectorDepth))
+	}
+
+	if parser.keyword("NOT") {
+		x, err := parser.parseNot()
+		return selectorNot{x}, err
+	}
+	return parser.parseCompare()
+}
+
+func (parser *selectorParser) parseCompare() (selectorExpr, error) {
+	x, err := parser.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range []string{"=", "<>", "<=", ">=", "<", ">"} {
+		if parser.operator(op) {
+			y, err := parser.parsePrimary()
+			return selectorCompare{op, x, y}, err
+		}
+	}
+
+	if parser.keyword("IS") {
+		not := parser.keyword("NOT")
+		if !parser.keyword("NULL") {
+			return nil, errors.New("NULL expected in selector")
+		}
+		return selectorIsNull{x, not}, nil
+	}
+
+	not := parser.keyword("NOT")
+	switch {
+	case parser.keyword("IN"):
+		if !parser.operator("(") {
+			return nil, errors.New("( expected after IN in selector")
+		}
+		in := selectorIn{x: x, not: not}
+		for {
+			e, err := parser.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			in.list = append(in.list, e)
+			if parser.operator(")") {
+				return in, nil
+			}
+			if !parser.operator(",") {
+				return nil, errors.New(", expected in IN of selector")
+			}
+		}
+	case parser.keyword("LIKE"):
+		token := parser.peek()
+		if token.kind != 's' {
+			return nil, errors.New("pattern expected after LIKE in selector")
+		}
+		parser.pos++
+		escape := ""
+		if parser.keyword("ESCAPE") {
+			if parser.peek().kind != 's' || len(parser.peek().text) != 1 {
+				return nil, errors.New("escape character expected in selector")
+			}
+			escape = parser.peek().text
+			parser.pos++
+		}
+		return selectorLike{x, likePattern(token.text, escape), not}, nil
+	case parser.keyword("BETWEEN"):
+		low, err := parser.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if !parser.keyword("AND") {
+			return nil, errors.New("AND expected in BETWEEN of selector")
+		}
+		high, err := parser.parsePrimary()
+		return selectorBetween{x, low, high, not}, err
+	}
+
+	if not {
+		return nil, errors.New("IN, LIKE or BETWEEN expected after NOT in selector")
+	}
+	return x, nil
+}
+
+func (parser *selectorParser) parsePrimary() (selectorExpr, error) {
+	token := parser.peek()
+	parser.pos++
+	switch token.kind {
+	case 's':
+		return selectorLiteral{token.text}, nil
+	case 'n':
+		f, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, errors.New("invalid number:" + token.text + " in selector")
+		}
+		return selectorLiteral{f}, nil
+	case 'i':
+		switch strings.ToUpper(token.text) {
+		case "TRUE":
+			return selectorLiteral{true}, nil
+		case "FALSE":
+			return selectorLiteral{false}, nil
+		case "NULL":
+			return selectorLiteral{nil}, nil
+		case "AND", "OR", "NOT", "IS", "IN", "LIKE", "BETWEEN", "ESCAPE":
+			return nil, errors.New("unexpected:" + token.text + " in selector")
+		}
+		return selectorIdent{token.text}, nil
+	case 'o':
+		switch token.text {
+		case "(":
+			x, err := parser.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !parser.operator(")") {
+				return nil, errors.New(") expected in selector")
+			}
+			return x, nil
+		case "-":
+			next := parser.peek()
+			if next.kind == 'n' {
+				parser.pos++
+				f, err := strconv.ParseFloat(next.text, 64)
+				if err != nil {
+					return nil, errors.New("invalid number:" + next.text + " in selector")
+				}
+				return selectorLiteral{-f}, nil
+			}
+		}
+		return nil, errors.New("unexpected:" + token.text + " in selector")
+	}
+	return nil, errors.New("unexpected end of selector")
+}
+
+//likePattern makes the regular expression of a LIKE pattern, % matches any
+//characters and _ one
+func likePattern(pattern, escape string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^(?s)")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case escape != "" && string(r) == escape:
+			escaped = true
+		case r == '%':
+			b.WriteString(".*")
+		case r == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
@@ -0,0 +1,99 @@
+package amf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelector(t *testing.T) {
+	headers := map[string]AMFAny{"prio": 7, "type": "news", "ok": true, "f": 1.5, "small": uint32(3)}
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"", true},
+		{"  ", true},
+		{"prio > 5 AND type = 'news'", true},
+		{"prio > 8 OR type <> 'news'", false},
+		{"NOT (prio < 5)", true},
+		{"not not prio = 7", true},
+		{"missing = 1", false},
+		{"NOT missing = 1", false},
+		{"missing = 1 OR prio = 7", true},
+		{"missing = 1 AND prio = 7", false},
+		{"missing IS NULL", true},
+		{"prio IS NOT NULL", true},
+		{"type IN ('a', 'news')", true},
+		{"type NOT IN ('a', 'news')", false},
+		{"missing NOT IN ('a')", false},
+		{"type LIKE 'ne%'", true},
+		{"type LIKE 'n_w_'", true},
+		{"type NOT LIKE '%x%'", true},
+		{"type LIKE 'n\\%' ESCAPE '\\'", false},
+		{"prio BETWEEN 1 AND 7", true},
+		{"prio NOT BETWEEN 1 AND 7", false},
+		{"ok = TRUE AND f >= -1.5", true},
+		{"small = 3 AND small < prio", true},
+		{"type = 'it''s'", false},
+		{"type = 7", false},
+		{"(prio = 7 OR ok = FALSE) AND (type = 'x' OR f = 1.5)", true},
+	}
+
+	for _, test := range tests {
+		selector, err := ParseSelector(test.text)
+		if err != nil {
+			t.Errorf("%q: %v", test.text, err)
+			continue
+		}
+		if selector.Match(headers) != test.want || selector.String() != test.text {
+			t.Errorf("%q: matched %v", test.text, !test.want)
+		}
+	}
+
+	var none *Selector
+	if !none.Match(headers) {
+		t.Error("nil selector didn't match")
+	}
+}
+
+func TestSelectorErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		err  string
+	}{
+		{"prio >", "unexpected end of selector"},
+		{"(a = 1", ") expected in selector"},
+		{"a = 'x", "unterminated string in selector"},
+		{"a NOT 1", "IN, LIKE or BETWEEN expected after NOT in selector"},
+		{"a = 1 b", "unexpected:b in selector"},
+		{"a IS 1", "NULL expected in selector"},
+		{"a IN 1", "( expected after IN in selector"},
+		{"a IN (1 2)", ", expected in IN of selector"},
+		{"a LIKE 1", "pattern expected after LIKE in selector"},
+		{"a BETWEEN 1 OR 2", "AND expected in BETWEEN of selector"},
+		{"a = 1..2", "invalid number:1..2 in selector"},
+		{"a = #", "unexpected character:# in selector"},
+		{"AND = 1", "unexpected:AND in selector"},
+		{strings.Repeat("(", 3000000), "selector longer than:4096"},
+		{strings.Repeat("(", 101) + "a = 1" + strings.Repeat(")", 101), "selector nested deeper than:100"},
+		{strings.Repeat("NOT ", 101) + "a = 1", "selector nested deeper than:100"},
+		{"a = " + strings.Repeat("(", 200), "selector nested deeper than:100"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseSelector(test.text)
+		if err == nil || err.Error() != test.err {
+			name := test.text
+			if len(name) > 20 {
+				name = name[:20] + "..."
+			}
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+
+	nested := strings.Repeat("(", 99) + "a = 1" + strings.Repeat(")", 99)
+	selector, err := ParseSelector(nested)
+	if err != nil || !selector.Match(map[string]AMFAny{"a": 1}) {
+		t.Errorf("99 parentheses: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package amf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+//ErrUnauthorized fails calls of methods registered with RequireAuth when the
+//context has no principal
+var ErrUnauthorized = errors.New("unauthorized")
+
+type principalKey struct{}
+
+//WithPrincipal returns a context carrying the authenticated principal
+func WithPrincipal(ctx context.Context, principal AMFAny) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+//PrincipalFrom returns the principal of the context, if any
+func PrincipalFrom(ctx context.Context) (AMFAny, bool) {
+	principal := ctx.Value(principalKey{})
+	return principal, principal != nil
+}
+
+type serviceConfig struct {
+	filter  func(name string) bool
+	methods map[string][]MethodOption
+}
+
+//ServiceOption configures a service, see RegisterService
+type ServiceOption func(*serviceConfig)
+
+//MethodFilter registers only the methods whose go name filter accepts
+func MethodFilter(filter func(name string) bool) ServiceOption {
+	return func(config *serviceConfig) {
+		config.filter = filter
+	}
+}
+
+//MethodOptions applies opts to the method of the given go name, or to all
+//methods of the service for "*"
+func MethodOptions(name string, opts ...MethodOption) ServiceOption {
+	return func(config *serviceConfig) {
+		config.methods[name] = append(config.methods[name], opts...)
+	}
+}
+
+//MethodOption configures a method of a service
+type MethodOption func(*serviceMethod)
+
+//CheckCall runs check before the method, an error fails the call
+func CheckCall(check func(ctx context.Context, call *Call) error) MethodOption {
+	return func(method *serviceMethod) {
+		method.checks = append(method.checks, check)
+	}
+}
+
+//RequireAuth fails calls with ErrUnauthorized if the context has no
+//principal, see WithPrincipal
+func RequireAuth() MethodOption {
+	return CheckCall(func(ctx context.Context, call *Call) error {
+		if _, ok := PrincipalFrom(ctx); !ok {
+			return ErrUnauthorized
+		}
+		return nil
+	})
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	callType    = reflect.TypeOf((*Call)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+//serviceMethod is a method of a registered receiver
+type serviceMethod struct {
+	target string
+	fn     reflect.Value
+	ctx    bool //the first parameter is a context.Context
+	call   bool //a *Call comes before the arguments
+	args   []reflect.Type
+	result bool //a value is returned
+	err    bool //an error is returned last
+	checks []func(ctx context.Context, call *Call) error
+}
+
+//RegisterService registers the exported methods of receiver, like net/rpc,
+//as the targets "name.Method" and "name.method". name defaults to the type
+//name of receiver. A method may take a context.Context and a *Call before
+//its arguments, which are decoded from the arguments of the call, and
+//return a result, an error, or both.
+func (gateway *Gateway) RegisterService(name string, receiver AMFAny, opts ...ServiceOption) error {
+	v := reflect.ValueOf(receiver)
+	if !v.IsValid() {
+		return errors.New("nil service receiver")
+	}
+
+	if name == "" {
+		name = reflect.Indirect(v).Type().Name()
+		if name == "" {
+			return errors.New("no service name for type:" + v.Type().String())
+		}
+	}
+
+	config := serviceConfig{methods: make(map[string][]MethodOption)}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	handlers := make(map[string]HandlerFunc)
+	t := v.Type()
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if !m.IsExported() || config.filter != nil && !config.filter(m.Name) {
+			continue
+		}
+
+		method, ok := newServiceMethod(name+"."+m.Name, v.Method(i))
+		if !ok {
+			continue
+		}
+
+		for _, opt := range config.methods["*"] {
+			opt(method)
+		}
+		for _, opt := range config.methods[m.Name] {
+			opt(method)
+		}
+
+		handlers[name+"."+m.Name] = method.handle
+		handlers[name+"."+lowerFirst(m.Name)] = method.handle
+	}
+
+	if len(handlers) == 0 {
+		return errors.New("type:" + t.String() + " has no exported methods of suitable type")
+	}
+
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	for target, handler := range handlers {
+		gateway.handlers[target] = handler
+	}
+	return nil
+}
+
+//newServiceMethod checks the signature of fn, variadic methods and methods
+//returning something else than a result and an error are not services
+func newServiceMethod(target string, fn reflect.Value) (*serviceMethod, bool) {
+	t := fn.Type()
+	if t.IsVariadic() {
+		return nil, false
+	}
+
+	method := &serviceMethod{target: target, fn: fn}
+	i := 0
+	if i < t.NumIn() && t.In(i) == contextType {
+		method.ctx = true
+		i++
+	}
+	if i < t.NumIn() && t.In(i) == callType {
+		method.call = true
+		i++
+	}
+	for ; i < t.NumIn(); i++ {
+		method.args = append(method.args, t.In(i))
+	}
+
+	switch t.NumOut() {
+	case 0:
+	case 1:
+		method.err = t.Out(0) == errorType
+		method.result = !method.err
+	case 2:
+		if t.Out(1) != errorType {
+			return nil, false
+		}
+		method.result = true
+		method.err = true
+	default:
+		return nil, false
+	}
+
+	return method, true
+}
+
+func (method *serviceMethod) handle(ctx context.Context, call *Call) (AMFAny, error) {
+	for _, check := range method.checks {
+		err := check(ctx, call)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(call.Args) != len(method.args) {
+		return nil, &callError{"Client.InvalidArgument", errors.New(method.target + " expects " + strconv.Itoa(len(method.args)) + " arguments, got " + strconv.Itoa(len(call.Args)))}
+	}
+
+	in := make([]reflect.Value, 0, len(method.args)+2)
+	if method.ctx {
+		in = append(in, reflect.ValueOf(&ctx).Elem())
+	}
+	if method.call {
+		in = append(in, reflect.ValueOf(call))
+	}
+	for i, t := range method.args {
+		arg := reflect.New(t)
+		err := call.Args[i].Decode(arg.Interface(), call.opts...)
+		if err != nil {
+			return nil, &callError{"Client.InvalidArgument", fmt.Errorf("argument %d of %s: %w", i, method.target, err)}
+		}
+		in = append(in, arg.Elem())
+	}
+
+	out := method.fn.Call(in)
+
+	var result AMFAny
+	if method.result {
+		result = out[0].Interface()
+	}
+	if method.err {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
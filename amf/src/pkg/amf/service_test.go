@@ -0,0 +1,152 @@
+package amf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type serviceUser struct {
+	Name string
+	Age  int
+}
+
+type serviceUsers struct{}
+
+func (serviceUsers) Get(ctx context.Context, id int) (*serviceUser, error) {
+	if id == 0 {
+		return nil, errors.New("not found")
+	}
+	return &serviceUser{Name: "bob", Age: id}, nil
+}
+
+func (serviceUsers) Save(user serviceUser) string { return "saved " + user.Name }
+func (serviceUsers) Target(call *Call) string     { return call.Target }
+func (serviceUsers) Secret() string               { return "secret" }
+func (serviceUsers) Hidden() string               { return "hidden" }
+func (serviceUsers) Fail() error                  { return &Fault{Code: "App.Fail"} }
+func (serviceUsers) Nothing()                     {}
+func (serviceUsers) Variadic(ids ...int)          {}
+func (serviceUsers) Results() (int, int)          { return 1, 2 }
+
+//withPrincipal authenticates the requests of handler as principal
+func withPrincipal(handler http.Handler, principal AMFAny) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+func TestRegisterService(t *testing.T) {
+	gateway := NewGateway()
+	err := gateway.RegisterService("", serviceUsers{},
+		MethodFilter(func(name string) bool { return name != "Hidden" }),
+		MethodOptions("Secret", RequireAuth()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	typed := NewObject("com.User")
+	typed.Members = []Member{{Key: "name", Value: NewString("al")}, {Key: "age", Value: NewInteger(5)}}
+
+	tests := []struct {
+		target string
+		data   AMFAny
+		auth   bool
+		result string //result as a document, empty for onStatus
+		code   string
+	}{
+		{"serviceUsers.get", []AMFAny{7}, false, `{"name": "bob", "age": 7}`, ""},
+		{"serviceUsers.Get", []AMFAny{7}, false, `{"name": "bob", "age": 7}`, ""},
+		{"serviceUsers.get", []AMFAny{0}, false, "", "Server.Processing"},
+		{"serviceUsers.get", []AMFAny{"x", 1}, false, "", "Client.InvalidArgument"},
+		{"serviceUsers.get", []AMFAny{"x"}, false, "", "Client.InvalidArgument"},
+		{"serviceUsers.save", NewArray(typed), false, `"saved al"`, ""},
+		{"serviceUsers.target", nil, false, `"serviceUsers.target"`, ""},
+		{"serviceUsers.secret", nil, false, "", "Client.Authentication"},
+		{"serviceUsers.secret", nil, true, `"secret"`, ""},
+		{"serviceUsers.hidden", nil, true, "", "Client.UnknownTarget"},
+		{"serviceUsers.fail", nil, false, "", "App.Fail"},
+		{"serviceUsers.nothing", nil, false, "null", ""},
+		{"serviceUsers.variadic", nil, false, "", "Client.UnknownTarget"},
+		{"serviceUsers.results", nil, false, "", "Client.UnknownTarget"},
+	}
+
+	for _, version := range []uint16{0, 3} {
+		for _, test := range tests {
+			var handler http.Handler = gateway
+			if test.auth {
+				handler = withPrincipal(gateway, "bob")
+			}
+
+			response, _ := postPacket(t, handler, &Packet{Version: version, Messages: []Message{{Target: test.target, Response: "/1", Data: test.data}}})
+			message := response.Messages[0]
+			data := message.Data.(*Value)
+			if test.code != "" {
+				if message.Target != "/1/onStatus" || memberString(data, "code") != test.code {
+					t.Errorf("version %d: %s answered %s %v", version, test.target, message.Target, data)
+				}
+				continue
+			}
+
+			if data == nil {
+				data = NewNull()
+			}
+			if message.Target != "/1/onResult" || data.String() != test.result {
+				t.Errorf("version %d: %s answered %s %v", version, test.target, message.Target, data)
+			}
+		}
+	}
+}
+
+func TestServiceOptions(t *testing.T) {
+	var checked []string
+	gateway := NewGateway()
+	err := gateway.RegisterService("users", &serviceUsers{},
+		MethodOptions("*", CheckCall(func(ctx context.Context, call *Call) error {
+			checked = append(checked, "all "+call.Target)
+			return nil
+		})),
+		MethodOptions("Save", CheckCall(func(ctx context.Context, call *Call) error {
+			checked = append(checked, "save "+call.Target)
+			return &Fault{Code: "App.Denied"}
+		})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, _ := postPacket(t, gateway, &Packet{Messages: []Message{
+		{Target: "users.target", Response: "/1"},
+		{Target: "users.save", Response: "/2", Data: []AMFAny{&serviceUser{}}},
+	}})
+	if data := response.Messages[0].Data.(*Value); data.Str != "users.target" {
+		t.Errorf("pointer receiver answered %v", data)
+	}
+	if code := memberString(response.Messages[1].Data.(*Value), "code"); code != "App.Denied" {
+		t.Errorf("denied call answered %q", code)
+	}
+	if len(checked) != 3 || checked[0] != "all users.target" || checked[1] != "all users.save" || checked[2] != "save users.save" {
+		t.Errorf("checks ran %q", checked)
+	}
+}
+
+func TestRegisterServiceErrors(t *testing.T) {
+	gateway := NewGateway()
+	tests := []struct {
+		name     string
+		receiver AMFAny
+	}{
+		{"", nil},
+		{"", struct{}{}},
+		{"empty", struct{}{}},
+		{"unsuitable", &fuzzStruct{}},
+		{"filtered", serviceUsers{}},
+	}
+
+	for _, test := range tests {
+		err := gateway.RegisterService(test.name, test.receiver, MethodFilter(func(string) bool { return test.name != "filtered" }))
+		if err == nil {
+			t.Errorf("%q %T registered", test.name, test.receiver)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package amf
+
+import (
+	"errors"
+	"strconv"
+)
+
+//streamFlushSize is how much a stream buffers before writing to the writer
+const streamFlushSize = 32 << 10
+
+//streamFrame is an array or object begun by BeginArray or BeginObject
+type streamFrame struct {
+	traits *Traits //nil for arrays
+	left   int     //elements of the array left
+	next   int     //next sealed member of the object
+	key    bool    //a key was written, its value comes next
+	depth  int     //depth of the encoder, Marshalers may begin values too
+}
+
+//BeginArray starts an array of length elements, which are written one by
+//one with WriteValue, Encode or nested Begin calls, and closed by End. The
+//output is written to the writer in chunks, instead of once per value.
+func (encoder *Encoder) BeginArray(length int) error {
+	err := encoder.streamValue()
+	if err != nil {
+		return err
+	}
+
+	encoder.startValue()
+	encoder.writeMarker(ARRAY_MARKER)
+	encoder.objectCount++
+	err = encoder.writeU29((uint32(length) << 1) | 0x01)
+	if err != nil {
+		return encoder.streamError(err)
+	}
+	encoder.writeString("")
+
+	encoder.stream = append(encoder.stream, streamFrame{left: length, depth: encoder.depth})
+	return nil
+}
+
+//BeginObject starts an object of the class described by traits, nil for an
+//anonymous dynamic object. Every member is written with WriteKey followed by
+//its value, the sealed members first in the order of traits.Members. Objects
+//begun with the same *Traits write a traits reference after the first one.
+func (encoder *Encoder) BeginObject(traits *Traits) error {
+	if traits == nil {
+		traits = &Traits{Dynamic: true}
+	}
+
+	if traits.Externalizable {
+		return errors.New("externalizable class:" + traits.Class + " not supported")
+	}
+
+	err := encoder.streamValue()
+	if err != nil {
+		return err
+	}
+
+	encoder.startValue()
+	encoder.writeMarker(OBJECT_MARKER)
+	encoder.objectCount++
+	err = encoder.writeTraits(traits)
+	if err != nil {
+		return encoder.streamError(err)
+	}
+
+	encoder.stream = append(encoder.stream, streamFrame{traits: traits, depth: encoder.depth})
+	return nil
+}
+
+//WriteKey writes the name of the next member of the object begun last
+func (encoder *Encoder) WriteKey(key string) error {
+	if len(encoder.stream) == 0 {
+		return errors.New("key:" + key + " outside of object")
+	}
+
+	frame := &encoder.stream[len(encoder.stream)-1]
+	switch {
+	case frame.traits == nil:
+		return errors.New("key:" + key + " not allowed in array")
+	case frame.key:
+		return errors.New("value of key expected, found key:" + key)
+	case frame.next < len(frame.traits.Members):
+		if key != frame.traits.Members[frame.next] {
+			return errors.New("sealed member:" + frame.traits.Members[frame.next] + " expected, found key:" + key)
+		}
+		frame.next++
+	case !frame.traits.Dynamic:
+		return errors.New("key:" + key + " not found in sealed class:" + frame.traits.Class)
+	case key == "":
+		return errors.New("empty key not allowed in object")
+	default:
+		encoder.writeString(key)
+	}
+
+	frame.key = true
+	return nil
+}
+
+//End closes the array or object begun last
+func (encoder *Encoder) End() error {
+	if len(encoder.stream) == 0 {
+		return errors.New("end without begin")
+	}
+
+	frame := encoder.stream[len(encoder.stream)-1]
+	switch {
+	case frame.key:
+		return errors.New("value of key expected, found end")
+	case frame.traits == nil && frame.left > 0:
+		return errors.New(strconv.Itoa(frame.left) + " elements of array missing")
+	case frame.traits != nil && frame.next < len(frame.traits.Members):
+		return errors.New("sealed member:" + frame.traits.Members[frame.next] + " missing")
+	}
+
+	if frame.traits != nil && frame.traits.Dynamic {
+		encoder.writeString("")
+	}
+
+	encoder.stream = encoder.stream[:len(encoder.stream)-1]
+	if encoder.depth > 0 {
+		return nil
+	}
+	return encoder.flush(nil)
+}
+
+//streamValue checks that a value may be written in the array or object
+//begun last
+func (encoder *Encoder) streamValue() error {
+	if len(encoder.stream) == 0 {
+		return nil
+	}
+
+	frame := &encoder.stream[len(encoder.stream)-1]
+	if frame.depth != encoder.depth {
+		return nil
+	}
+
+	switch {
+	case frame.traits != nil && !frame.key:
+		return errors.New("key expected before value in object")
+	case frame.traits != nil:
+		frame.key = false
+	case frame.left == 0:
+		return errors.New("too many elements for array")
+	default:
+		frame.left--
+	}
+
+	return nil
+}
+
+//streamError drops a stream broken by an error, the output already written
+//can't be completed any more
+func (encoder *Encoder) streamError(err error) error {
+	encoder.stream = encoder.stream[:0]
+	return encoder.flush(err)
+}
@@ -0,0 +1,110 @@
+package amf
+
+import (
+	"bytes"
+	"testing"
+)
+
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	writer.writes++
+	return writer.Buffer.Write(p)
+}
+
+func TestStream(t *testing.T) {
+	const rows = 10000
+	traits := &Traits{Class: "Row", Members: []string{"id", "name"}}
+
+	writer := &countingWriter{}
+	encoder := NewEncoder(writer, false)
+	must := func(err error) {
+		if err != nil {
+			t.Helper()
+			t.Fatal(err)
+		}
+	}
+	must(encoder.BeginObject(nil))
+	must(encoder.WriteKey("rows"))
+	must(encoder.BeginArray(rows))
+	for i := 0; i < rows; i++ {
+		must(encoder.BeginObject(traits))
+		must(encoder.WriteKey("id"))
+		must(encoder.Encode(i))
+		must(encoder.WriteKey("name"))
+		must(encoder.WriteValue("row"))
+		must(encoder.End())
+	}
+	must(encoder.End())
+	must(encoder.WriteKey("total"))
+	must(encoder.Encode(rows))
+	must(encoder.End())
+
+	if max := writer.Len()/streamFlushSize + 2; writer.writes > max {
+		t.Errorf("%d writes for %d bytes", writer.writes, writer.Len())
+	}
+
+	//the stream is the encoding of the same document
+	document := NewArray()
+	for i := 0; i < rows; i++ {
+		document.Elements = append(document.Elements, &Value{Kind: KindObject, Traits: traits, Sealed: []*Value{NewInteger(int32(i)), NewString("row")}})
+	}
+	object := NewObject("")
+	object.Members = []Member{{"rows", document}, {"total", NewInteger(rows)}}
+	want, err := Marshal(object)
+	must(err)
+	if !bytes.Equal(writer.Bytes(), want) {
+		t.Error("stream differs from the document")
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	traits := &Traits{Class: "Row", Members: []string{"id"}}
+	tests := []struct {
+		name  string
+		calls func(encoder *Encoder) error
+	}{
+		{"end without begin", func(encoder *Encoder) error {
+			return encoder.End()
+		}},
+		{"key in array", func(encoder *Encoder) error {
+			encoder.BeginArray(1)
+			return encoder.WriteKey("x")
+		}},
+		{"missing elements", func(encoder *Encoder) error {
+			encoder.BeginArray(1)
+			return encoder.End()
+		}},
+		{"too many elements", func(encoder *Encoder) error {
+			encoder.BeginArray(1)
+			encoder.Encode(1)
+			return encoder.Encode(2)
+		}},
+		{"value without key", func(encoder *Encoder) error {
+			encoder.BeginObject(nil)
+			return encoder.Encode(1)
+		}},
+		{"end after key", func(encoder *Encoder) error {
+			encoder.BeginObject(nil)
+			encoder.WriteKey("x")
+			return encoder.End()
+		}},
+		{"sealed member missing", func(encoder *Encoder) error {
+			encoder.BeginObject(traits)
+			return encoder.End()
+		}},
+		{"sealed member out of order", func(encoder *Encoder) error {
+			encoder.BeginObject(traits)
+			return encoder.WriteKey("other")
+		}},
+	}
+
+	for _, test := range tests {
+		if err := test.calls(NewEncoder(&bytes.Buffer{}, false)); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
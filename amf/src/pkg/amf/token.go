@@ -0,0 +1,387 @@
+package amf
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//Token is returned by Decoder.Token, one of
+//
+//	Undefined, nil, bool, int32, float64, string, time.Time, []byte, XML,
+//	XMLDocument                  scalar values
+//	StartArray, StartObject,
+//	StartVector, StartDictionary the start of a complex value, closed by End
+//	Key                          the name of the member whose value follows
+//	Ref                          a reference to a complex value seen before
+//
+//An array returns its associative members as Key and value first, then its
+//dense elements. Items of int, uint and double vectors are int32, uint32 and
+//float64, a dictionary returns its key and value tokens one after another.
+type Token interface{}
+
+type Undefined struct{}
+
+type XML string
+
+type XMLDocument string
+
+type StartArray struct {
+	Len int //number of dense elements
+}
+
+type StartObject struct {
+	Class   string //"" for anonymous objects
+	Dynamic bool
+}
+
+type StartVector struct {
+	Type     byte   //marker of the vector, e.g. VECTOR_INT_MARKER
+	ElemType string //type name of object vectors
+	Len      int
+	Fixed    bool
+}
+
+type StartDictionary struct {
+	Len      int
+	WeakKeys bool
+}
+
+type Key string
+
+type End struct{}
+
+//Ref is the index in the object table of a value seen before. Arrays,
+//objects, vectors, dictionaries, dates, byte arrays and xml take an index
+//each in the order they start. References to dates, byte arrays and xml are
+//returned as the value itself.
+type Ref int
+
+//tokenFrame is a complex value being read by Token
+type tokenFrame struct {
+	marker  byte
+	traits  *Traits
+	dynamic bool //the members after the sealed ones, or the associative part of an array
+	next    int  //next sealed member, or number of dynamic members read
+	left    int  //dense elements, vector items or dictionary tokens left
+	value   bool //a key was returned, its value comes next
+	elem    string
+}
+
+//Token returns the next token of the input, io.EOF at the end of the input
+//between top level values. The tokens take the memory of the reference
+//tables only, not of the values, so it could scan inputs of any size.
+//Decode and ReadValue could read the value after a Key, or the next element
+//of an array, as a whole.
+func (decoder *Decoder) Token() (Token, error) {
+	if len(decoder.tokens) == 0 {
+		err := decoder.peekMarker()
+		if err != nil {
+			return nil, err
+		}
+		decoder.startValue()
+		return decoder.readToken()
+	}
+
+	frame := &decoder.tokens[len(decoder.tokens)-1]
+	if frame.value {
+		frame.value = false
+		return decoder.readToken()
+	}
+
+	switch frame.marker {
+	case ARRAY_MARKER:
+		if frame.dynamic {
+			key, err := decoder.readUTF8()
+			if err != nil {
+				return nil, decoder.tokenError(err, decoder.offset, 0)
+			}
+
+			if key != "" {
+				frame.next++
+				err = decoder.checkMembers(frame.next + frame.left)
+				if err != nil {
+					return nil, decoder.tokenError(err, decoder.offset, 0)
+				}
+				return decoder.tokenKey(frame, key), nil
+			}
+			frame.dynamic = false
+			frame.next = 0
+		}
+
+		if frame.left == 0 {
+			return decoder.tokenEnd(), nil
+		}
+		frame.elem = indexElem(frame.next)
+		frame.next++
+		frame.left--
+		return decoder.readToken()
+	case OBJECT_MARKER:
+		if !frame.dynamic {
+			if frame.next < len(frame.traits.Members) {
+				key := frame.traits.Members[frame.next]
+				frame.next++
+				return decoder.tokenKey(frame, key), nil
+			}
+
+			if !frame.traits.Dynamic {
+				return decoder.tokenEnd(), nil
+			}
+			frame.dynamic = true
+		}
+
+		key, err := decoder.readUTF8()
+		if err != nil {
+			return nil, decoder.tokenError(err, decoder.offset, 0)
+		}
+
+		if key == "" {
+			return decoder.tokenEnd(), nil
+		}
+
+		frame.next++
+		err = decoder.checkMembers(frame.next)
+		if err != nil {
+			return nil, decoder.tokenError(err, decoder.offset, 0)
+		}
+		return decoder.tokenKey(frame, key), nil
+	case VECTOR_INT_MARKER, VECTOR_UINT_MARKER, VECTOR_DOUBLE_MARKER:
+		if frame.left == 0 {
+			return decoder.tokenEnd(), nil
+		}
+		frame.elem = indexElem(frame.next)
+		frame.next++
+		frame.left--
+
+		offset := decoder.offset
+		var token Token
+		var err error
+		switch frame.marker {
+		case VECTOR_INT_MARKER:
+			var n uint32
+			n, err = decoder.readUint32()
+			token = int32(n)
+		case VECTOR_UINT_MARKER:
+			token, err = decoder.readUint32()
+		default:
+			token, err = decoder.readDouble()
+		}
+		if err != nil {
+			return nil, decoder.tokenError(err, offset, 0)
+		}
+		return token, nil
+	default:
+		if frame.left == 0 {
+			return decoder.tokenEnd(), nil
+		}
+		frame.elem = indexElem(frame.next)
+		frame.next++
+		frame.left--
+		return decoder.readToken()
+	}
+}
+
+func (decoder *Decoder) tokenKey(frame *tokenFrame, key string) Token {
+	frame.value = true
+	frame.elem = memberElem(key)
+	return Key(key)
+}
+
+func (decoder *Decoder) tokenEnd() Token {
+	decoder.tokens = decoder.tokens[:len(decoder.tokens)-1]
+	return End{}
+}
+
+//tokenError makes a DecodeError with the path of the tokens being read
+func (decoder *Decoder) tokenError(err error, offset int64, marker byte) error {
+	var path strings.Builder
+	for _, frame := range decoder.tokens {
+		path.WriteString(frame.elem)
+	}
+	return &DecodeError{Offset: offset, Marker: marker, Path: strings.TrimPrefix(path.String(), "."), Err: err}
+}
+
+//readToken reads a value, complex values push a frame and return their start
+func (decoder *Decoder) readToken() (Token, error) {
+	marker, err := decoder.readMarker()
+	if err != nil {
+		return nil, decoder.tokenError(err, decoder.offset, 0)
+	}
+
+	offset := decoder.offset - 1
+	token, err := decoder.readMarkedToken(marker)
+	if err != nil {
+		return nil, decoder.tokenError(err, offset, marker)
+	}
+
+	return token, nil
+}
+
+func (decoder *Decoder) readMarkedToken(marker byte) (Token, error) {
+	switch marker {
+	case ARRAY_MARKER, OBJECT_MARKER, VECTOR_INT_MARKER, VECTOR_UINT_MARKER, VECTOR_DOUBLE_MARKER, VECTOR_OBJECT_MARKER, DICTIONARY_MARKER:
+		return decoder.readStartToken(marker)
+	}
+
+	value, err := decoder.readValue(marker)
+	if err != nil {
+		return nil, err
+	}
+
+	switch value.Kind {
+	case KindUndefined:
+		return Undefined{}, nil
+	case KindNull:
+		return nil, nil
+	case KindBool:
+		return value.Bool, nil
+	case KindInteger:
+		return int32(value.Int), nil
+	case KindDouble:
+		return value.Float, nil
+	case KindString:
+		return value.Str, nil
+	case KindDate:
+		return value.Time(), nil
+	case KindXML:
+		return XML(value.Str), nil
+	case KindXMLDocument:
+		return XMLDocument(value.Str), nil
+	case KindByteArray:
+		return value.Bytes, nil
+	}
+
+	return nil, errors.New("unsupported marker:" + strconv.Itoa(int(marker)))
+}
+
+func (decoder *Decoder) readStartToken(marker byte) (Token, error) {
+	header, err := decoder.readU29()
+	if err != nil {
+		return nil, err
+	}
+
+	if (header & 0x01) == 0 {
+		index := int(header >> 1)
+		if index >= len(decoder.objectCache) {
+			return nil, errors.New("invalid object reference:" + strconv.Itoa(index))
+		}
+		if decoder.refs != nil {
+			decoder.refs.add(index, decoder.refs.objects)
+		}
+		return Ref(index), nil
+	}
+
+	if decoder.maxDepth > 0 && len(decoder.tokens) >= decoder.maxDepth {
+		return nil, ErrMaxDepth
+	}
+
+	header >>= 1
+	frame := tokenFrame{marker: marker}
+	var token Token
+
+	switch marker {
+	case ARRAY_MARKER:
+		err = decoder.checkMembers(int(header))
+		if err != nil {
+			return nil, err
+		}
+		frame.dynamic = true
+		frame.left = int(header)
+		token = StartArray{Len: int(header)}
+	case OBJECT_MARKER:
+		frame.traits, err = decoder.readTraits(header)
+		if err != nil {
+			return nil, err
+		}
+		if frame.traits.Externalizable && wrapperClasses[frame.traits.Class] {
+			//a flex wrapper is replaced by the value it wraps, only its
+			//place in the table is kept
+			err = decoder.addObject(reflect.Value{})
+			if err != nil {
+				return nil, err
+			}
+			marker, err = decoder.readMarker()
+			if err != nil {
+				return nil, err
+			}
+			return decoder.readMarkedToken(marker)
+		}
+		if frame.traits.Externalizable {
+			return nil, errors.New("externalizable class:" + frame.traits.Class + " not supported")
+		}
+		token = StartObject{Class: frame.traits.Class, Dynamic: frame.traits.Dynamic}
+	case DICTIONARY_MARKER:
+		err = decoder.checkMembers(int(header))
+		if err != nil {
+			return nil, err
+		}
+		weak, err := decoder.readMarker()
+		if err != nil {
+			return nil, err
+		}
+		frame.left = int(header) * 2
+		token = StartDictionary{Len: int(header), WeakKeys: weak != 0}
+	default:
+		err = decoder.checkMembers(int(header))
+		if err != nil {
+			return nil, err
+		}
+		fixed, err := decoder.readMarker()
+		if err != nil {
+			return nil, err
+		}
+		start := StartVector{Type: marker, Len: int(header), Fixed: fixed != 0}
+		if marker == VECTOR_OBJECT_MARKER {
+			start.ElemType, err = decoder.readUTF8()
+			if err != nil {
+				return nil, err
+			}
+		}
+		frame.left = int(header)
+		token = start
+	}
+
+	//the value isn't kept, only its place in the table
+	err = decoder.addObject(reflect.Value{})
+	if err != nil {
+		return nil, err
+	}
+
+	decoder.tokens = append(decoder.tokens, frame)
+	return token, nil
+}
+
+//tokenValue moves the tokens over a value read by Decode or ReadValue, which
+//could be used for the value after a Key or for the elements of an array
+func (decoder *Decoder) tokenValue() error {
+	frame := &decoder.tokens[len(decoder.tokens)-1]
+	if frame.value {
+		frame.value = false
+		return nil
+	}
+
+	if frame.marker == ARRAY_MARKER && frame.dynamic {
+		key, err := decoder.readUTF8()
+		if err != nil {
+			return decoder.tokenError(err, decoder.offset, 0)
+		}
+		if key != "" {
+			return decoder.tokenError(errors.New("key:"+key+" of array must be read by Token"), decoder.offset, 0)
+		}
+		frame.dynamic = false
+		frame.next = 0
+	}
+
+	switch frame.marker {
+	case ARRAY_MARKER, VECTOR_OBJECT_MARKER, DICTIONARY_MARKER:
+		if frame.left > 0 {
+			frame.elem = indexElem(frame.next)
+			frame.next++
+			frame.left--
+			return nil
+		}
+	}
+
+	return decoder.tokenError(errors.New("no value to decode, Token expected"), decoder.offset, 0)
+}
@@ -0,0 +1,118 @@
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestTokens(t *testing.T) {
+	shared := NewObject("")
+	shared.Members = []Member{{"x", NewString("hello")}}
+	typed := NewObject("com.Foo")
+	typed.Traits.Members = []string{"a", "b"}
+	typed.Sealed = []*Value{NewInteger(-3), NewString("hello")}
+	typedAgain := &Value{Kind: KindObject, Traits: typed.Traits, Sealed: []*Value{NewDouble(1.5), NewBool(true)}}
+	array := NewArray()
+	array.Members = []Member{{"k", NewNull()}}
+	array.Elements = []*Value{
+		shared,
+		shared,
+		typed,
+		typedAgain,
+		{Kind: KindVector, VectorType: VECTOR_INT_MARKER, Elements: []*Value{NewInteger(1), NewInteger(-2)}},
+		{Kind: KindDictionary, Entries: []Entry{{NewString("a"), NewInteger(1)}}},
+		NewByteArray([]byte("xy")),
+	}
+
+	want := []Token{
+		StartArray{Len: 7},
+		Key("k"), nil,
+		StartObject{Dynamic: true}, Key("x"), "hello", End{},
+		Ref(1),
+		StartObject{Class: "com.Foo", Dynamic: true}, Key("a"), int32(-3), Key("b"), "hello", End{},
+		StartObject{Class: "com.Foo", Dynamic: true}, Key("a"), 1.5, Key("b"), true, End{},
+		StartVector{Type: VECTOR_INT_MARKER, Len: 2}, int32(1), int32(-2), End{},
+		StartDictionary{Len: 1}, "a", int32(1), End{},
+		[]byte("xy"),
+		End{},
+	}
+
+	data, err := Marshal(array)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder(bytes.NewReader(data))
+	var tokens []Token
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Errorf("tokens %v\nwant %v", tokens, want)
+	}
+}
+
+func TestTokensDecode(t *testing.T) {
+	type user struct {
+		Uid  int
+		Name string
+	}
+	data, err := Marshal(&struct{ Users []user }{[]user{{1, "a"}, {2, "a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the elements of the array are decoded as a whole between tokens, the
+	//string references of the second one point into the first one
+	decoder := NewDecoder(bytes.NewReader(data))
+	var decoded []user
+	var tokens []Token
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+
+		if start, ok := token.(StartArray); ok {
+			for i := 0; i < start.Len; i++ {
+				var u user
+				err = decoder.Decode(&u)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded = append(decoded, u)
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(decoded, []user{{1, "a"}, {2, "a"}}) {
+		t.Errorf("decoded %v", decoded)
+	}
+	want := []Token{StartObject{Dynamic: true}, Key("users"), StartArray{Len: 2}, End{}, End{}}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Errorf("tokens %v, want %v", tokens, want)
+	}
+
+	decoder = NewDecoder(bytes.NewReader(data[:len(data)-4]))
+	for err == nil {
+		_, err = decoder.Token()
+	}
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || !errors.Is(err, io.ErrUnexpectedEOF) || decodeErr.Path != "users[1].name" {
+		t.Errorf("truncated input: %v", err)
+	}
+}
@@ -0,0 +1,1107 @@
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Kind is the amf type held by a Value
+type Kind int
+
+const (
+	KindUndefined Kind = iota
+	KindNull
+	KindBool
+	KindInteger
+	KindDouble
+	KindString
+	KindDate
+	KindXMLDocument
+	KindXML
+	KindByteArray
+	KindArray
+	KindObject
+	KindVector
+	KindDictionary
+)
+
+var kindNames = []string{
+	KindUndefined:   "undefined",
+	KindNull:        "null",
+	KindBool:        "bool",
+	KindInteger:     "integer",
+	KindDouble:      "double",
+	KindString:      "string",
+	KindDate:        "date",
+	KindXMLDocument: "xmldocument",
+	KindXML:         "xml",
+	KindByteArray:   "bytearray",
+	KindArray:       "array",
+	KindObject:      "object",
+	KindVector:      "vector",
+	KindDictionary:  "dictionary",
+}
+
+func (kind Kind) String() string {
+	if kind >= 0 && int(kind) < len(kindNames) {
+		return kindNames[kind]
+	}
+	return "kind(" + strconv.Itoa(int(kind)) + ")"
+}
+
+//Traits describes the class of an amf object. Objects decoded from the same
+//traits declaration share the same *Traits, so the encoder can write a traits
+//reference for them again.
+type Traits struct {
+	Class          string
+	Dynamic        bool
+	Externalizable bool
+	Members        []string
+}
+
+//Member is a named value, used for dynamic object members and for the
+//associative part of an array
+type Member struct {
+	Key   string
+	Value *Value
+}
+
+//Entry is a key/value pair of a dictionary
+type Entry struct {
+	Key   *Value
+	Value *Value
+}
+
+//Value is a node of an amf document. Complex values (date, xml, bytearray,
+//array, object, vector, dictionary) are reference types in amf: a *Value that
+//appears several times in a tree is encoded once and referenced afterwards,
+//exactly like the decoder found it.
+type Value struct {
+	Kind Kind
+
+	Bool  bool    //KindBool
+	Int   int64   //KindInteger, items of int and uint vectors
+	Float float64 //KindDouble, milliseconds since epoch for KindDate
+	Str   string  //KindString, KindXML, KindXMLDocument
+	Bytes []byte  //KindByteArray
+
+	Traits   *Traits        //KindObject
+	Sealed   []*Value       //KindObject, values of Traits.Members in order
+	External Externalizable //KindObject of a registered externalizable class
+
+	Members  []Member //dynamic members of KindObject, associative part of KindArray
+	Elements []*Value //dense part of KindArray, items of KindVector
+
+	VectorType byte   //KindVector, one of the VECTOR_*_MARKER
+	ElemType   string //KindVector, type name of an object vector
+	Fixed      bool   //KindVector
+
+	Entries  []Entry //KindDictionary
+	WeakKeys bool    //KindDictionary
+}
+
+var valueType = reflect.TypeOf((*Value)(nil))
+
+func NewUndefined() *Value {
+	return &Value{Kind: KindUndefined}
+}
+
+func NewNull() *Value {
+	return &Value{Kind: KindNull}
+}
+
+func NewBool(b bool) *Value {
+	return &Value{Kind: KindBool, Bool: b}
+}
+
+func NewInteger(i int32) *Value {
+	return &Value{Kind: KindInteger, Int: int64(i)}
+}
+
+func NewDouble(f float64) *Value {
+	return &Value{Kind: KindDouble, Float: f}
+}
+
+func NewString(s string) *Value {
+	return &Value{Kind: KindString, Str: s}
+}
+
+func NewDate(t time.Time) *Value {
+	return &Value{Kind: KindDate, Float: float64(t.UnixNano() / int64(time.Millisecond))}
+}
+
+func NewByteArray(b []byte) *Value {
+	return &Value{Kind: KindByteArray, Bytes: b}
+}
+
+func NewArray(elements ...*Value) *Value {
+	return &Value{Kind: KindArray, Elements: elements}
+}
+
+//NewObject creates a dynamic object of the given class without sealed members
+func NewObject(class string) *Value {
+	return &Value{Kind: KindObject, Traits: &Traits{Class: class, Dynamic: true}}
+}
+
+//Time returns the time of a KindDate value
+func (value *Value) Time() time.Time {
+	ms := int64(value.Float)
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+//Class returns the class name of an object or the type name of an object vector
+func (value *Value) Class() string {
+	switch value.Kind {
+	case KindObject:
+		if value.Traits != nil {
+			return value.Traits.Class
+		}
+	case KindVector:
+		return value.ElemType
+	}
+	return ""
+}
+
+//Member returns the sealed or dynamic member of an object, or the associative
+//member of an array with the given key
+func (value *Value) Member(key string) (*Value, bool) {
+	if value.Kind == KindObject && value.Traits != nil {
+		for i, name := range value.Traits.Members {
+			if name == key && i < len(value.Sealed) {
+				return value.Sealed[i], true
+			}
+		}
+	}
+
+	for _, m := range value.Members {
+		if m.Key == key {
+			return m.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+//Decode decodes the document into value, like Unmarshal of its encoding
+func (value *Value) Decode(v AMFAny, opts ...DecoderOption) error {
+	data, err := Marshal(value)
+	if err != nil {
+		return err
+	}
+	return Unmarshal(data, v, opts...)
+}
+
+func (value *Value) String() string {
+	var b strings.Builder
+	value.format(&b, make(map[*Value]bool))
+	return b.String()
+}
+
+func (value *Value) format(b *strings.Builder, seen map[*Value]bool) {
+	if value == nil {
+		b.WriteString("<nil>")
+		return
+	}
+
+	switch value.Kind {
+	case KindUndefined, KindNull:
+		b.WriteString(value.Kind.String())
+		return
+	case KindBool:
+		b.WriteString(strconv.FormatBool(value.Bool))
+		return
+	case KindInteger:
+		b.WriteString(strconv.FormatInt(value.Int, 10))
+		return
+	case KindDouble:
+		b.WriteString(strconv.FormatFloat(value.Float, 'g', -1, 64))
+		return
+	case KindString:
+		b.WriteString(strconv.Quote(value.Str))
+		return
+	}
+
+	if seen[value] {
+		fmt.Fprintf(b, "<%s %p>", value.Kind, value)
+		return
+	}
+	seen[value] = true
+	defer delete(seen, value)
+
+	switch value.Kind {
+	case KindDate:
+		b.WriteString("date(" + value.Time().UTC().Format(time.RFC3339Nano) + ")")
+	case KindXML, KindXMLDocument:
+		b.WriteString(value.Kind.String() + "(" + strconv.Quote(value.Str) + ")")
+	case KindByteArray:
+		fmt.Fprintf(b, "bytearray(%x)", value.Bytes)
+	case KindArray:
+		b.WriteString("[")
+		for i, e := range value.Elements {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			e.format(b, seen)
+		}
+		for i, m := range value.Members {
+			if i > 0 || len(value.Elements) > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(strconv.Quote(m.Key) + ": ")
+			m.Value.format(b, seen)
+		}
+		b.WriteString("]")
+	case KindObject:
+		if class := value.Class(); class != "" {
+			b.WriteString(class)
+		}
+		b.WriteString("{")
+		if value.External != nil {
+			fmt.Fprintf(b, "%+v", value.External)
+		}
+		n := 0
+		if value.Traits != nil {
+			for i, name := range value.Traits.Members {
+				if n > 0 {
+					b.WriteString(", ")
+				}
+				b.WriteString(name + ": ")
+				if i < len(value.Sealed) {
+					value.Sealed[i].format(b, seen)
+				}
+				n++
+			}
+		}
+		for _, m := range value.Members {
+			if n > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(strconv.Quote(m.Key) + ": ")
+			m.Value.format(b, seen)
+			n++
+		}
+		b.WriteString("}")
+	case KindVector:
+		b.WriteString("vector")
+		if value.ElemType != "" {
+			b.WriteString(".<" + value.ElemType + ">")
+		}
+		b.WriteString("[")
+		for i, e := range value.Elements {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			e.format(b, seen)
+		}
+		b.WriteString("]")
+	case KindDictionary:
+		b.WriteString("dictionary{")
+		for i, e := range value.Entries {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			e.Key.format(b, seen)
+			b.WriteString(": ")
+			e.Value.format(b, seen)
+		}
+		b.WriteString("}")
+	default:
+		b.WriteString(value.Kind.String())
+	}
+}
+
+//ReadValue decodes the next amf value as a document tree, without the need of
+//a target go type
+func (decoder *Decoder) ReadValue() (*Value, error) {
+	if len(decoder.tokens) > 0 {
+		err := decoder.tokenValue()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := decoder.peekMarker()
+	if err != nil {
+		return nil, err
+	}
+
+	decoder.startValue()
+	value, err := decoder.readNextValue()
+	if decoder.depth > 0 {
+		return value, err
+	}
+	return value, topPath(err)
+}
+
+func (decoder *Decoder) readNextValue() (*Value, error) {
+	marker, err := decoder.readMarker()
+	if err != nil {
+		return nil, decodeError(err, decoder.offset, 0, nil)
+	}
+
+	offset := decoder.offset - 1
+	defer decoder.leave()
+	err = decoder.enter()
+	if err != nil {
+		return nil, decodeError(err, offset, marker, nil)
+	}
+
+	value, err := decoder.readValue(marker)
+	if err != nil {
+		return nil, decodeError(err, offset, marker, nil)
+	}
+
+	return value, nil
+}
+
+func (decoder *Decoder) readValue(marker byte) (*Value, error) {
+	switch marker {
+	case UNDEFINED_MARKER:
+		return NewUndefined(), nil
+	case NULL_MARKER:
+		return NewNull(), nil
+	case FALSE_MARKER:
+		return NewBool(false), nil
+	case TRUE_MARKER:
+		return NewBool(true), nil
+	case INTEGER_MARKER:
+		uv, err := decoder.readU29()
+		if err != nil {
+			return nil, err
+		}
+		vv := int64(uv)
+		if uv > 0xfffffff {
+			vv -= 0x20000000
+		}
+		return &Value{Kind: KindInteger, Int: vv}, nil
+	case DOUBLE_MARKER:
+		f, err := decoder.readDouble()
+		if err != nil {
+			return nil, err
+		}
+		return NewDouble(f), nil
+	case STRING_MARKER:
+		s, err := decoder.readUTF8()
+		if err != nil {
+			return nil, err
+		}
+		return NewString(s), nil
+	case XMLDOC_MARKER, XML_MARKER, BYTEARRAY_MARKER:
+		return decoder.readBytesValue(marker)
+	case DATE_MARKER:
+		return decoder.readDateValue()
+	case ARRAY_MARKER:
+		return decoder.readArrayValue()
+	case OBJECT_MARKER:
+		return decoder.readObjectValue()
+	case VECTOR_INT_MARKER, VECTOR_UINT_MARKER, VECTOR_DOUBLE_MARKER, VECTOR_OBJECT_MARKER:
+		return decoder.readVectorValue(marker)
+	case DICTIONARY_MARKER:
+		return decoder.readDictionaryValue()
+	}
+
+	return nil, errors.New("unsupported marker:" + strconv.Itoa(int(marker)))
+}
+
+//readReference reads the u29 header of a complex value, if it is a reference,
+//the referenced value is returned, otherwise the remaining bits
+func (decoder *Decoder) readReference(marker byte) (*Value, uint32, error) {
+	index, err := decoder.readU29()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if (index & 0x01) != 0 {
+		return nil, index >> 1, nil
+	}
+
+	index >>= 1
+	if int(index) >= len(decoder.objectCache) {
+		return nil, 0, errors.New("invalid object reference:" + strconv.Itoa(int(index)))
+	}
+	if decoder.refs != nil {
+		decoder.refs.add(int(index), decoder.refs.objects)
+	}
+
+	ref := decoder.objectCache[index]
+	if ref.IsValid() && ref.Type() == valueType {
+		return ref.Interface().(*Value), 0, nil
+	}
+	if ref.IsValid() {
+		if value := scalarDocument(marker, ref); value != nil {
+			return value, 0, nil
+		}
+		if decoder.documentOf != nil {
+			value, err := decoder.documentOf(ref)
+			return value, 0, err
+		}
+	}
+
+	return nil, 0, errors.New("object reference:" + strconv.Itoa(int(index)) + " is not a document value")
+}
+
+//scalarDocument makes the document of a date, byte array or xml decoded into
+//a go value before, nil for other values
+func scalarDocument(marker byte, ref reflect.Value) *Value {
+	switch {
+	case marker == DATE_MARKER && ref.Type() == timeType:
+		return NewDate(ref.Interface().(time.Time))
+	case marker == BYTEARRAY_MARKER && ref.Kind() == reflect.String:
+		return NewByteArray([]byte(ref.String()))
+	case marker == BYTEARRAY_MARKER && ref.Kind() == reflect.Slice && ref.Type().Elem().Kind() == reflect.Uint8:
+		return NewByteArray(bytes.Clone(ref.Bytes()))
+	case marker == XML_MARKER && ref.Kind() == reflect.String:
+		return &Value{Kind: KindXML, Str: ref.String()}
+	case marker == XMLDOC_MARKER && ref.Kind() == reflect.String:
+		return &Value{Kind: KindXMLDocument, Str: ref.String()}
+	}
+	return nil
+}
+
+func (decoder *Decoder) addValueReference(value *Value) error {
+	return decoder.addObject(reflect.ValueOf(value))
+}
+
+func (decoder *Decoder) readBytesValue(marker byte) (*Value, error) {
+	ref, length, err := decoder.readReference(marker)
+	if ref != nil || err != nil {
+		return ref, err
+	}
+
+	err = decoder.checkString(int(length))
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := decoder.readBytes(int(length))
+	if err != nil {
+		return nil, err
+	}
+
+	value := new(Value)
+	switch marker {
+	case XMLDOC_MARKER:
+		value.Kind = KindXMLDocument
+		value.Str = string(bytes)
+	case XML_MARKER:
+		value.Kind = KindXML
+		value.Str = string(bytes)
+	default:
+		value.Kind = KindByteArray
+		value.Bytes = bytes
+	}
+
+	return value, decoder.addValueReference(value)
+}
+
+func (decoder *Decoder) readDateValue() (*Value, error) {
+	ref, _, err := decoder.readReference(DATE_MARKER)
+	if ref != nil || err != nil {
+		return ref, err
+	}
+
+	ms, err := decoder.readDouble()
+	if err != nil {
+		return nil, err
+	}
+
+	value := &Value{Kind: KindDate, Float: ms}
+	return value, decoder.addValueReference(value)
+}
+
+func (decoder *Decoder) readArrayValue() (*Value, error) {
+	ref, length, err := decoder.readReference(ARRAY_MARKER)
+	if ref != nil || err != nil {
+		return ref, err
+	}
+
+	err = decoder.checkMembers(int(length))
+	if err != nil {
+		return nil, err
+	}
+
+	value := &Value{Kind: KindArray}
+	err = decoder.addValueReference(value)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		key, err := decoder.readUTF8()
+		if err != nil {
+			return nil, err
+		}
+
+		if key == "" {
+			break
+		}
+
+		err = decoder.checkMembers(int(length) + len(value.Members) + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := decoder.readNextValue()
+		if err != nil {
+			return nil, prependPath(err, memberElem(key))
+		}
+
+		value.Members = append(value.Members, Member{key, v})
+	}
+
+	value.Elements = make([]*Value, 0, min(length, maxPrealloc))
+	for i := uint32(0); i < length; i++ {
+		v, err := decoder.readNextValue()
+		if err != nil {
+			return nil, prependPath(err, indexElem(int(i)))
+		}
+
+		value.Elements = append(value.Elements, v)
+	}
+
+	return value, nil
+}
+
+func (decoder *Decoder) readTraits(index uint32) (*Traits, error) {
+	if (index & 0x01) == 0 {
+		index >>= 1
+		if int(index) >= len(decoder.traitsCache) {
+			return nil, errors.New("invalid traits reference:" + strconv.Itoa(int(index)))
+		}
+		if decoder.refs != nil {
+			decoder.refs.add(int(index), decoder.refs.traits)
+		}
+		return decoder.traitsCache[index], nil
+	}
+
+	traits := new(Traits)
+	traits.Externalizable = (index & 0x02) != 0
+	traits.Dynamic = (index & 0x04) != 0
+	count := index >> 3
+
+	class, err := decoder.readUTF8()
+	if err != nil {
+		return nil, err
+	}
+	traits.Class = class
+
+	if traits.Externalizable {
+		return traits, decoder.addTraits(traits)
+	}
+
+	err = decoder.checkMembers(int(count))
+	if err != nil {
+		return nil, err
+	}
+
+	traits.Members = make([]string, 0, min(count, maxPrealloc))
+	for i := uint32(0); i < count; i++ {
+		name, err := decoder.readUTF8()
+		if err != nil {
+			return nil, err
+		}
+		traits.Members = append(traits.Members, name)
+	}
+
+	return traits, decoder.addTraits(traits)
+}
+
+func (decoder *Decoder) readObjectValue() (*Value, error) {
+	ref, index, err := decoder.readReference(OBJECT_MARKER)
+	if ref != nil || err != nil {
+		return ref, err
+	}
+
+	traits, err := decoder.readTraits(index)
+	if err != nil {
+		return nil, err
+	}
+
+	if traits.Externalizable {
+		return decoder.readExternalValue(traits)
+	}
+
+	value := &Value{Kind: KindObject, Traits: traits}
+	err = decoder.addValueReference(value)
+	if err != nil {
+		return nil, err
+	}
+
+	value.Sealed = make([]*Value, 0, len(traits.Members))
+	for i := 0; i < len(traits.Members); i++ {
+		v, err := decoder.readNextValue()
+		if err != nil {
+			return nil, prependPath(err, memberElem(traits.Members[i]))
+		}
+		value.Sealed = append(value.Sealed, v)
+	}
+
+	if !traits.Dynamic {
+		return value, nil
+	}
+
+	for {
+		key, err := decoder.readUTF8()
+		if err != nil {
+			return nil, err
+		}
+
+		if key == "" {
+			break
+		}
+
+		err = decoder.checkMembers(len(value.Sealed) + len(value.Members) + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := decoder.readNextValue()
+		if err != nil {
+			return nil, prependPath(err, memberElem(key))
+		}
+
+		value.Members = append(value.Members, Member{key, v})
+	}
+
+	return value, nil
+}
+
+func (decoder *Decoder) readVectorValue(marker byte) (*Value, error) {
+	ref, length, err := decoder.readReference(marker)
+	if ref != nil || err != nil {
+		return ref, err
+	}
+
+	err = decoder.checkMembers(int(length))
+	if err != nil {
+		return nil, err
+	}
+
+	fixed, err := decoder.readMarker()
+	if err != nil {
+		return nil, err
+	}
+
+	value := &Value{Kind: KindVector, VectorType: marker, Fixed: fixed != 0}
+	if marker == VECTOR_OBJECT_MARKER {
+		value.ElemType, err = decoder.readUTF8()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = decoder.addValueReference(value)
+	if err != nil {
+		return nil, err
+	}
+
+	value.Elements = make([]*Value, 0, min(length, maxPrealloc))
+	for i := uint32(0); i < length; i++ {
+		var v *Value
+		switch marker {
+		case VECTOR_INT_MARKER, VECTOR_UINT_MARKER:
+			n, err := decoder.readUint32()
+			if err != nil {
+				return nil, err
+			}
+			if marker == VECTOR_INT_MARKER {
+				v = &Value{Kind: KindInteger, Int: int64(int32(n))}
+			} else {
+				v = &Value{Kind: KindInteger, Int: int64(n)}
+			}
+		case VECTOR_DOUBLE_MARKER:
+			f, err := decoder.readDouble()
+			if err != nil {
+				return nil, err
+			}
+			v = NewDouble(f)
+		default:
+			v, err = decoder.readNextValue()
+			if err != nil {
+				return nil, prependPath(err, indexElem(int(i)))
+			}
+		}
+		value.Elements = append(value.Elements, v)
+	}
+
+	return value, nil
+}
+
+func (decoder *Decoder) readDictionaryValue() (*Value, error) {
+	ref, length, err := decoder.readReference(DICTIONARY_MARKER)
+	if ref != nil || err != nil {
+		return ref, err
+	}
+
+	err = decoder.checkMembers(int(length))
+	if err != nil {
+		return nil, err
+	}
+
+	weak, err := decoder.readMarker()
+	if err != nil {
+		return nil, err
+	}
+
+	value := &Value{Kind: KindDictionary, WeakKeys: weak != 0}
+	err = decoder.addValueReference(value)
+	if err != nil {
+		return nil, err
+	}
+
+	value.Entries = make([]Entry, 0, min(length, maxPrealloc))
+	for i := uint32(0); i < length; i++ {
+		k, err := decoder.readNextValue()
+		if err != nil {
+			return nil, prependPath(err, indexElem(int(i)))
+		}
+
+		v, err := decoder.readNextValue()
+		if err != nil {
+			return nil, prependPath(err, entryElem(k, int(i)))
+		}
+
+		value.Entries = append(value.Entries, Entry{k, v})
+	}
+
+	return value, nil
+}
+
+//WriteValue encodes a document tree, or any other value like Encode does. A
+//tree produced by Decoder.ReadValue is written back byte for byte, provided
+//the original encoder used string references whenever possible, as flash
+//player and this package do.
+func (encoder *Encoder) WriteValue(value AMFAny) error {
+	return encoder.Encode(value)
+}
+
+func (encoder *Encoder) writeValue(value *Value) error {
+	if value == nil {
+		return encoder.encodeNull()
+	}
+
+	switch value.Kind {
+	case KindUndefined:
+		return encoder.writeMarker(UNDEFINED_MARKER)
+	case KindNull:
+		return encoder.encodeNull()
+	case KindBool:
+		return encoder.encodeBool(value.Bool)
+	case KindInteger:
+		if value.Int < -0x10000000 || value.Int > 0xfffffff {
+			return encoder.encodeFloat(float64(value.Int))
+		}
+		err := encoder.writeMarker(INTEGER_MARKER)
+		if err != nil {
+			return err
+		}
+		return encoder.writeU29(uint32(value.Int) & 0x1fffffff)
+	case KindDouble:
+		return encoder.encodeFloat(value.Float)
+	case KindString:
+		return encoder.encodeString(value.Str)
+	}
+
+	marker, err := value.marker()
+	if err != nil {
+		return err
+	}
+
+	err = encoder.writeMarker(marker)
+	if err != nil {
+		return err
+	}
+
+	ok, err := encoder.writeValueReference(value)
+	if ok || err != nil {
+		return err
+	}
+
+	switch value.Kind {
+	case KindXMLDocument, KindXML:
+		err = encoder.writeU29(uint32(len(value.Str)<<1) | 0x01)
+		if err != nil {
+			return err
+		}
+		return encoder.writeBytes([]byte(value.Str))
+	case KindByteArray:
+		err = encoder.writeU29(uint32(len(value.Bytes)<<1) | 0x01)
+		if err != nil {
+			return err
+		}
+		return encoder.writeBytes(value.Bytes)
+	case KindDate:
+		err = encoder.writeU29(0x01)
+		if err != nil {
+			return err
+		}
+		return encoder.writeDouble(value.Float)
+	case KindArray:
+		return encoder.writeArrayValue(value)
+	case KindObject:
+		return encoder.writeObjectValue(value)
+	case KindVector:
+		return encoder.writeVectorValue(value)
+	default:
+		return encoder.writeDictionaryValue(value)
+	}
+}
+
+func (value *Value) marker() (byte, error) {
+	switch value.Kind {
+	case KindDate:
+		return DATE_MARKER, nil
+	case KindXMLDocument:
+		return XMLDOC_MARKER, nil
+	case KindXML:
+		return XML_MARKER, nil
+	case KindByteArray:
+		return BYTEARRAY_MARKER, nil
+	case KindArray:
+		return ARRAY_MARKER, nil
+	case KindObject:
+		return OBJECT_MARKER, nil
+	case KindVector:
+		switch value.VectorType {
+		case VECTOR_INT_MARKER, VECTOR_UINT_MARKER, VECTOR_DOUBLE_MARKER, VECTOR_OBJECT_MARKER:
+			return value.VectorType, nil
+		}
+		return 0, errors.New("invalid vector type:" + strconv.Itoa(int(value.VectorType)))
+	case KindDictionary:
+		return DICTIONARY_MARKER, nil
+	}
+
+	return 0, errors.New("invalid value kind:" + value.Kind.String())
+}
+
+//writeValueReference writes a reference if the value has been written before,
+//otherwise it registers the value in the object table
+func (encoder *Encoder) writeValueReference(value *Value) (bool, error) {
+	index, ok := encoder.valueCache[value]
+	if ok {
+		return true, encoder.writeU29(uint32(index << 1))
+	}
+
+	encoder.valueCache[value] = encoder.objectCount
+	encoder.objectCount++
+	return false, nil
+}
+
+func (encoder *Encoder) writeArrayValue(value *Value) error {
+	err := encoder.writeU29(uint32(len(value.Elements)<<1) | 0x01)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range value.Members {
+		if m.Key == "" {
+			return errors.New("empty key not allowed in array")
+		}
+
+		err = encoder.writeString(m.Key)
+		if err != nil {
+			return err
+		}
+
+		err = encoder.writeValue(m.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = encoder.writeString("")
+	if err != nil {
+		return err
+	}
+
+	for _, e := range value.Elements {
+		err = encoder.writeValue(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (encoder *Encoder) writeTraits(traits *Traits) error {
+	index, ok := encoder.traitsCache[traits]
+	if ok {
+		return encoder.writeU29(uint32(index<<2) | 0x01)
+	}
+	encoder.traitsCache[traits] = encoder.traitsCount
+	encoder.traitsCount++
+
+	header := uint32(0x03)
+	if traits.Externalizable {
+		header |= 0x04
+	} else {
+		if traits.Dynamic {
+			header |= 0x08
+		}
+		header |= uint32(len(traits.Members)) << 4
+	}
+
+	err := encoder.writeU29(header)
+	if err != nil {
+		return err
+	}
+
+	err = encoder.writeString(traits.Class)
+	if err != nil {
+		return err
+	}
+
+	if traits.Externalizable {
+		return nil
+	}
+
+	for _, name := range traits.Members {
+		err = encoder.writeString(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (encoder *Encoder) writeObjectValue(value *Value) error {
+	traits := value.Traits
+	if traits == nil {
+		traits = &Traits{Dynamic: true}
+	}
+
+	if traits.Externalizable {
+		if value.External == nil {
+			return errors.New("externalizable class:" + traits.Class + " without external value")
+		}
+
+		err := encoder.writeTraits(traits)
+		if err != nil {
+			return err
+		}
+		return value.External.WriteExternal(encoder)
+	}
+
+	if len(value.Sealed) != len(traits.Members) {
+		return errors.New("sealed members of class:" + traits.Class + " mismatch traits")
+	}
+
+	err := encoder.writeTraits(traits)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range value.Sealed {
+		err = encoder.writeValue(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !traits.Dynamic {
+		return nil
+	}
+
+	for _, m := range value.Members {
+		if m.Key == "" {
+			return errors.New("empty key not allowed in object")
+		}
+
+		err = encoder.writeString(m.Key)
+		if err != nil {
+			return err
+		}
+
+		err = encoder.writeValue(m.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return encoder.writeString("")
+}
+
+func (encoder *Encoder) writeVectorValue(value *Value) error {
+	err := encoder.writeU29(uint32(len(value.Elements)<<1) | 0x01)
+	if err != nil {
+		return err
+	}
+
+	fixed := byte(0)
+	if value.Fixed {
+		fixed = 1
+	}
+	err = encoder.writeMarker(fixed)
+	if err != nil {
+		return err
+	}
+
+	if value.VectorType == VECTOR_OBJECT_MARKER {
+		err = encoder.writeString(value.ElemType)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, e := range value.Elements {
+		switch value.VectorType {
+		case VECTOR_INT_MARKER, VECTOR_UINT_MARKER:
+			if e == nil || e.Kind != KindInteger {
+				return errors.New("integer expected in vector")
+			}
+			err = encoder.writeUint32(uint32(e.Int))
+		case VECTOR_DOUBLE_MARKER:
+			if e == nil || (e.Kind != KindDouble && e.Kind != KindInteger) {
+				return errors.New("double expected in vector")
+			}
+			f := e.Float
+			if e.Kind == KindInteger {
+				f = float64(e.Int)
+			}
+			err = encoder.writeDouble(f)
+		default:
+			err = encoder.writeValue(e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (encoder *Encoder) writeDictionaryValue(value *Value) error {
+	err := encoder.writeU29(uint32(len(value.Entries)<<1) | 0x01)
+	if err != nil {
+		return err
+	}
+
+	weak := byte(0)
+	if value.WeakKeys {
+		weak = 1
+	}
+	err = encoder.writeMarker(weak)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range value.Entries {
+		err = encoder.writeValue(e.Key)
+		if err != nil {
+			return err
+		}
+
+		err = encoder.writeValue(e.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package amf
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestValueKinds(t *testing.T) {
+	date := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	point := &Value{Kind: KindObject, Traits: &Traits{Class: "test.Point", Members: []string{"x", "y"}}, Sealed: []*Value{NewInteger(1), NewInteger(2)}}
+	dynamic := &Value{Kind: KindObject, Traits: &Traits{Class: "", Dynamic: true}, Members: []Member{{Key: "a", Value: NewString("b")}}}
+	mixed := NewArray(NewInteger(1))
+	mixed.Members = []Member{{Key: "k", Value: NewBool(true)}}
+
+	tests := []struct {
+		value *Value
+		text  string
+	}{
+		{NewUndefined(), "undefined"},
+		{NewNull(), "null"},
+		{NewBool(true), "true"},
+		{NewInteger(-5), "-5"},
+		{NewDouble(1.5), "1.5"},
+		{NewString("héllo"), `"héllo"`},
+		{NewDate(date), "date(2020-01-02T03:04:05.006Z)"},
+		{&Value{Kind: KindXML, Str: "<a/>"}, `xml("<a/>")`},
+		{&Value{Kind: KindXMLDocument, Str: "<b/>"}, `xmldocument("<b/>")`},
+		{NewByteArray([]byte{1, 2}), "bytearray(0102)"},
+		{NewArray(NewInteger(1), NewString("x")), `[1, "x"]`},
+		{mixed, `[1, "k": true]`},
+		{point, "test.Point{x: 1, y: 2}"},
+		{dynamic, `{"a": "b"}`},
+		{&Value{Kind: KindVector, VectorType: VECTOR_INT_MARKER, Fixed: true, Elements: []*Value{NewInteger(-1), NewInteger(2)}}, "vector[-1, 2]"},
+		{&Value{Kind: KindVector, VectorType: VECTOR_UINT_MARKER, Elements: []*Value{{Kind: KindInteger, Int: 0xffffffff}}}, "vector[4294967295]"},
+		{&Value{Kind: KindVector, VectorType: VECTOR_DOUBLE_MARKER, Elements: []*Value{NewDouble(0.5)}}, "vector[0.5]"},
+		{&Value{Kind: KindVector, VectorType: VECTOR_OBJECT_MARKER, ElemType: "test.Point", Elements: []*Value{point}}, "vector.<test.Point>[test.Point{x: 1, y: 2}]"},
+		{&Value{Kind: KindDictionary, WeakKeys: true, Entries: []Entry{{NewInteger(1), NewString("one")}, {point, NewNull()}}}, `dictionary{1: "one", test.Point{x: 1, y: 2}: null}`},
+	}
+
+	for _, test := range tests {
+		if text := test.value.String(); text != test.text {
+			t.Errorf("%s formatted as %s", test.text, text)
+		}
+
+		data, err := Marshal(test.value)
+		if err != nil {
+			t.Errorf("%s: %v", test.text, err)
+			continue
+		}
+		decoded, err := NewDecoder(bytes.NewReader(data)).ReadValue()
+		if err != nil || decoded.Kind != test.value.Kind || decoded.String() != test.text {
+			t.Errorf("%s: decoded %v, %v", test.text, decoded, err)
+			continue
+		}
+		again, err := Marshal(decoded)
+		if err != nil || !bytes.Equal(again, data) {
+			t.Errorf("%s: encoded again as % x, want % x, %v", test.text, again, data, err)
+		}
+	}
+
+	//null is a nil pointer when decoded into a *Value, ReadValue keeps its kind
+	if value, err := UnmarshalAs[*Value]([]byte{NULL_MARKER}); value != nil || err != nil {
+		t.Errorf("null decoded as %v, %v", value, err)
+	}
+
+	//integers out of the 29 bits of amf3 are written as doubles
+	data, _ := Marshal(NewInteger(0x10000000))
+	if value, err := NewDecoder(bytes.NewReader(data)).ReadValue(); err != nil || value.Kind != KindDouble || value.Float != 0x10000000 {
+		t.Errorf("large integer decoded as %#v, %v", value, err)
+	}
+
+	if !NewDate(date).Time().Equal(date.Truncate(time.Millisecond)) {
+		t.Errorf("date decoded as %v", NewDate(date).Time())
+	}
+	if Kind(99).String() != "kind(99)" {
+		t.Errorf("unknown kind named %s", Kind(99))
+	}
+}
+
+//TestValueReferences checks a value found several times in a tree is written
+//once and decoded as the same *Value
+func TestValueReferences(t *testing.T) {
+	shared := NewByteArray([]byte("shared"))
+	traits := &Traits{Class: "test.Point", Members: []string{"x", "y"}}
+	first := &Value{Kind: KindObject, Traits: traits, Sealed: []*Value{NewInteger(1), shared}}
+	second := &Value{Kind: KindObject, Traits: traits, Sealed: []*Value{NewInteger(2), shared}}
+	root := NewArray(first, second, first, NewString("test.Point"), NewString("test.Point"))
+	root.Elements = append(root.Elements, root)
+
+	data, err := Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("shared")); n != 1 {
+		t.Errorf("shared bytes written %d times", n)
+	}
+	if n := bytes.Count(data, []byte("test.Point")); n != 1 {
+		t.Errorf("class name written %d times", n)
+	}
+
+	decoded, err := UnmarshalAs[*Value](data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elements := decoded.Elements
+	if len(elements) != 6 || elements[0] != elements[2] || elements[0] == elements[1] || elements[5] != decoded ||
+		elements[0].Sealed[1] != elements[1].Sealed[1] || elements[0].Traits != elements[1].Traits {
+		t.Errorf("decoded %v", decoded)
+	}
+	if decoded.Elements[0].String() != first.String() || decoded.Elements[1].String() != second.String() {
+		t.Errorf("decoded %s", decoded)
+	}
+
+	again, err := Marshal(decoded)
+	if err != nil || !bytes.Equal(again, data) {
+		t.Errorf("encoded again as % x, want % x, %v", again, data, err)
+	}
+}
+
+func TestValueMember(t *testing.T) {
+	object := &Value{Kind: KindObject, Traits: &Traits{Class: "c", Dynamic: true, Members: []string{"sealed"}}, Sealed: []*Value{NewInteger(1)}, Members: []Member{{Key: "dynamic", Value: NewInteger(2)}}}
+	tests := []struct {
+		key string
+		ok  bool
+		int int64
+	}{
+		{"sealed", true, 1},
+		{"dynamic", true, 2},
+		{"missing", false, 0},
+	}
+
+	for _, test := range tests {
+		member, ok := object.Member(test.key)
+		if ok != test.ok || ok && member.Int != test.int {
+			t.Errorf("%s: %v, %v", test.key, member, ok)
+		}
+	}
+
+	var decoded struct {
+		Sealed  int
+		Dynamic int
+	}
+	err := object.Decode(&decoded)
+	if err != nil || decoded.Sealed != 1 || decoded.Dynamic != 2 {
+		t.Errorf("decoded %+v, %v", decoded, err)
+	}
+	if object.Class() != "c" || NewArray().Class() != "" {
+		t.Error("class of a document")
+	}
+}